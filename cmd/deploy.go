@@ -3,7 +3,10 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
 	"path"
+	"sort"
+	"sync"
 
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/spf13/cobra"
@@ -61,6 +64,30 @@ func deploy(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// Cancel running actions on SIGINT or SIGTERM. Targets which
+	// have not started are skipped.
+	baseCtx, cancel := signalContext(log)
+	defer cancel()
+
+	// The status of each target is reported once all have finished.
+	// A target is only ok if every role applied to it succeeded.
+	var statusMu sync.Mutex
+	status := make(map[string]string)
+	setStatus := func(target inventories.Target, s string) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+
+		if s == "ok" && status[target.Name] != "" {
+			return
+		}
+
+		status[target.Name] = s
+	}
+
+	// Connections are shared by every role deployed to a target.
+	cache := connections.NewCache()
+	defer cache.Close()
+
 	for roleName, role := range roles {
 		inv := role.Inventories
 		if len(inv) == 0 {
@@ -96,44 +123,112 @@ func deploy(cmd *cobra.Command, args []string) {
 					continue
 				}
 
+				// Options set by the inventory for a target
+				// override those of the connection.
+				connOptions := make(map[string]interface{})
+				for k, v := range connInfo.Options {
+					connOptions[k] = v
+				}
+
+				for k, v := range t.ConnectionOptions {
+					connOptions[k] = v
+				}
+
+				// A target with its own connection options
+				// doesn't share a connection to its address.
+				key := fmt.Sprintf("%s/%s", connName, t.Address)
+				if len(t.ConnectionOptions) > 0 {
+					key = fmt.Sprintf("%s/%s/%s", connName, t.Name, t.Address)
+				}
+
+				t.InventoryName = invName
 				t.ConnectionName = connName
 				t.ConnectionType = connInfo.Type
-				t.ConnectionOptions = connInfo.Options
+				t.ConnectionOptions = connOptions
+
+				if baseCtx.Err() != nil {
+					setStatus(t, "interrupted")
+					continue
+				}
 
 				swg.Add()
 				go func(roleName string, target inventories.Target) {
 					defer swg.Done()
-					connOptions := target.ConnectionOptions
-					connOptions["host"] = target.Address
-					conn, err := connections.New(target.ConnectionType, connOptions)
-					if err != nil {
-						log.Errorf("Error creating connection to %s: %s", target.Address, err)
-						return
+
+					// fail records an error as an interruption if the
+					// deploy was cancelled while it was running.
+					fail := func(format string, args ...interface{}) {
+						if baseCtx.Err() != nil {
+							setStatus(target, "interrupted")
+						} else {
+							setStatus(target, "failed")
+						}
+
+						log.Errorf(format, args...)
 					}
 
-					if err := conn.Connect(); err != nil {
-						log.Errorf("Error connecting to %s: %s", target.Address, err)
+					connOptions := make(map[string]interface{})
+					for k, v := range target.ConnectionOptions {
+						connOptions[k] = v
+					}
+					connOptions["host"] = target.Address
+
+					conn, err := cache.Get(baseCtx, key, target.ConnectionType, connOptions)
+					if err != nil {
+						fail("Error connecting to %s: %s", target.Address, err)
 						return
 					}
-					defer conn.Close()
 
 					L := utils.LuaPool.Get()
 					defer utils.LuaPool.Shutdown()
 
-					ctx := context.WithValue(context.Background(), "connection", conn)
+					// Anything tied to the role run, such as a
+					// tunnel, is closed when it finishes.
+					roleCtx, roleCancel := context.WithCancel(baseCtx)
+					defer roleCancel()
+
+					ctx := context.WithValue(roleCtx, "connection", conn)
+					ctx = context.WithValue(ctx, "host", target.Name)
 					L.SetContext(ctx)
 					resources.Register(L)
+					L.SetGlobal("target", target.ToLTable(L))
 
 					file := fmt.Sprintf("/opt/bagel/roles/%s.lua", roleName)
 					if err := L.DoFile(file); err != nil {
-						log.Errorf("Error deploying role %s: %s", roleName, err)
+						fail("Error deploying role %s to %s: %s", roleName, target.Name, err)
 						return
 					}
 
+					setStatus(target, "ok")
+
 					return
 				}(roleName, t)
 				swg.Wait()
 			}
 		}
 	}
+
+	if len(status) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var interrupted bool
+	for _, name := range names {
+		log.Infof("%s: %s", name, status[name])
+		if status[name] == "interrupted" {
+			interrupted = true
+		}
+	}
+
+	if interrupted {
+		cache.Close()
+		cancel()
+		os.Exit(130)
+	}
 }
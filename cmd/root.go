@@ -3,9 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/jtopjian/bagel/lib/connections"
 )
 
 var (
@@ -31,6 +34,9 @@ func init() {
 
 	rootCmd.PersistentFlags().Bool("debug", false, "debug mode")
 	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
+
+	rootCmd.PersistentFlags().Bool("stream-output", false, "stream command output as it is received")
+	viper.BindPFlag("stream_output", rootCmd.PersistentFlags().Lookup("stream-output"))
 }
 
 func initConfig() {
@@ -46,6 +52,11 @@ func initConfig() {
 	viper.ReadInConfig()
 
 	viper.SetDefault("site_dir", "/opt/bagel")
+
+	// Connection plugins in the site are used before those in PATH.
+	connections.PluginDirs = []string{
+		path.Join(viper.GetString("site_dir"), "plugins"),
+	}
 }
 
 func Execute() {
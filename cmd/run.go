@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/inventories"
 	"github.com/jtopjian/bagel/lib/resources"
 	"github.com/jtopjian/bagel/lib/utils"
 )
@@ -38,11 +39,23 @@ func run(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	ctx := context.WithValue(context.Background(), "connection", conn)
+	// Cancel running actions on SIGINT or SIGTERM.
+	baseCtx, cancel := signalContext(log)
+	defer cancel()
+
+	ctx := context.WithValue(baseCtx, "connection", conn)
+	ctx = context.WithValue(ctx, "host", "localhost")
 	L.SetContext(ctx)
 
 	resources.Register(L)
 
+	target := inventories.Target{
+		Name:           "localhost",
+		Address:        "localhost",
+		ConnectionType: "local",
+	}
+	L.SetGlobal("target", target.ToLTable(L))
+
 	if err := L.DoFile(file); err != nil {
 		log.Fatal(err)
 	}
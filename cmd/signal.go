@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// signalContext returns a context which is cancelled on the first
+// SIGINT or SIGTERM so running actions can stop and clean up. A
+// second signal exits immediately.
+func signalContext(log *logrus.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Warnf("Received %s, interrupting running actions. Send again to exit immediately.", sig)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigCh)
+			return
+		}
+
+		<-sigCh
+		log.Warn("Exiting immediately")
+		os.Exit(130)
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigCh)
+		cancel()
+	}
+}
@@ -0,0 +1,767 @@
+package connections
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BecomeMethodSudo = "sudo"
+	BecomeMethodSu   = "su"
+	BecomeMethodDoas = "doas"
+
+	BecomeDefaultMethod = BecomeMethodSudo
+	BecomeDefaultUser   = "root"
+)
+
+// becomePromptRe matches the password prompts of su and doas, which
+// can't be set to a known value like sudo's.
+var becomePromptRe = regexp.MustCompile(`(?i)password[^\n]*:\s*$`)
+
+// Become represents options for running an action as another user.
+type Become struct {
+	// Method is how to become the user: sudo, su or doas.
+	// Defaults to sudo.
+	Method string `mapstructure:"method" json:"method,omitempty"`
+
+	// User is the user to become. Defaults to root.
+	User string `mapstructure:"user" json:"user,omitempty"`
+
+	// Password is sent when a password is prompted for. If it is
+	// not set, the method must not require a password.
+	Password string `mapstructure:"password" json:"password,omitempty"`
+}
+
+// method returns the become method, or the default.
+func (r Become) method() string {
+	if r.Method == "" {
+		return BecomeDefaultMethod
+	}
+
+	return r.Method
+}
+
+// user returns the user to become, or the default.
+func (r Become) user() string {
+	if r.User == "" {
+		return BecomeDefaultUser
+	}
+
+	return r.User
+}
+
+// needsTTY reports whether the password must be entered on a
+// terminal. Only sudo can read a password from stdin.
+func (r Become) needsTTY() bool {
+	return r.Password != "" && r.method() != BecomeMethodSudo
+}
+
+// becomeSession wraps a command so it runs as another user and
+// watches its output for password prompts and for a marker which
+// shows the user was successfully become.
+type becomeSession struct {
+	command string
+	user    string
+
+	password string
+	prompt   string
+	marker   string
+	tty      bool
+
+	mu       sync.Mutex
+	stdin    io.WriteCloser
+	answered bool
+	success  bool
+	filters  []*becomeFilter
+}
+
+// newBecomeSession returns a becomeSession which runs command with
+// shell as the user described by b.
+func newBecomeSession(b *Become, shell, command string) (*becomeSession, error) {
+	token := make([]byte, 8)
+	rand.Read(token)
+
+	s := &becomeSession{
+		user:     b.user(),
+		password: b.Password,
+		marker:   fmt.Sprintf("BAGEL-BECOME-SUCCESS-%s", hex.EncodeToString(token)),
+		tty:      b.needsTTY(),
+	}
+
+	// The marker is written to stderr so it doesn't mix with
+	// the command's stdout.
+	command = fmt.Sprintf("echo %s >&2; %s", s.marker, command)
+
+	var args []string
+	switch b.method() {
+	case BecomeMethodSudo:
+		args = []string{"sudo", "-H"}
+		if s.password != "" {
+			s.prompt = fmt.Sprintf("[bagel-become-%s] password: ", hex.EncodeToString(token))
+			args = append(args, "-S", "-p", s.prompt)
+		} else {
+			args = append(args, "-n")
+		}
+		args = append(args, "-u", s.user, "--", shell, "-c", command)
+	case BecomeMethodSu:
+		args = []string{"su", "-s", shell, "-c", command, s.user}
+	case BecomeMethodDoas:
+		args = []string{"doas"}
+		if s.password == "" {
+			args = append(args, "-n")
+		}
+		args = append(args, "-u", s.user, shell, "-c", command)
+	default:
+		return nil, fmt.Errorf("unsupported become method: %s", b.Method)
+	}
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	s.command = strings.Join(args, " ")
+
+	return s, nil
+}
+
+// filter returns a writer which passes output to w, with password
+// prompts and the success marker removed.
+func (r *becomeSession) filter(w io.Writer) io.Writer {
+	f := &becomeFilter{
+		session: r,
+		w:       w,
+	}
+
+	r.mu.Lock()
+	r.filters = append(r.filters, f)
+	r.mu.Unlock()
+
+	return f
+}
+
+// flush writes any held output and closes stdin. It must be called
+// once the command has finished and before its output is closed.
+func (r *becomeSession) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.filters {
+		f.w.Write(f.buf)
+		f.buf = nil
+	}
+
+	r.closeStdin()
+}
+
+// err returns an error if the user could not be become.
+func (r *becomeSession) err(stderr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.success {
+		return nil
+	}
+
+	if stderr == "" {
+		stderr = "no output"
+	}
+
+	return fmt.Errorf("unable to become %s: %s", r.user, stderr)
+}
+
+// answer sends the password. Unless a terminal is in use, stdin
+// is then closed so a rejected password can't cause a hang.
+func (r *becomeSession) answer() {
+	r.answered = true
+
+	if r.stdin == nil {
+		return
+	}
+
+	io.WriteString(r.stdin, r.password+"\n")
+
+	if !r.tty {
+		r.closeStdin()
+	}
+}
+
+func (r *becomeSession) closeStdin() {
+	if r.stdin != nil {
+		r.stdin.Close()
+		r.stdin = nil
+	}
+}
+
+// isPrompt reports whether b ends with a password prompt and
+// returns where the prompt starts.
+func (r *becomeSession) isPrompt(b []byte) (int, bool) {
+	if r.prompt != "" {
+		i := bytes.LastIndex(b, []byte(r.prompt))
+		return i, i >= 0
+	}
+
+	if loc := becomePromptRe.FindIndex(b); loc != nil {
+		return bytes.LastIndexByte(b[:loc[0]], '\n') + 1, true
+	}
+
+	return 0, false
+}
+
+// becomeFilter is a stream of output from a becomeSession.
+type becomeFilter struct {
+	session *becomeSession
+	w       io.Writer
+	buf     []byte
+}
+
+// Write implements io.Writer. Output is held a line at a time until
+// the marker is seen so prompts can be answered and removed.
+func (r *becomeFilter) Write(p []byte) (int, error) {
+	s := r.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.success && !s.tty {
+		return r.w.Write(p)
+	}
+
+	r.buf = append(r.buf, p...)
+
+	for {
+		if s.success {
+			// Terminals end lines with \r\n.
+			r.w.Write(bytes.Replace(r.buf, []byte("\r\n"), []byte("\n"), -1))
+			r.buf = nil
+			break
+		}
+
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			// Prompts do not end with a newline.
+			if s.password != "" && !s.answered {
+				if start, ok := s.isPrompt(r.buf); ok {
+					r.w.Write(r.buf[:start])
+					r.buf = nil
+					s.answer()
+				}
+			}
+
+			break
+		}
+
+		line := strings.TrimRight(string(r.buf[:i]), "\r")
+		r.buf = r.buf[i+1:]
+
+		switch {
+		case line == s.marker:
+			s.success = true
+			s.closeStdin()
+		case s.tty && s.answered && line == "":
+			// The newline echoed after a password is entered.
+		default:
+			r.w.Write([]byte(line + "\n"))
+		}
+	}
+
+	return len(p), nil
+}
+
+// becomeStage creates a private directory on the target to stage files
+// in as the connection user. It returns the directory and the uid and
+// gid of the connection user.
+func becomeStage(ctx context.Context, conn Connection, timeout int) (string, int, int, error) {
+	ro := RunOpts{
+		Command: `d=$(mktemp -d) && chmod 0700 "$d" && echo "$d" && id -u && id -g`,
+		Timeout: timeout,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	lines := strings.Split(rr.Stdout, "\n")
+	if rr.ExitCode != 0 || len(lines) != 3 {
+		return "", 0, 0, fmt.Errorf("unable to create staging directory: %s", rr.Stderr)
+	}
+
+	uid, err := strconv.Atoi(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unable to determine uid: %s", err)
+	}
+
+	gid, err := strconv.Atoi(strings.TrimSpace(lines[2]))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unable to determine gid: %s", err)
+	}
+
+	return strings.TrimSpace(lines[0]), uid, gid, nil
+}
+
+// becomeShare grants the become user access to a staging directory
+// with an ACL. The directory stays closed to every other user.
+func becomeShare(ctx context.Context, conn Connection, b *Become, dir, perms string, timeout int) error {
+	ro := RunOpts{
+		Command: fmt.Sprintf("setfacl -m %s -- %s", shellQuote("u:"+b.user()+":"+perms), shellQuote(dir)),
+		Timeout: timeout,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		return err
+	}
+
+	if rr.ExitCode != 0 {
+		return fmt.Errorf("unable to share the staging directory with %s (is setfacl installed?): %s", b.user(), rr.Stderr)
+	}
+
+	return nil
+}
+
+// becomeUnstage removes a staging directory. It is not cancelled
+// with the action so the directory is removed after an interrupt.
+func becomeUnstage(conn Connection, dir string, timeout int) {
+	ro := RunOpts{
+		Command: "rm -rf -- " + shellQuote(dir),
+		Timeout: timeout,
+	}
+
+	conn.RunCommand(context.Background(), ro)
+}
+
+// becomeStreams reports whether files are streamed to and from the
+// become user rather than staged. Streaming avoids sharing a staging
+// directory with a user other than root, but stdin is needed for the
+// password if there is one.
+func becomeStreams(b *Become) bool {
+	return b.user() != "root" && b.Password == ""
+}
+
+// becomeFileUpload uploads a file as the become user. The file is
+// either streamed to the become user or uploaded to a staging
+// directory as the connection user, and then moved into place as the
+// become user.
+func becomeFileUpload(ctx context.Context, conn Connection, cfo CopyFileOpts) (*FileResult, error) {
+	b := cfo.Become
+
+	if cfo.Mode == 0 {
+		cfo.Mode = 0640
+	}
+
+	if becomeStreams(b) {
+		return becomeStreamUpload(ctx, conn, cfo)
+	}
+
+	stage, uid, gid, err := becomeStage(ctx, conn, cfo.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer becomeUnstage(conn, stage, cfo.Timeout)
+
+	staged := cfo
+	staged.Become = nil
+	staged.Destination = path.Join(stage, "upload")
+	staged.UID = uid
+	staged.GID = gid
+	staged.Mode = 0600
+
+	// The staging directory is shared with a become user other
+	// than root, so the file must be readable by it.
+	if b.user() != "root" {
+		if err := becomeShare(ctx, conn, b, stage, "x", cfo.Timeout); err != nil {
+			return nil, err
+		}
+		staged.Mode = 0644
+	}
+
+	fr, err := conn.FileUpload(ctx, staged)
+	if err != nil {
+		return fr, err
+	}
+
+	tmp := shellQuote(path.Join(path.Dir(cfo.Destination), tempName(path.Base(cfo.Destination))))
+	cmd := fmt.Sprintf("cp -- %s %s && %s && chmod %04o %s && mv -f -- %s %s || { rm -f -- %s; exit 1; }",
+		shellQuote(staged.Destination), tmp, chownCommand(cfo.UID, cfo.GID, tmp), uint32(cfo.Mode.Perm()), tmp,
+		tmp, shellQuote(cfo.Destination), tmp)
+
+	ro := RunOpts{
+		Command: cmd,
+		Timeout: cfo.Timeout,
+		Become:  b,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		fr.Success = false
+		fr.Timeout = rr != nil && rr.Timeout
+		return fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		return nil, fmt.Errorf("unable to move %s into place: %s", cfo.Destination, rr.Stderr)
+	}
+
+	return fr, nil
+}
+
+// becomeStreamUpload sends a file to the become user on stdin. The
+// become user writes it to a temporary file it creates next to the
+// destination, verifies it and moves it into place.
+func becomeStreamUpload(ctx context.Context, conn Connection, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file copy")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file copy")
+	}
+
+	f, err := os.Open(cfo.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sum, err := checksum(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	template := path.Join(path.Dir(cfo.Destination), tempName(path.Base(cfo.Destination))) + "-XXXXXX"
+	script := []string{
+		"t=$(mktemp " + shellQuote(template) + ") || exit 1",
+		`if ! cat > "$t" || [ "$(sha256sum < "$t" | cut -d ' ' -f 1)" != ` + sum + ` ]; then`,
+		`echo "checksum mismatch" >&2; rm -f -- "$t"; exit 1`,
+		"fi",
+		fmt.Sprintf(`%s && chmod %04o "$t" && mv -f -- "$t" %s || { rm -f -- "$t"; exit 1; }`,
+			chownCommand(cfo.UID, cfo.GID, `"$t"`), uint32(cfo.Mode.Perm()), shellQuote(cfo.Destination)),
+	}
+
+	ro := RunOpts{
+		Command: strings.Join(script, "\n"),
+		Timeout: cfo.Timeout,
+		Stdin:   f,
+		Become:  cfo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		fr.Timeout = rr != nil && rr.Timeout
+		return &fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		return nil, fmt.Errorf("unable to upload %s: %s", cfo.Destination, rr.Stderr)
+	}
+
+	fr.Checksum = sum
+	fr.Verified = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// becomeFileDownload downloads a file as the become user. The file is
+// either streamed from the become user or copied to a staging
+// directory as the become user, and then downloaded as the connection
+// user.
+func becomeFileDownload(ctx context.Context, conn Connection, cfo CopyFileOpts) (*FileResult, error) {
+	b := cfo.Become
+
+	if becomeStreams(b) {
+		return becomeStreamDownload(ctx, conn, cfo)
+	}
+
+	stage, uid, gid, err := becomeStage(ctx, conn, cfo.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer becomeUnstage(conn, stage, cfo.Timeout)
+
+	// A become user other than root can't give the copy to the
+	// connection user, so it is made readable instead.
+	tmp := shellQuote(path.Join(stage, "download"))
+	cmd := fmt.Sprintf("cp -- %s %s && chown %d:%d %s", shellQuote(cfo.Source), tmp, uid, gid, tmp)
+	if b.user() != "root" {
+		if err := becomeShare(ctx, conn, b, stage, "wx", cfo.Timeout); err != nil {
+			return nil, err
+		}
+		cmd = fmt.Sprintf("cp -- %s %s && chmod 0644 %s", shellQuote(cfo.Source), tmp, tmp)
+	}
+
+	ro := RunOpts{
+		Command: cmd,
+		Timeout: cfo.Timeout,
+		Become:  b,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		return nil, err
+	}
+
+	if rr.ExitCode != 0 {
+		return nil, fmt.Errorf("unable to copy %s: %s", cfo.Source, rr.Stderr)
+	}
+
+	staged := cfo
+	staged.Become = nil
+	staged.Source = path.Join(stage, "download")
+
+	return conn.FileDownload(ctx, staged)
+}
+
+// becomeStreamDownload reads a file as the become user. It is sent
+// base64 encoded on stdout, decoded as it arrives and verified against
+// the checksum the become user reads before it is renamed into place.
+func becomeStreamDownload(ctx context.Context, conn Connection, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file copy")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file copy")
+	}
+
+	if cfo.Mode == 0 {
+		cfo.Mode = 0640
+	}
+
+	src := shellQuote(cfo.Source)
+	ro := RunOpts{
+		Command: "sha256sum -- " + src,
+		Timeout: cfo.Timeout,
+		Become:  cfo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		fr.Timeout = rr != nil && rr.Timeout
+		return &fr, err
+	}
+
+	fields := strings.Fields(rr.Stdout)
+	if rr.ExitCode != 0 || len(fields) == 0 {
+		return nil, fmt.Errorf("unable to read %s: %s", cfo.Source, rr.Stderr)
+	}
+	expected := fields[0]
+
+	// The output is decoded and written while the command runs. What
+	// isn't read after an error is drained so the command can finish.
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	written := make(chan error, 1)
+	go func() {
+		r := io.TeeReader(base64.NewDecoder(base64.StdEncoding, pr), h)
+		sum, err := writeLocalFile(cfo.Destination, r, cfo.Mode, func(string) error {
+			if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+				return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", cfo.Destination, expected, actual)
+			}
+
+			return nil
+		})
+
+		fr.Checksum = sum
+		io.Copy(ioutil.Discard, pr)
+		written <- err
+	}()
+
+	ro.Command = "base64 -- " + src
+	ro.Stdout = pw
+	rr, err = conn.RunCommand(ctx, ro)
+	if err != nil {
+		pw.CloseWithError(err)
+		<-written
+		fr.Timeout = rr != nil && rr.Timeout
+		return &fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		err := fmt.Errorf("unable to read %s: %s", cfo.Source, rr.Stderr)
+		pw.CloseWithError(err)
+		<-written
+		return nil, err
+	}
+
+	pw.Close()
+	if err := <-written; err != nil {
+		return nil, err
+	}
+
+	fr.Verified = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// becomeFileInfo stats a file as the become user.
+func becomeFileInfo(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	// The first line is the stat output, the second is the link
+	// target and the third is the checksum.
+	p := shellQuote(fo.Path)
+	script := []string{
+		"stat -c '" + statFormat + "' -- " + p + " || exit",
+		"if [ -L " + p + " ]; then readlink -- " + p + "; else echo; fi",
+	}
+
+	if fo.Checksum {
+		script = append(script, "if [ -f "+p+" ] && [ ! -L "+p+" ]; then sha256sum -- "+p+"; fi")
+	}
+
+	ro := RunOpts{
+		Command: strings.Join(script, "\n"),
+		Timeout: fo.Timeout,
+		Become:  fo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		if rr != nil && rr.Timeout {
+			fr.Timeout = true
+			return &fr, nil
+		}
+
+		return nil, err
+	}
+
+	if rr.ExitCode != 0 {
+		if strings.Contains(rr.Stderr, "No such file or directory") {
+			fr.Success = true
+			return &fr, nil
+		}
+
+		return nil, fmt.Errorf("unable to stat %s: %s", fo.Path, rr.Stderr)
+	}
+
+	lines := strings.Split(rr.Stdout, "\n")
+	fi, err := parseStat(path.Base(fo.Path), lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse stat output for %s: %s", fo.Path, rr.Stdout)
+	}
+
+	if len(lines) > 1 {
+		fi.LinkTarget = lines[1]
+	}
+
+	if len(lines) > 2 {
+		if f := strings.Fields(lines[2]); len(f) > 0 {
+			fi.Checksum = f[0]
+		}
+	}
+
+	fr.FileInfo = fi
+	fr.Exists = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// statFormat is the stat format parsed by parseStat.
+const statFormat = "%s|%u|%g|%U|%G|%a|%F|%Y"
+
+// parseStat parses a line of stat output printed with statFormat
+// into a FileInfo for a file called name.
+func parseStat(name, line string) (FileInfo, error) {
+	fields := strings.Split(line, "|")
+	if len(fields) != 8 {
+		return FileInfo{}, fmt.Errorf("unexpected stat output: %s", line)
+	}
+
+	fi := FileInfo{
+		Name:  name,
+		Owner: fields[3],
+		Group: fields[4],
+	}
+
+	fi.Size, _ = strconv.ParseInt(fields[0], 10, 64)
+	fi.UID, _ = strconv.Atoi(fields[1])
+	fi.GID, _ = strconv.Atoi(fields[2])
+	fi.Mode, _ = strconv.Atoi(fields[5])
+
+	// stat prints UNKNOWN for IDs without a name.
+	if fi.Owner == "UNKNOWN" {
+		fi.Owner = ""
+	}
+
+	if fi.Group == "UNKNOWN" {
+		fi.Group = ""
+	}
+
+	switch fields[6] {
+	case "directory":
+		fi.Type = "directory"
+	case "symbolic link":
+		fi.Type = "symlink"
+	case "socket":
+		fi.Type = "socket"
+	case "fifo":
+		fi.Type = "fifo"
+	case "character special file":
+		fi.Type = "char_device"
+	case "block special file":
+		fi.Type = "block_device"
+	default:
+		fi.Type = "file"
+	}
+
+	if mtime, err := strconv.ParseInt(fields[7], 10, 64); err == nil {
+		fi.ModTime = time.Unix(mtime, 0)
+	}
+
+	return fi, nil
+}
+
+// becomeFileDelete deletes a file as the become user.
+func becomeFileDelete(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	ro := RunOpts{
+		Command: "rm -- " + shellQuote(fo.Path),
+		Timeout: fo.Timeout,
+		Become:  fo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		if rr != nil {
+			fr.Timeout = rr.Timeout
+		}
+
+		return &fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		return nil, fmt.Errorf("unable to delete %s: %s", fo.Path, rr.Stderr)
+	}
+
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
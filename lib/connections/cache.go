@@ -0,0 +1,87 @@
+package connections
+
+import (
+	"context"
+	"sync"
+)
+
+// Cache holds open connections so they can be shared by every action
+// run against a target, rather than connecting for each one.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a cached connection, or the error from connecting.
+// Its lock is held while it connects so a target is only connected to
+// once.
+type cacheEntry struct {
+	mu   sync.Mutex
+	conn Connection
+	err  error
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Get returns the connection cached under key. If there is none, a
+// connection is created with connType and options and connected. If
+// that fails, the error is cached and returned for the key from then
+// on, so an unreachable target isn't retried by every role. An error
+// from a done context isn't cached.
+func (r *Cache) Get(ctx context.Context, key, connType string, options map[string]interface{}) (Connection, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &cacheEntry{}
+		r.entries[key] = entry
+	}
+	r.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.conn != nil || entry.err != nil {
+		return entry.conn, entry.err
+	}
+
+	conn, err := New(connType, options)
+	if err != nil {
+		entry.err = err
+		return nil, err
+	}
+
+	if err := conn.Connect(ctx); err != nil {
+		conn.Close()
+
+		if ctx.Err() == nil {
+			entry.err = err
+		}
+
+		return nil, err
+	}
+
+	entry.conn = conn
+
+	return conn, nil
+}
+
+// Close closes every cached connection and empties the cache.
+func (r *Cache) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, entry := range r.entries {
+		entry.mu.Lock()
+		if entry.conn != nil {
+			entry.conn.Close()
+		}
+		entry.mu.Unlock()
+
+		delete(r.entries, key)
+	}
+}
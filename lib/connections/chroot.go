@@ -0,0 +1,350 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const (
+	ChrootMethodChroot = "chroot"
+	ChrootMethodNspawn = "nspawn"
+
+	ChrootDefaultMethod = ChrootMethodChroot
+	ChrootDefaultShell  = "/bin/bash"
+
+	// chrootMaxLinks is the number of symlinks which will be followed
+	// when resolving a path, the same as the Linux limit.
+	chrootMaxLinks = 40
+)
+
+// Chroot represents a connection to a root directory, such as a
+// debootstrap tree. Commands are run inside the root with either
+// chroot or systemd-nspawn and file operations are mapped to paths
+// under the root.
+type Chroot struct {
+	Host       string   `mapstructure:"host"`
+	Root       string   `mapstructure:"root"`
+	Method     string   `mapstructure:"method"`
+	NspawnArgs []string `mapstructure:"nspawn_args"`
+	Shell      string   `mapstructure:"shell"`
+
+	local *Local
+}
+
+// NewChroot will return a Chroot connection. If root is not set,
+// the host option is used as the root directory.
+func NewChroot(options map[string]interface{}) (*Chroot, error) {
+	var chroot Chroot
+
+	err := utils.DecodeAndValidate(options, &chroot)
+	if err != nil {
+		return nil, err
+	}
+
+	if chroot.Root == "" {
+		chroot.Root = chroot.Host
+	}
+
+	if chroot.Root == "" {
+		return nil, fmt.Errorf("missing input: root")
+	}
+
+	chroot.Root, err = filepath.Abs(chroot.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if chroot.Method == "" {
+		chroot.Method = ChrootDefaultMethod
+	}
+
+	if chroot.Method != ChrootMethodChroot && chroot.Method != ChrootMethodNspawn {
+		return nil, fmt.Errorf("unsupported chroot method: %s", chroot.Method)
+	}
+
+	if chroot.Shell == "" {
+		chroot.Shell = ChrootDefaultShell
+	}
+
+	chroot.local, err = NewLocal(map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &chroot, nil
+}
+
+// Connect implements the Connect method of the Connection interface.
+// It verifies the root directory exists.
+func (r *Chroot) Connect(ctx context.Context) error {
+	stat, err := os.Stat(r.Root)
+	if err != nil {
+		return fmt.Errorf("unable to use root %s: %s", r.Root, err)
+	}
+
+	if !stat.IsDir() {
+		return fmt.Errorf("root %s is not a directory", r.Root)
+	}
+
+	if r.Method == ChrootMethodNspawn {
+		if _, err := exec.LookPath("systemd-nspawn"); err != nil {
+			return fmt.Errorf("systemd-nspawn is required for the nspawn method: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// RunCommand implements the RunCommand method of the Connection interface.
+func (r Chroot) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
+	if ro.Command == "" {
+		return nil, fmt.Errorf("a command is required")
+	}
+
+	// The directory and environment are set inside the root.
+	command, err := wrapCommand(ro.Command, ro.Dir, ro.Env)
+	if err != nil {
+		return nil, err
+	}
+	ro.Dir = ""
+	ro.Env = nil
+
+	var args []string
+	switch r.Method {
+	case ChrootMethodNspawn:
+		args = append(args, "systemd-nspawn", "--quiet", "--directory="+r.Root)
+		args = append(args, r.NspawnArgs...)
+	default:
+		args = append(args, "chroot", r.Root)
+	}
+	args = append(args, r.Shell, "-c", command)
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+
+	ro.Command = strings.Join(args, " ")
+
+	return r.local.RunCommand(ctx, ro)
+}
+
+// FileUpload implements the FileUpload method of the Connection interface.
+func (r Chroot) FileUpload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	p, err := r.path(cfo.Destination, true)
+	if err != nil {
+		return nil, err
+	}
+	cfo.Destination = p
+
+	return r.local.FileUpload(ctx, cfo)
+}
+
+// FileDownload implements the FileDownload method of the Connection interface.
+func (r Chroot) FileDownload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	p, err := r.path(cfo.Source, true)
+	if err != nil {
+		return nil, err
+	}
+	cfo.Source = p
+
+	return r.local.FileDownload(ctx, cfo)
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+// A symlink is described rather than the file it points to.
+func (r Chroot) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	p, err := r.path(fo.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	fo.Path = p
+
+	return r.local.FileInfo(ctx, fo)
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+// A symlink is deleted rather than the file it points to.
+func (r Chroot) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	p, err := r.path(fo.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	fo.Path = p
+
+	return r.local.FileDelete(ctx, fo)
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r Chroot) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.MkdirAll(ctx, fo)
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r Chroot) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.Chmod(ctx, fo)
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r Chroot) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.Chown(ctx, fo)
+}
+
+// Rename implements the Rename method of the Connection interface.
+// A symlink is renamed rather than the file it points to.
+func (r Chroot) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, false); err != nil {
+		return nil, err
+	}
+
+	target, err := r.path(fo.Target, false)
+	if err != nil {
+		return nil, err
+	}
+	fo.Target = target
+
+	return r.local.Rename(ctx, fo)
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+// The target is left as it is, since it is resolved inside the root.
+func (r Chroot) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, false); err != nil {
+		return nil, err
+	}
+
+	return r.local.Symlink(ctx, fo)
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r Chroot) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.ReadFile(ctx, fo)
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+func (r Chroot) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.WriteFile(ctx, fo)
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+// A symlink is removed rather than the directory it points to.
+func (r Chroot) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, false); err != nil {
+		return nil, err
+	}
+
+	return r.local.RemoveAll(ctx, fo)
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r Chroot) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if err := r.mapPath(&fo, true); err != nil {
+		return nil, err
+	}
+
+	return r.local.ReadDir(ctx, fo)
+}
+
+// Close implements the Close method of the Connection interface.
+// It peforms no action.
+func (r Chroot) Close() {
+	return
+}
+
+// mapPath maps the path of fo to a path on the local host.
+func (r Chroot) mapPath(fo *FileOpts, followLast bool) error {
+	p, err := r.path(fo.Path, followLast)
+	if err != nil {
+		return err
+	}
+	fo.Path = p
+
+	return nil
+}
+
+// path maps a path inside the root to a path on the local host.
+// Symlinks are resolved as they would be inside the root, so a link
+// to an absolute path such as /etc/resolv.conf can't point outside
+// of it. If followLast is false, the last element of the path is not
+// resolved.
+func (r Chroot) path(p string, followLast bool) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+
+	current := "/"
+	queue := strings.Split(filepath.Clean("/"+p), "/")
+	links := 0
+
+	for len(queue) > 0 {
+		part := queue[0]
+		queue = queue[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		stat, err := os.Lstat(filepath.Join(r.Root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+
+			return "", err
+		}
+
+		if stat.Mode()&os.ModeSymlink == 0 || (len(queue) == 0 && !followLast) {
+			current = next
+			continue
+		}
+
+		links++
+		if links > chrootMaxLinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+
+		target, err := os.Readlink(filepath.Join(r.Root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+
+		queue = append(strings.Split(target, "/"), queue...)
+	}
+
+	return filepath.Join(r.Root, current), nil
+}
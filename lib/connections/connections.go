@@ -11,12 +11,24 @@ func New(connType string, options map[string]interface{}) (Connection, error) {
 	}
 
 	switch connType {
+	case "chroot":
+		return NewChroot(options)
+	case "docker":
+		return NewDocker(options)
 	case "local":
 		return NewLocal(options)
+	case "lxd":
+		return NewLXD(options)
 	case "ssh":
 		return NewSSH(options)
 	default:
-		return nil, fmt.Errorf("unsupported connection type: %s", connType)
+		// Any other type is implemented by a plugin.
+		path, err := FindPlugin(connType)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewPlugin(connType, path, options)
 	}
 
 	return nil, nil
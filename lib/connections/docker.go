@@ -0,0 +1,786 @@
+package connections
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const (
+	DockerDefaultSocket = "unix:///var/run/docker.sock"
+	DockerDefaultShell  = "/bin/sh"
+
+	DockerCommandTimeout = 60
+)
+
+// Docker represents a connection to a container through the
+// Docker Engine API.
+type Docker struct {
+	Host    string `mapstructure:"host" required:"true"`
+	Socket  string `mapstructure:"socket"`
+	Shell   string `mapstructure:"shell"`
+	Timeout int    `mapstructure:"timeout"`
+	User    string `mapstructure:"user"`
+
+	baseURL string
+	client  *http.Client
+}
+
+// NewDocker will return a Docker connection. The host option is the
+// name or ID of the container.
+func NewDocker(options map[string]interface{}) (*Docker, error) {
+	var docker Docker
+
+	err := utils.DecodeAndValidate(options, &docker)
+	if err != nil {
+		return nil, err
+	}
+
+	if docker.Socket == "" {
+		docker.Socket = os.Getenv("DOCKER_HOST")
+	}
+
+	if docker.Socket == "" {
+		docker.Socket = DockerDefaultSocket
+	}
+
+	if docker.Shell == "" {
+		docker.Shell = DockerDefaultShell
+	}
+
+	var network, address string
+	switch {
+	case strings.HasPrefix(docker.Socket, "unix://"):
+		network = "unix"
+		address = strings.TrimPrefix(docker.Socket, "unix://")
+		docker.baseURL = "http://docker"
+	case strings.HasPrefix(docker.Socket, "tcp://"):
+		network = "tcp"
+		address = strings.TrimPrefix(docker.Socket, "tcp://")
+		docker.baseURL = "http://" + address
+	case strings.HasPrefix(docker.Socket, "/"):
+		network = "unix"
+		address = docker.Socket
+		docker.baseURL = "http://docker"
+	default:
+		return nil, fmt.Errorf("unsupported docker socket: %s", docker.Socket)
+	}
+
+	docker.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+
+	return &docker, nil
+}
+
+// Connect implements the Connect method of the Connection interface.
+// It verifies the container exists and is running.
+func (r *Docker) Connect(ctx context.Context) error {
+	var info struct {
+		State struct {
+			Running bool
+		}
+	}
+
+	res, err := r.do(ctx, "GET", r.containerPath("json"), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheckResponse(res); err != nil {
+		return fmt.Errorf("unable to inspect container %s: %s", r.Host, err)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return err
+	}
+
+	if !info.State.Running {
+		return fmt.Errorf("container %s is not running", r.Host)
+	}
+
+	return nil
+}
+
+// RunCommand implements the RunCommand method of the Connection interface.
+// It runs the command through an exec instance in the container.
+func (r Docker) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
+	var rr RunResult
+	var outBuf, errBuf bytes.Buffer
+
+	// validate options
+	if ro.Command == "" {
+		return nil, fmt.Errorf("a command is required")
+	}
+
+	// Exec instances are not attached to stdin.
+	if ro.Stdin != nil {
+		return nil, fmt.Errorf("stdin is not supported by the docker driver")
+	}
+
+	env, err := envList(ro.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run the command as another user if requested. There is no
+	// stdin to send a password over. The directory and environment
+	// are set by the command so they apply to the become user.
+	var become *becomeSession
+	if ro.Become != nil {
+		if ro.Become.Password != "" {
+			return nil, fmt.Errorf("become passwords are not supported by the docker driver")
+		}
+
+		command, err := wrapCommand(ro.Command, ro.Dir, ro.Env)
+		if err != nil {
+			return nil, err
+		}
+
+		become, err = newBecomeSession(ro.Become, r.Shell, command)
+		if err != nil {
+			return nil, err
+		}
+
+		ro.Command = become.command
+		ro.Dir = ""
+		env = nil
+	}
+
+	timeout := DockerCommandTimeout
+	if ro.Timeout > 0 {
+		timeout = ro.Timeout
+	}
+
+	// Set up the output
+	log := ioutil.Discard
+	if ro.Log != nil {
+		log = *ro.Log
+	}
+
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+
+	var output io.Writer = &outBuf
+	if ro.Stdout != nil {
+		output = ro.Stdout
+	}
+
+	outTee := io.TeeReader(outR, output)
+	errTee := io.TeeReader(errR, &errBuf)
+	outDoneCh := make(chan struct{})
+	errDoneCh := make(chan struct{})
+	go printOutput(log, "stdout", outTee, outDoneCh)
+	go printOutput(log, "stderr", errTee, errDoneCh)
+
+	var stdout, stderr io.Writer = outW, errW
+	if become != nil {
+		stdout = become.filter(outW)
+		stderr = become.filter(errW)
+	}
+
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		execID, err := r.execCreate(ctx, []string{r.Shell, "-c", ro.Command}, env, ro.Dir)
+		if err != nil {
+			return err
+		}
+
+		if err := r.execStart(ctx, execID, stdout, stderr); err != nil {
+			return err
+		}
+
+		rr.ExitCode, err = r.execExitCode(ctx, execID)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			rr.Timeout = true
+		}
+	}
+
+	if become != nil {
+		become.flush()
+	}
+
+	outW.Close()
+	errW.Close()
+	<-outDoneCh
+	<-errDoneCh
+
+	rr.Stdout = strings.TrimSpace(outBuf.String())
+	rr.Stderr = strings.TrimSpace(errBuf.String())
+	rr.Applied = true
+
+	if become != nil && err == nil {
+		err = become.err(rr.Stderr)
+	}
+
+	return &rr, err
+}
+
+// FileUpload implements the FileUpload method of the Connection interface.
+// It copies a local file into the container through the archive API.
+func (r Docker) FileUpload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	if cfo.Become != nil {
+		return becomeFileUpload(ctx, &r, cfo)
+	}
+
+	// validate options
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file upload")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file upload")
+	}
+
+	if cfo.Mode == 0 {
+		cfo.Mode = os.FileMode(0640)
+	}
+
+	timeout := DockerCommandTimeout
+	if cfo.Timeout > 0 {
+		timeout = cfo.Timeout
+	}
+
+	local, err := os.Open(cfo.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+
+	stat, err := local.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The archive replaces the file, so an owner which is left as
+	// it is becomes root.
+	uid, gid := cfo.UID, cfo.GID
+	if uid < 0 {
+		uid = 0
+	}
+
+	if gid < 0 {
+		gid = 0
+	}
+
+	hdr := &tar.Header{
+		Name:     path.Base(cfo.Destination),
+		Mode:     int64(cfo.Mode.Perm()),
+		Uid:      uid,
+		Gid:      gid,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Typeflag: tar.TypeReg,
+	}
+
+	// The archive is streamed to the API rather than built in memory.
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := tw.WriteHeader(hdr); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(tw, local); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(tw.Close())
+	}()
+
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		query := url.Values{}
+		query.Set("path", path.Dir(cfo.Destination))
+
+		headers := map[string]string{
+			"Content-Type": "application/x-tar",
+		}
+
+		res, err := r.do(ctx, "PUT", r.containerPath("archive")+"?"+query.Encode(), pr, headers)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		return dockerCheckResponse(res)
+	})
+
+	pr.Close()
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// FileDownload implements the FileDownload method of the Connection interface.
+// It copies a file out of the container through the archive API.
+func (r Docker) FileDownload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	if cfo.Become != nil {
+		return becomeFileDownload(ctx, &r, cfo)
+	}
+
+	// validate options
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file download")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file download")
+	}
+
+	if cfo.Mode == 0 {
+		cfo.Mode = os.FileMode(0640)
+	}
+
+	timeout := DockerCommandTimeout
+	if cfo.Timeout > 0 {
+		timeout = cfo.Timeout
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		tr, closer, err := r.archive(ctx, cfo.Source)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+
+		hdr, err := tr.Next()
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s is not a regular file", cfo.Source)
+		}
+
+		fr.Checksum, err = writeLocalFile(cfo.Destination, contextReader{ctx, tr}, cfo.Mode, nil)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Verified = true
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+// The information is read from the first header of the archive of the
+// path, after which the archive is discarded.
+func (r Docker) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+	var fi FileInfo
+
+	if fo.Path == "" {
+		return nil, fmt.Errorf("path is required for file info")
+	}
+
+	if fo.Become != nil {
+		return becomeFileInfo(ctx, &r, fo)
+	}
+
+	timeout := DockerCommandTimeout
+	if fo.Timeout > 0 {
+		timeout = fo.Timeout
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		tr, closer, err := r.archive(ctx, fo.Path)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+
+		hdr, err := tr.Next()
+		if err != nil {
+			return err
+		}
+
+		stat := hdr.FileInfo()
+		fi.Name = stat.Name()
+		fi.Size = stat.Size()
+		fi.UID = hdr.Uid
+		fi.GID = hdr.Gid
+		fi.Owner = hdr.Uname
+		fi.Group = hdr.Gname
+		fi.Mode = fileMode(stat.Mode())
+		fi.Type = fileType(stat.Mode())
+		fi.ModTime = hdr.ModTime
+		fi.LinkTarget = hdr.Linkname
+
+		if fo.Checksum && fi.Type == "file" {
+			fi.Checksum, err = checksum(tr)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+
+		if os.IsNotExist(err) {
+			fr.Success = true
+		}
+
+		return &fr, nil
+	}
+
+	fr.FileInfo = fi
+	fr.Exists = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+// The archive API has no way of deleting files, so rm is run in the
+// container instead.
+func (r Docker) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	// validate options
+	if fo.Path == "" {
+		return nil, fmt.Errorf("path is required for file delete")
+	}
+
+	if fo.Become != nil {
+		return becomeFileDelete(ctx, &r, fo)
+	}
+
+	ro := RunOpts{
+		Command: fmt.Sprintf("rm -f -- %s", shellQuote(fo.Path)),
+		Timeout: fo.Timeout,
+	}
+
+	rr, err := r.RunCommand(ctx, ro)
+	if err != nil {
+		if rr != nil {
+			fr.Timeout = rr.Timeout
+		}
+
+		fr.Applied = true
+		return &fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		err = fmt.Errorf("unable to delete %s: %s", fo.Path, rr.Stderr)
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+// It runs mkdir in the container.
+func (r Docker) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellMkdirAll(ctx, &r, fo)
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r Docker) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellChmod(ctx, &r, fo)
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r Docker) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellChown(ctx, &r, fo)
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r Docker) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellRename(ctx, &r, fo)
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r Docker) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellSymlink(ctx, &r, fo)
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+// The file is read with FileDownload.
+func (r Docker) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return downloadReadFile(ctx, &r, fo)
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+// The file is written with FileUpload.
+func (r Docker) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return uploadWriteFile(ctx, &r, fo)
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r Docker) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellRemoveAll(ctx, &r, fo)
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r Docker) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellReadDir(ctx, &r, fo)
+}
+
+// Close implements the Close method of the Connection interface.
+func (r Docker) Close() {
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
+
+// containerPath returns the API path of an endpoint of the container.
+func (r Docker) containerPath(endpoint string) string {
+	return fmt.Sprintf("/containers/%s/%s", url.PathEscape(r.Host), endpoint)
+}
+
+// do performs a request against the Docker Engine API.
+func (r Docker) do(ctx context.Context, method, p string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+p, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return r.client.Do(req)
+}
+
+// doJSON performs a request with a JSON body and decodes a JSON response.
+func (r Docker) doJSON(ctx context.Context, method, p string, in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+
+	res, err := r.do(ctx, method, p, bytes.NewReader(b), headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheckResponse(res); err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// execCreate creates an exec instance and returns its ID. env is a
+// list of KEY=value pairs and dir is the working directory, if set.
+func (r Docker) execCreate(ctx context.Context, cmd, env []string, dir string) (string, error) {
+	var resp struct {
+		ID string `json:"Id"`
+	}
+
+	req := map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          false,
+		"Cmd":          cmd,
+	}
+
+	if r.User != "" {
+		req["User"] = r.User
+	}
+
+	if len(env) > 0 {
+		req["Env"] = env
+	}
+
+	if dir != "" {
+		req["WorkingDir"] = dir
+	}
+
+	if err := r.doJSON(ctx, "POST", r.containerPath("exec"), req, &resp); err != nil {
+		return "", fmt.Errorf("unable to create exec in container %s: %s", r.Host, err)
+	}
+
+	return resp.ID, nil
+}
+
+// execStart starts an exec instance and copies its output until it exits.
+func (r Docker) execStart(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	req := map[string]interface{}{
+		"Detach": false,
+		"Tty":    false,
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+
+	res, err := r.do(ctx, "POST", fmt.Sprintf("/exec/%s/start", id), bytes.NewReader(b), headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheckResponse(res); err != nil {
+		return fmt.Errorf("unable to start exec in container %s: %s", r.Host, err)
+	}
+
+	return dockerDemux(res.Body, stdout, stderr)
+}
+
+// execExitCode returns the exit code of a finished exec instance.
+func (r Docker) execExitCode(ctx context.Context, id string) (int, error) {
+	var resp struct {
+		ExitCode int
+	}
+
+	res, err := r.do(ctx, "GET", fmt.Sprintf("/exec/%s/json", id), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheckResponse(res); err != nil {
+		return 0, err
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return 0, err
+	}
+
+	return resp.ExitCode, nil
+}
+
+// archive returns a tar reader of a path in the container. A path
+// which does not exist returns an os.ErrNotExist error.
+func (r Docker) archive(ctx context.Context, p string) (*tar.Reader, io.Closer, error) {
+	query := url.Values{}
+	query.Set("path", p)
+
+	res, err := r.do(ctx, "GET", r.containerPath("archive")+"?"+query.Encode(), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	if err := dockerCheckResponse(res); err != nil {
+		res.Body.Close()
+		return nil, nil, err
+	}
+
+	return tar.NewReader(res.Body), res.Body, nil
+}
+
+// dockerCheckResponse returns the API error message of a failed request.
+func dockerCheckResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+
+	b, _ := ioutil.ReadAll(res.Body)
+	if err := json.Unmarshal(b, &apiErr); err == nil && apiErr.Message != "" {
+		return fmt.Errorf("%s", apiErr.Message)
+	}
+
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+}
+
+// dockerDemux splits a multiplexed exec stream into stdout and stderr.
+// Each frame has an 8 byte header of the stream type, three empty
+// bytes and the big endian size of the frame.
+func dockerDemux(r io.Reader, stdout, stderr io.Writer) error {
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		var w io.Writer
+		switch hdr[0] {
+		case 0, 1:
+			w = stdout
+		case 2:
+			w = stderr
+		default:
+			return fmt.Errorf("unknown stream type %d in exec output", hdr[0])
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
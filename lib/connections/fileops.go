@@ -0,0 +1,323 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The functions in this file implement file actions by running shell
+// commands over a connection. They are used by drivers which have no
+// native way of doing so and when an action is run as another user.
+
+// validateFileOpts checks the options of a file action. A target is
+// required by Rename and Symlink.
+func validateFileOpts(action string, fo FileOpts, needsTarget bool) error {
+	if fo.Path == "" {
+		return fmt.Errorf("path is required for %s", action)
+	}
+
+	if needsTarget && fo.Target == "" {
+		return fmt.Errorf("target is required for %s", action)
+	}
+
+	return nil
+}
+
+// fileAction runs f with the timeout of a file action and returns
+// the result of the action.
+func fileAction(ctx context.Context, timeout int, f func(context.Context) error) (*FileResult, error) {
+	var fr FileResult
+
+	err := timeoutFunc(ctx, timeout, f)
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// shellFileAction runs command for a file action over conn.
+func shellFileAction(ctx context.Context, conn Connection, fo FileOpts, command string) (*FileResult, error) {
+	var fr FileResult
+
+	ro := RunOpts{
+		Command: command,
+		Timeout: fo.Timeout,
+		Become:  fo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		if rr != nil {
+			fr.Timeout = rr.Timeout
+		}
+
+		fr.Applied = true
+		return &fr, err
+	}
+
+	if rr.ExitCode != 0 {
+		err = fmt.Errorf("unable to %s: %s", command, rr.Stderr)
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// shellMkdirAll creates a directory and its parents with mkdir.
+func shellMkdirAll(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("mkdir", fo, false); err != nil {
+		return nil, err
+	}
+
+	command := "mkdir -p -- " + shellQuote(fo.Path)
+	if fo.Mode != 0 {
+		command += fmt.Sprintf(" && chmod %o -- %s", fo.Mode.Perm(), shellQuote(fo.Path))
+	}
+
+	return shellFileAction(ctx, conn, fo, command)
+}
+
+// shellChmod sets the mode of a file with chmod.
+func shellChmod(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("chmod", fo, false); err != nil {
+		return nil, err
+	}
+
+	command := fmt.Sprintf("chmod %o -- %s", fo.Mode.Perm(), shellQuote(fo.Path))
+
+	return shellFileAction(ctx, conn, fo, command)
+}
+
+// shellChown sets the owner and group of a file with chown.
+func shellChown(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("chown", fo, false); err != nil {
+		return nil, err
+	}
+
+	command := chownCommand(fo.UID, fo.GID, shellQuote(fo.Path))
+
+	return shellFileAction(ctx, conn, fo, command)
+}
+
+// chownCommand returns a command which sets the owner and group of a
+// file. An ID below 0 is left as it is.
+func chownCommand(uid, gid int, file string) string {
+	switch {
+	case uid >= 0 && gid >= 0:
+		return fmt.Sprintf("chown %d:%d -- %s", uid, gid, file)
+	case uid >= 0:
+		return fmt.Sprintf("chown %d -- %s", uid, file)
+	case gid >= 0:
+		return fmt.Sprintf("chgrp %d -- %s", gid, file)
+	}
+
+	return "true"
+}
+
+// shellRename moves a file with mv.
+func shellRename(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("rename", fo, true); err != nil {
+		return nil, err
+	}
+
+	command := fmt.Sprintf("mv -f -- %s %s", shellQuote(fo.Path), shellQuote(fo.Target))
+
+	return shellFileAction(ctx, conn, fo, command)
+}
+
+// shellSymlink creates a symlink with ln. Like os.Symlink, it fails
+// if the path already exists.
+func shellSymlink(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("symlink", fo, true); err != nil {
+		return nil, err
+	}
+
+	p := shellQuote(fo.Path)
+	command := fmt.Sprintf("if [ -e %[1]s ] || [ -L %[1]s ]; then echo %[1]s: file exists >&2; exit 1; fi; ln -s -- %[2]s %[1]s",
+		p, shellQuote(fo.Target))
+
+	return shellFileAction(ctx, conn, fo, command)
+}
+
+// shellRemoveAll deletes a path and everything below it with rm.
+func shellRemoveAll(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("remove", fo, false); err != nil {
+		return nil, err
+	}
+
+	return shellFileAction(ctx, conn, fo, "rm -rf -- "+shellQuote(fo.Path))
+}
+
+// shellReadDir describes the entries of a directory with stat. Each
+// entry is printed as four lines: its name, its stat output, its link
+// target and its checksum. The entries are framed by lines containing
+// a dot, since the output of a command is trimmed.
+func shellReadDir(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	if err := validateFileOpts("read dir", fo, false); err != nil {
+		return nil, err
+	}
+
+	sum := "echo"
+	if fo.Checksum {
+		sum = `if [ -f "$f" ] && [ ! -L "$f" ]; then sha256sum -- "$f"; else echo; fi`
+	}
+
+	script := []string{
+		"cd -- " + shellQuote(fo.Path) + " || exit",
+		"echo .",
+		"for f in * .[!.]* ..?*; do",
+		`[ -e "$f" ] || [ -L "$f" ] || continue`,
+		`printf '%s\n' "$f"`,
+		`stat -c '` + statFormat + `' -- "$f" || exit`,
+		`if [ -L "$f" ]; then readlink -- "$f"; else echo; fi`,
+		sum,
+		"done",
+		"echo .",
+	}
+
+	ro := RunOpts{
+		Command: strings.Join(script, "\n"),
+		Timeout: fo.Timeout,
+		Become:  fo.Become,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		if rr != nil && rr.Timeout {
+			fr.Timeout = true
+			return &fr, nil
+		}
+
+		return nil, err
+	}
+
+	if rr.ExitCode != 0 {
+		if strings.Contains(rr.Stderr, "No such file or directory") {
+			fr.Success = true
+			return &fr, nil
+		}
+
+		return nil, fmt.Errorf("unable to read directory %s: %s", fo.Path, rr.Stderr)
+	}
+
+	lines := strings.Split(rr.Stdout, "\n")
+	if len(lines) < 2 || (len(lines)-2)%4 != 0 {
+		return nil, fmt.Errorf("unable to parse directory listing for %s: %s", fo.Path, rr.Stdout)
+	}
+
+	lines = lines[1 : len(lines)-1]
+	for i := 0; i < len(lines); i += 4 {
+		fi, err := parseStat(lines[i], lines[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse stat output for %s: %s", fo.Path, rr.Stdout)
+		}
+
+		fi.LinkTarget = lines[i+2]
+		if f := strings.Fields(lines[i+3]); len(f) > 0 {
+			fi.Checksum = f[0]
+		}
+
+		fr.Entries = append(fr.Entries, fi)
+	}
+
+	sortEntries(fr.Entries)
+
+	fr.Exists = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// sortEntries sorts the entries of a directory by name.
+func sortEntries(entries []FileInfo) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// downloadReadFile reads a file by downloading it to a temporary
+// local file.
+func downloadReadFile(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("read", fo, false); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	cfo := CopyFileOpts{
+		Source:      fo.Path,
+		Destination: filepath.Join(dir, "content"),
+		Mode:        0600,
+		Timeout:     fo.Timeout,
+		Become:      fo.Become,
+	}
+
+	fr, err := conn.FileDownload(ctx, cfo)
+	if err != nil {
+		return fr, err
+	}
+
+	fr.Content, err = ioutil.ReadFile(cfo.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return fr, nil
+}
+
+// uploadWriteFile writes a file by uploading a temporary local file
+// with its content.
+func uploadWriteFile(ctx context.Context, conn Connection, fo FileOpts) (*FileResult, error) {
+	if err := validateFileOpts("write", fo, false); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "content")
+	if err := ioutil.WriteFile(src, fo.Content, 0600); err != nil {
+		return nil, err
+	}
+
+	cfo := CopyFileOpts{
+		Source:      src,
+		Destination: fo.Path,
+		UID:         fo.UID,
+		GID:         fo.GID,
+		Mode:        fo.Mode,
+		Timeout:     fo.Timeout,
+		Become:      fo.Become,
+	}
+
+	return conn.FileUpload(ctx, cfo)
+}
@@ -2,11 +2,16 @@ package connections
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -17,8 +22,6 @@ import (
 const (
 	LocalCommandShell   = "/bin/bash"
 	LocalCommandTimeout = 60
-
-	LocalFileCopyMaxBytes = 4096
 )
 
 // Local represents a local connection.
@@ -45,12 +48,14 @@ func NewLocal(options map[string]interface{}) (*Local, error) {
 
 // Connect implements the Connect method of the Connection interface.
 // It's only here to satisfy the interface.
-func (r Local) Connect() error {
+func (r Local) Connect(ctx context.Context) error {
 	return nil
 }
 
 // RunCommand implements the RunCommand method of the Connection interface.
-func (r Local) RunCommand(ro RunOpts) (*RunResult, error) {
+// The command is run in its own process group, which is killed
+// if ctx is cancelled or the timeout is reached.
+func (r Local) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
 	var err error
 	var rr RunResult
 	var outBuf, errBuf bytes.Buffer
@@ -60,9 +65,49 @@ func (r Local) RunCommand(ro RunOpts) (*RunResult, error) {
 		return nil, fmt.Errorf("a command is required")
 	}
 
+	env, err := envList(ro.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run the command as another user if requested. The directory
+	// and environment are set by the command so they apply to the
+	// become user.
+	var become *becomeSession
+	if ro.Become != nil {
+		if ro.Become.needsTTY() {
+			return nil, fmt.Errorf("become method %s needs a terminal to send a password, which the local driver does not support", ro.Become.method())
+		}
+
+		if ro.Become.Password != "" && ro.Stdin != nil {
+			return nil, fmt.Errorf("stdin can't be used with a become password")
+		}
+
+		command, err := wrapCommand(ro.Command, ro.Dir, ro.Env)
+		if err != nil {
+			return nil, err
+		}
+
+		become, err = newBecomeSession(ro.Become, r.Shell, command)
+		if err != nil {
+			return nil, err
+		}
+
+		ro.Command = become.command
+	}
+
 	// Build the command
 	cmdArgs := []string{r.Shell, "-c", ro.Command}
 	r.c = exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	r.c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	r.c.Stdin = ro.Stdin
+
+	if become == nil {
+		r.c.Dir = ro.Dir
+		if len(env) > 0 {
+			r.c.Env = append(os.Environ(), env...)
+		}
+	}
 
 	// Set up the output
 	log := ioutil.Discard
@@ -83,23 +128,51 @@ func (r Local) RunCommand(ro RunOpts) (*RunResult, error) {
 	r.c.Stdout = outW
 	r.c.Stderr = errW
 
-	outTee := io.TeeReader(outR, &outBuf)
+	if become != nil {
+		r.c.Stdout = become.filter(outW)
+		r.c.Stderr = become.filter(errW)
+
+		if become.password != "" {
+			become.stdin, err = r.c.StdinPipe()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var output io.Writer = &outBuf
+	if ro.Stdout != nil {
+		output = ro.Stdout
+	}
+
+	outTee := io.TeeReader(outR, output)
 	errTee := io.TeeReader(errR, &errBuf)
 	outDoneCh := make(chan struct{})
 	errDoneCh := make(chan struct{})
-	go printOutput(log, outTee, outDoneCh)
-	go printOutput(log, errTee, errDoneCh)
+	go printOutput(log, "stdout", outTee, outDoneCh)
+	go printOutput(log, "stderr", errTee, errDoneCh)
 
 	timeout := LocalCommandTimeout
 	if ro.Timeout > 0 {
 		timeout = ro.Timeout
 	}
 
-	err = timeoutFunc(timeout, func() error {
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
 		if err := r.c.Start(); err != nil {
 			return err
 		}
 
+		waitCh := make(chan struct{})
+		defer close(waitCh)
+
+		go func(pid int) {
+			select {
+			case <-ctx.Done():
+				syscall.Kill(-pid, syscall.SIGKILL)
+			case <-waitCh:
+			}
+		}(r.c.Process.Pid)
+
 		if err := r.c.Wait(); err != nil {
 			if exit, ok := err.(*exec.ExitError); ok {
 				rr.ExitCode = int(exit.ProcessState.Sys().(syscall.WaitStatus) / 256)
@@ -118,6 +191,10 @@ func (r Local) RunCommand(ro RunOpts) (*RunResult, error) {
 		}
 	}
 
+	if become != nil {
+		become.flush()
+	}
+
 	outW.Close()
 	errW.Close()
 	<-outDoneCh
@@ -127,23 +204,35 @@ func (r Local) RunCommand(ro RunOpts) (*RunResult, error) {
 	rr.Stderr = strings.TrimSpace(errBuf.String())
 	rr.Applied = true
 
+	if become != nil && err == nil {
+		err = become.err(rr.Stderr)
+	}
+
 	return &rr, err
 }
 
 // FileUpload implements the FileUpload method of the Connection interface.
 // It peforms a local file copy.
-func (r Local) FileUpload(fo CopyFileOpts) (*FileResult, error) {
-	return r.copyFile(fo)
+func (r Local) FileUpload(ctx context.Context, fo CopyFileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return becomeFileUpload(ctx, r, fo)
+	}
+
+	return r.copyFile(ctx, fo)
 }
 
 // FileDownload implements the FileDownload method of the Connection interface.
 // It peforms a local file copy.
-func (r Local) FileDownload(fo CopyFileOpts) (*FileResult, error) {
-	return r.copyFile(fo)
+func (r Local) FileDownload(ctx context.Context, fo CopyFileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return becomeFileDownload(ctx, r, fo)
+	}
+
+	return r.copyFile(ctx, fo)
 }
 
 // FileInfo implements the FileInfo method of the Connection interface.
-func (r Local) FileInfo(fo FileOpts) (*FileResult, error) {
+func (r Local) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
 	var fr FileResult
 	var fi FileInfo
 	var err error
@@ -152,39 +241,18 @@ func (r Local) FileInfo(fo FileOpts) (*FileResult, error) {
 		return nil, fmt.Errorf("path is required for file exists")
 	}
 
+	if fo.Become != nil {
+		return becomeFileInfo(ctx, r, fo)
+	}
+
 	timeout := LocalCommandTimeout
 	if fo.Timeout > 0 {
 		timeout = fo.Timeout
 	}
 
-	err = timeoutFunc(timeout, func() error {
-		stat, err := os.Stat(fo.Path)
-		if err == nil {
-			fi.Name = stat.Name()
-			fi.Size = stat.Size()
-			fi.UID = int(stat.Sys().(*syscall.Stat_t).Uid)
-			fi.GID = int(stat.Sys().(*syscall.Stat_t).Gid)
-
-			mode := fmt.Sprintf("%o", int(stat.Mode().Perm()))
-			fi.Mode, _ = strconv.Atoi(mode)
-
-			if stat.IsDir() {
-				fi.Type = "directory"
-			}
-
-			if stat.Mode() == os.ModeSymlink {
-				fi.Type = "symlink"
-			}
-
-			if stat.Mode() == os.ModeSocket {
-				fi.Type = "socket"
-			}
-
-			if fi.Type == "" {
-				fi.Type = "file"
-			}
-		}
-
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		fi, err = localFileInfo(ctx, fo.Path, fo.Checksum)
 		return err
 	})
 
@@ -210,7 +278,7 @@ func (r Local) FileInfo(fo FileOpts) (*FileResult, error) {
 }
 
 // FileDelete implements the FileDelete method of the Connection interface.
-func (r Local) FileDelete(fo FileOpts) (*FileResult, error) {
+func (r Local) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
 	var fr FileResult
 	var err error
 
@@ -219,12 +287,16 @@ func (r Local) FileDelete(fo FileOpts) (*FileResult, error) {
 		return nil, fmt.Errorf("path is required for file delete")
 	}
 
+	if fo.Become != nil {
+		return becomeFileDelete(ctx, r, fo)
+	}
+
 	timeout := LocalCommandTimeout
 	if fo.Timeout > 0 {
 		timeout = fo.Timeout
 	}
 
-	err = timeoutFunc(timeout, func() error {
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
 		if err := os.Remove(fo.Path); err != nil {
 			return err
 		}
@@ -247,13 +319,279 @@ func (r Local) FileDelete(fo FileOpts) (*FileResult, error) {
 	return &fr, err
 }
 
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r Local) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellMkdirAll(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("mkdir", fo, false); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		mode := fo.Mode
+		if mode == 0 {
+			mode = os.FileMode(0755)
+		}
+
+		if err := os.MkdirAll(fo.Path, mode); err != nil {
+			return err
+		}
+
+		if fo.Mode != 0 {
+			return os.Chmod(fo.Path, fo.Mode)
+		}
+
+		return nil
+	})
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r Local) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellChmod(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("chmod", fo, false); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		return os.Chmod(fo.Path, fo.Mode)
+	})
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r Local) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellChown(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("chown", fo, false); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		return os.Chown(fo.Path, fo.UID, fo.GID)
+	})
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r Local) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellRename(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("rename", fo, true); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		return os.Rename(fo.Path, fo.Target)
+	})
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r Local) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellSymlink(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("symlink", fo, true); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		return os.Symlink(fo.Target, fo.Path)
+	})
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r Local) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return downloadReadFile(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("read", fo, false); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	fr, err := fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		f, err := os.Open(fo.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		content, err = ioutil.ReadAll(contextReader{ctx, f})
+		return err
+	})
+
+	fr.Content = content
+
+	return fr, err
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+// Like FileUpload, the content is written to a temporary file which is
+// renamed into place.
+func (r Local) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return uploadWriteFile(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("write", fo, false); err != nil {
+		return nil, err
+	}
+
+	if fo.Mode == 0 {
+		fo.Mode = os.FileMode(0640)
+	}
+
+	var sum string
+	fr, err := fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		var err error
+		sum, err = writeLocalFile(fo.Path, contextReader{ctx, bytes.NewReader(fo.Content)}, fo.Mode, func(tmp string) error {
+			return os.Chown(tmp, fo.UID, fo.GID)
+		})
+
+		return err
+	})
+
+	if err == nil {
+		fr.Checksum = sum
+		fr.Verified = true
+	}
+
+	return fr, err
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r Local) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellRemoveAll(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("remove", fo, false); err != nil {
+		return nil, err
+	}
+
+	return fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		return os.RemoveAll(fo.Path)
+	})
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r Local) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellReadDir(ctx, r, fo)
+	}
+
+	if err := validateFileOpts("read dir", fo, false); err != nil {
+		return nil, err
+	}
+
+	var entries []FileInfo
+	fr, err := fileAction(ctx, r.timeout(fo.Timeout), func(ctx context.Context) error {
+		names, err := ioutil.ReadDir(fo.Path)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			fi, err := localFileInfo(ctx, filepath.Join(fo.Path, name.Name()), fo.Checksum)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, fi)
+		}
+
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return &FileResult{Success: true}, nil
+	}
+
+	if err == nil {
+		fr.Entries = entries
+		fr.Exists = true
+	}
+
+	return fr, err
+}
+
 // Close implements the Close method of the Connection interface.
 // It peforms no action.
 func (r Local) Close() {
 	return
 }
 
-func (r Local) copyFile(fo CopyFileOpts) (*FileResult, error) {
+// localFileInfo describes the file at p without following a symlink.
+func localFileInfo(ctx context.Context, p string, withChecksum bool) (FileInfo, error) {
+	var fi FileInfo
+
+	stat, err := os.Lstat(p)
+	if err != nil {
+		return fi, err
+	}
+
+	sys := stat.Sys().(*syscall.Stat_t)
+	fi.Name = stat.Name()
+	fi.Size = stat.Size()
+	fi.UID = int(sys.Uid)
+	fi.GID = int(sys.Gid)
+	fi.Mode = fileMode(stat.Mode())
+	fi.Type = fileType(stat.Mode())
+	fi.ModTime = stat.ModTime()
+
+	if u, err := user.LookupId(strconv.Itoa(fi.UID)); err == nil {
+		fi.Owner = u.Username
+	}
+
+	if g, err := user.LookupGroupId(strconv.Itoa(fi.GID)); err == nil {
+		fi.Group = g.Name
+	}
+
+	if fi.Type == "symlink" {
+		fi.LinkTarget, err = os.Readlink(p)
+		if err != nil {
+			return fi, err
+		}
+	}
+
+	if withChecksum && fi.Type == "file" {
+		f, err := os.Open(p)
+		if err != nil {
+			return fi, err
+		}
+		defer f.Close()
+
+		fi.Checksum, err = checksum(contextReader{ctx, f})
+		if err != nil {
+			return fi, err
+		}
+	}
+
+	return fi, nil
+}
+
+// timeout returns timeout, or the default local timeout if it is unset.
+func (r Local) timeout(timeout int) int {
+	if timeout > 0 {
+		return timeout
+	}
+
+	return LocalCommandTimeout
+}
+
+// copyFile copies a file on the local host. The file is written to a
+// temporary file next to the destination and renamed into place once
+// it has been verified.
+func (r Local) copyFile(ctx context.Context, fo CopyFileOpts) (*FileResult, error) {
 	var fr FileResult
 
 	// validate options
@@ -274,25 +612,19 @@ func (r Local) copyFile(fo CopyFileOpts) (*FileResult, error) {
 		timeout = fo.Timeout
 	}
 
-	destination, err := os.OpenFile(fo.Destination, os.O_RDWR|os.O_CREATE, fo.Mode)
-	if err != nil {
-		return nil, err
-	}
-	defer destination.Close()
-
 	source, err := os.Open(fo.Source)
 	if err != nil {
 		return nil, err
 	}
 	defer source.Close()
 
-	err = timeoutFunc(timeout, func() error {
-		buf := make([]byte, LocalFileCopyMaxBytes)
-		if _, err := io.CopyBuffer(destination, source, buf); err != nil {
-			return err
-		}
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		fr.Checksum, err = writeLocalFile(fo.Destination, contextReader{ctx, source}, fo.Mode, func(tmp string) error {
+			return os.Chown(tmp, fo.UID, fo.GID)
+		})
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -303,19 +635,73 @@ func (r Local) copyFile(fo CopyFileOpts) (*FileResult, error) {
 		return nil, err
 	}
 
-	destination.Close()
-	source.Close()
-
-	if err := os.Chown(fo.Destination, fo.UID, fo.GID); err != nil {
-		return nil, err
-	}
-
+	fr.Verified = true
 	fr.Success = true
 	fr.Applied = true
 
 	return &fr, err
 }
 
+// writeLocalFile writes the contents of r to a temporary file next to
+// dst, verifies the SHA-256 checksum of what was written and renames it
+// to dst. If prepare is set, it is called with the temporary file name
+// before the rename. It returns the checksum of the contents.
+func writeLocalFile(dst string, r io.Reader, mode os.FileMode, prepare func(string) error) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".bagel-")
+	if err != nil {
+		return "", err
+	}
+
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return "", err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	actual, err := checksum(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	if actual != sum {
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", dst, sum, actual)
+	}
+
+	if prepare != nil {
+		if err := prepare(tmp.Name()); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	renamed = true
+
+	return sum, nil
+}
+
 // NewLocalConnection is a convenience function to quickly
 // obtain a local connection.
 func NewLocalConnection() (Connection, error) {
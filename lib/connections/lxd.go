@@ -0,0 +1,919 @@
+package connections
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const (
+	LXDDefaultShell = "/bin/sh"
+
+	LXDCommandTimeout = 60
+)
+
+// LXDDefaultSockets are the unix sockets which are tried, in order,
+// when neither socket nor remote is specified.
+var LXDDefaultSockets = []string{
+	"/var/snap/lxd/common/lxd/unix.socket",
+	"/var/lib/lxd/unix.socket",
+}
+
+// LXD represents a connection to an instance through the LXD REST API.
+type LXD struct {
+	Host    string `mapstructure:"host" required:"true"`
+	Project string `mapstructure:"project"`
+	Shell   string `mapstructure:"shell"`
+	Timeout int    `mapstructure:"timeout"`
+
+	Socket string `mapstructure:"socket"`
+
+	Remote     string `mapstructure:"remote"`
+	ClientCert string `mapstructure:"client_cert"`
+	ClientKey  string `mapstructure:"client_key"`
+	ServerCert string `mapstructure:"server_cert"`
+
+	baseURL string
+	client  *http.Client
+	dialer  *websocket.Dialer
+}
+
+// lxdResponse represents a response of the LXD REST API.
+type lxdResponse struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status_code"`
+	Operation  string          `json:"operation"`
+	ErrorCode  int             `json:"error_code"`
+	Error      string          `json:"error"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+// lxdOperation represents a background operation of the LXD REST API.
+type lxdOperation struct {
+	ID       string                 `json:"id"`
+	Status   string                 `json:"status"`
+	Err      string                 `json:"err"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// NewLXD will return an LXD connection. The host option is the
+// name of the instance.
+func NewLXD(options map[string]interface{}) (*LXD, error) {
+	var lxd LXD
+
+	err := utils.DecodeAndValidate(options, &lxd)
+	if err != nil {
+		return nil, err
+	}
+
+	if lxd.Shell == "" {
+		lxd.Shell = LXDDefaultShell
+	}
+
+	if lxd.Remote != "" {
+		if err := lxd.configureRemote(); err != nil {
+			return nil, err
+		}
+
+		return &lxd, nil
+	}
+
+	if lxd.Socket == "" {
+		if v := os.Getenv("LXD_DIR"); v != "" {
+			lxd.Socket = v + "/unix.socket"
+		}
+	}
+
+	if lxd.Socket == "" {
+		for _, socket := range LXDDefaultSockets {
+			if _, err := os.Stat(socket); err == nil {
+				lxd.Socket = socket
+				break
+			}
+		}
+	}
+
+	if lxd.Socket == "" {
+		return nil, fmt.Errorf("unable to find an LXD socket: specify socket or remote")
+	}
+
+	socket := lxd.Socket
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+
+	lxd.baseURL = "http://lxd"
+	lxd.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: dial,
+		},
+	}
+	lxd.dialer = &websocket.Dialer{
+		NetDialContext: dial,
+	}
+
+	return &lxd, nil
+}
+
+// configureRemote sets up an HTTPS client authenticated with a
+// client certificate.
+func (r *LXD) configureRemote() error {
+	u, err := url.Parse(r.Remote)
+	if err != nil {
+		return fmt.Errorf("invalid remote %s: %s", r.Remote, err)
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("remote must be an https URL: %s", r.Remote)
+	}
+
+	if r.ClientCert == "" || r.ClientKey == "" {
+		return fmt.Errorf("client_cert and client_key are required for remote")
+	}
+
+	clientCert, err := homedir.Expand(r.ClientCert)
+	if err != nil {
+		return err
+	}
+
+	clientKey, err := homedir.Expand(r.ClientKey)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		return fmt.Errorf("unable to load client_cert: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// LXD servers usually have self-signed certificates, so the
+	// server certificate can be trusted directly.
+	if r.ServerCert != "" {
+		serverCert, err := homedir.Expand(r.ServerCert)
+		if err != nil {
+			return err
+		}
+
+		pem, err := ioutil.ReadFile(serverCert)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("unable to parse server_cert %s", serverCert)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	r.baseURL = strings.TrimSuffix(r.Remote, "/")
+	r.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	r.dialer = &websocket.Dialer{
+		TLSClientConfig: tlsConfig,
+	}
+
+	return nil
+}
+
+// Connect implements the Connect method of the Connection interface.
+// It verifies the instance exists and is running.
+func (r *LXD) Connect(ctx context.Context) error {
+	var instance struct {
+		Status string `json:"status"`
+	}
+
+	resp, err := r.request(ctx, "GET", r.instancePath(""), nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get instance %s: %s", r.Host, err)
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &instance); err != nil {
+		return err
+	}
+
+	if instance.Status != "Running" {
+		return fmt.Errorf("instance %s is not running: %s", r.Host, instance.Status)
+	}
+
+	return nil
+}
+
+// RunCommand implements the RunCommand method of the Connection interface.
+// The command is run through the exec API with its output read from
+// the operation's websockets.
+func (r LXD) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
+	var rr RunResult
+	var outBuf, errBuf bytes.Buffer
+
+	// validate options
+	if ro.Command == "" {
+		return nil, fmt.Errorf("a command is required")
+	}
+
+	if _, err := envList(ro.Env); err != nil {
+		return nil, err
+	}
+
+	// Run the command as another user if requested. There is no
+	// stdin to send a password over. The directory and environment
+	// are set by the command so they apply to the become user.
+	var become *becomeSession
+	if ro.Become != nil {
+		if ro.Become.Password != "" {
+			return nil, fmt.Errorf("become passwords are not supported by the lxd driver")
+		}
+
+		command, err := wrapCommand(ro.Command, ro.Dir, ro.Env)
+		if err != nil {
+			return nil, err
+		}
+
+		become, err = newBecomeSession(ro.Become, r.Shell, command)
+		if err != nil {
+			return nil, err
+		}
+
+		ro.Command = become.command
+		ro.Dir = ""
+		ro.Env = nil
+	}
+
+	timeout := LXDCommandTimeout
+	if ro.Timeout > 0 {
+		timeout = ro.Timeout
+	}
+
+	// Set up the output
+	log := ioutil.Discard
+	if ro.Log != nil {
+		log = *ro.Log
+	}
+
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+
+	var output io.Writer = &outBuf
+	if ro.Stdout != nil {
+		output = ro.Stdout
+	}
+
+	outTee := io.TeeReader(outR, output)
+	errTee := io.TeeReader(errR, &errBuf)
+	outDoneCh := make(chan struct{})
+	errDoneCh := make(chan struct{})
+	go printOutput(log, "stdout", outTee, outDoneCh)
+	go printOutput(log, "stderr", errTee, errDoneCh)
+
+	var stdout, stderr io.Writer = outW, errW
+	if become != nil {
+		stdout = become.filter(outW)
+		stderr = become.filter(errW)
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		rr.ExitCode, err = r.exec(ctx, ro, stdout, stderr)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			rr.Timeout = true
+		}
+	}
+
+	if become != nil {
+		become.flush()
+	}
+
+	outW.Close()
+	errW.Close()
+	<-outDoneCh
+	<-errDoneCh
+
+	rr.Stdout = strings.TrimSpace(outBuf.String())
+	rr.Stderr = strings.TrimSpace(errBuf.String())
+	rr.Applied = true
+
+	if become != nil && err == nil {
+		err = become.err(rr.Stderr)
+	}
+
+	return &rr, err
+}
+
+// FileUpload implements the FileUpload method of the Connection interface.
+// The owner and mode are set by the files API.
+func (r LXD) FileUpload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	// validate options
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file upload")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file upload")
+	}
+
+	if cfo.Mode == 0 {
+		cfo.Mode = os.FileMode(0640)
+	}
+
+	timeout := LXDCommandTimeout
+	if cfo.Timeout > 0 {
+		timeout = cfo.Timeout
+	}
+
+	local, err := os.Open(cfo.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		headers := map[string]string{
+			"Content-Type": "application/octet-stream",
+			"X-LXD-type":   "file",
+			"X-LXD-mode":   fmt.Sprintf("%04o", cfo.Mode.Perm()),
+			"X-LXD-write":  "overwrite",
+		}
+
+		// An ID below 0 isn't sent, so it is left as it is.
+		if cfo.UID >= 0 {
+			headers["X-LXD-uid"] = strconv.Itoa(cfo.UID)
+		}
+
+		if cfo.GID >= 0 {
+			headers["X-LXD-gid"] = strconv.Itoa(cfo.GID)
+		}
+
+		_, err := r.request(ctx, "POST", r.filesPath(cfo.Destination), local, headers)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// FileDownload implements the FileDownload method of the Connection interface.
+func (r LXD) FileDownload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	// validate options
+	if cfo.Source == "" {
+		return nil, fmt.Errorf("source is required for file download")
+	}
+
+	if cfo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file download")
+	}
+
+	if cfo.Mode == 0 {
+		cfo.Mode = os.FileMode(0640)
+	}
+
+	timeout := LXDCommandTimeout
+	if cfo.Timeout > 0 {
+		timeout = cfo.Timeout
+	}
+
+	local, err := os.OpenFile(cfo.Destination, os.O_RDWR|os.O_CREATE|os.O_TRUNC, cfo.Mode)
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		res, err := r.getFile(ctx, cfo.Source)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if t := res.Header.Get("X-LXD-type"); t != "" && t != "file" {
+			return fmt.Errorf("%s is not a regular file", cfo.Source)
+		}
+
+		_, err = io.Copy(local, res.Body)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+func (r LXD) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+	var fi FileInfo
+
+	if fo.Path == "" {
+		return nil, fmt.Errorf("path is required for file info")
+	}
+
+	timeout := LXDCommandTimeout
+	if fo.Timeout > 0 {
+		timeout = fo.Timeout
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		res, err := r.getFile(ctx, fo.Path)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		fi.Name = fo.Path[strings.LastIndex(fo.Path, "/")+1:]
+		fi.UID, _ = strconv.Atoi(res.Header.Get("X-LXD-uid"))
+		fi.GID, _ = strconv.Atoi(res.Header.Get("X-LXD-gid"))
+
+		mode, _ := strconv.ParseInt(res.Header.Get("X-LXD-mode"), 8, 32)
+		fi.Mode, _ = strconv.Atoi(fmt.Sprintf("%o", mode&0777))
+
+		switch res.Header.Get("X-LXD-type") {
+		case "directory":
+			fi.Type = "directory"
+		case "symlink":
+			fi.Type = "symlink"
+		default:
+			fi.Type = "file"
+		}
+
+		if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+			fi.ModTime = t
+		}
+
+		switch fi.Type {
+		case "file":
+			if fo.Checksum {
+				h := sha256.New()
+				fi.Size, err = io.Copy(h, res.Body)
+				fi.Checksum = hex.EncodeToString(h.Sum(nil))
+				break
+			}
+
+			fi.Size = res.ContentLength
+			if fi.Size < 0 {
+				fi.Size, err = io.Copy(ioutil.Discard, res.Body)
+			}
+		case "symlink":
+			// The body of a symlink is its target.
+			var b []byte
+			b, err = ioutil.ReadAll(res.Body)
+			fi.LinkTarget = string(b)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+
+		if os.IsNotExist(err) {
+			fr.Success = true
+		}
+
+		return &fr, nil
+	}
+
+	fr.FileInfo = fi
+	fr.Exists = true
+	fr.Success = true
+	fr.Applied = true
+
+	return &fr, nil
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+func (r LXD) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	var fr FileResult
+
+	// validate options
+	if fo.Path == "" {
+		return nil, fmt.Errorf("path is required for file delete")
+	}
+
+	timeout := LXDCommandTimeout
+	if fo.Timeout > 0 {
+		timeout = fo.Timeout
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		_, err := r.request(ctx, "DELETE", r.filesPath(fo.Path), nil, nil)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "timeout" {
+			fr.Timeout = true
+		}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	fr.Applied = true
+
+	return &fr, err
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+// It runs mkdir in the instance.
+func (r LXD) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellMkdirAll(ctx, &r, fo)
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r LXD) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellChmod(ctx, &r, fo)
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r LXD) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellChown(ctx, &r, fo)
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r LXD) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellRename(ctx, &r, fo)
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r LXD) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellSymlink(ctx, &r, fo)
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+// The file is read with FileDownload.
+func (r LXD) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return downloadReadFile(ctx, &r, fo)
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+// The file is written with FileUpload.
+func (r LXD) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return uploadWriteFile(ctx, &r, fo)
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r LXD) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellRemoveAll(ctx, &r, fo)
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r LXD) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return shellReadDir(ctx, &r, fo)
+}
+
+// Close implements the Close method of the Connection interface.
+func (r LXD) Close() {
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
+
+// instancePath returns the API path of an endpoint of the instance.
+func (r LXD) instancePath(endpoint string) string {
+	p := "/1.0/instances/" + url.PathEscape(r.Host)
+	if endpoint != "" {
+		p = p + "/" + endpoint
+	}
+
+	return r.withProject(p, nil)
+}
+
+// filesPath returns the API path of a file in the instance.
+func (r LXD) filesPath(path string) string {
+	query := url.Values{}
+	query.Set("path", path)
+
+	return r.withProject("/1.0/instances/"+url.PathEscape(r.Host)+"/files", query)
+}
+
+// withProject adds the project, if set, to a path's query string.
+func (r LXD) withProject(p string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	if r.Project != "" {
+		query.Set("project", r.Project)
+	}
+
+	if len(query) == 0 {
+		return p
+	}
+
+	return p + "?" + query.Encode()
+}
+
+// do performs a raw request against the LXD REST API.
+func (r LXD) do(ctx context.Context, method, p string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+p, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return r.client.Do(req)
+}
+
+// request performs a request and decodes the standard response.
+func (r LXD) request(ctx context.Context, method, p string, body io.Reader, headers map[string]string) (*lxdResponse, error) {
+	res, err := r.do(ctx, method, p, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp lxdResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("unable to parse response of %s %s: %s", method, p, err)
+	}
+
+	if resp.Type == "error" {
+		if resp.ErrorCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: method, Path: p, Err: os.ErrNotExist}
+		}
+
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// getFile requests a file from the instance. A file which does not
+// exist returns an os.ErrNotExist error.
+func (r LXD) getFile(ctx context.Context, path string) (*http.Response, error) {
+	res, err := r.do(ctx, "GET", r.filesPath(path), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+
+		var resp lxdResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err == nil && resp.Error != "" {
+			return nil, fmt.Errorf("%s", resp.Error)
+		}
+
+		return nil, fmt.Errorf("unable to get %s: %s", path, res.Status)
+	}
+
+	return res, nil
+}
+
+// exec runs a command in the instance with its stdin, environment and
+// directory, and returns its exit code.
+func (r LXD) exec(ctx context.Context, ro RunOpts, stdout, stderr io.Writer) (int, error) {
+	env := ro.Env
+	if env == nil {
+		env = map[string]string{}
+	}
+
+	req := map[string]interface{}{
+		"command":            []string{r.Shell, "-c", ro.Command},
+		"wait-for-websocket": true,
+		"interactive":        false,
+		"environment":        env,
+	}
+
+	if ro.Dir != "" {
+		req["cwd"] = ro.Dir
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+
+	resp, err := r.request(ctx, "POST", r.instancePath("exec"), bytes.NewReader(b), headers)
+	if err != nil {
+		return 0, fmt.Errorf("unable to exec in instance %s: %s", r.Host, err)
+	}
+
+	var op lxdOperation
+	if err := json.Unmarshal(resp.Metadata, &op); err != nil {
+		return 0, err
+	}
+
+	fds, _ := op.Metadata["fds"].(map[string]interface{})
+
+	// Every websocket must be connected before LXD starts the command.
+	conns := make(map[string]*websocket.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for _, fd := range []string{"control", "0", "1", "2"} {
+		secret, ok := fds[fd].(string)
+		if !ok {
+			return 0, fmt.Errorf("exec operation is missing the %s websocket", fd)
+		}
+
+		conn, err := r.websocket(ctx, op.ID, secret)
+		if err != nil {
+			return 0, err
+		}
+		conns[fd] = conn
+	}
+
+	// An empty message signals the end of stdin. stdin is sent in
+	// the background since the command may not read all of it.
+	if ro.Stdin == nil {
+		if err := conns["0"].WriteMessage(websocket.TextMessage, []byte{}); err != nil {
+			return 0, err
+		}
+	} else {
+		go lxdWriteStream(conns["0"], ro.Stdin)
+	}
+
+	// If ctx is cancelled, the command is killed through the control
+	// websocket and the output streams are closed.
+	waitCh := make(chan struct{})
+	defer close(waitCh)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conns["control"].WriteJSON(map[string]interface{}{
+				"command": "signal",
+				"signal":  9,
+			})
+			conns["1"].Close()
+			conns["2"].Close()
+		case <-waitCh:
+		}
+	}()
+
+	outDoneCh := make(chan error)
+	errDoneCh := make(chan error)
+	go func() { outDoneCh <- lxdReadStream(conns["1"], stdout) }()
+	go func() { errDoneCh <- lxdReadStream(conns["2"], stderr) }()
+
+	outErr := <-outDoneCh
+	errErr := <-errDoneCh
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	waitResp, err := r.request(ctx, "GET", r.withProject("/1.0/operations/"+op.ID+"/wait", nil), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var result lxdOperation
+	if err := json.Unmarshal(waitResp.Metadata, &result); err != nil {
+		return 0, err
+	}
+
+	if result.Err != "" {
+		return 0, fmt.Errorf("%s", result.Err)
+	}
+
+	if outErr != nil {
+		return 0, outErr
+	}
+
+	if errErr != nil {
+		return 0, errErr
+	}
+
+	exitCode, _ := result.Metadata["return"].(float64)
+
+	return int(exitCode), nil
+}
+
+// websocket connects to a websocket of an operation.
+func (r LXD) websocket(ctx context.Context, id, secret string) (*websocket.Conn, error) {
+	u := strings.Replace(r.baseURL, "http", "ws", 1)
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	u = u + r.withProject("/1.0/operations/"+id+"/websocket", query)
+
+	conn, _, err := r.dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to exec websocket: %s", err)
+	}
+
+	return conn, nil
+}
+
+// lxdWriteStream sends the contents of r over a websocket followed by
+// an empty message.
+func lxdWriteStream(conn *websocket.Conn, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return conn.WriteMessage(websocket.TextMessage, []byte{})
+}
+
+// lxdReadStream copies the messages of a websocket until it is closed
+// or an empty message is received.
+func lxdReadStream(conn *websocket.Conn, w io.Writer) error {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return nil
+			}
+
+			return err
+		}
+
+		if len(b) == 0 {
+			return nil
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+}
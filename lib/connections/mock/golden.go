@@ -0,0 +1,109 @@
+package mock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// UpdateGoldenEnv is the environment variable which, when set to a
+// non-empty value, has AssertGolden write golden files instead of
+// comparing against them.
+const UpdateGoldenEnv = "BAGEL_UPDATE_GOLDEN"
+
+// Mask replaces the matches of Pattern in rendered calls with
+// Replacement. It is used to hide values which change between runs,
+// such as the names of temporary files.
+type Mask struct {
+	Pattern     string
+	Replacement string
+}
+
+// Render returns a readable description of calls. Each call is a line
+// with its method and what it acted on, followed by its options.
+func Render(calls []Call, masks ...Mask) string {
+	var b strings.Builder
+
+	for _, call := range calls {
+		fmt.Fprintln(&b, call)
+
+		if call.Become != "" {
+			fmt.Fprintf(&b, "  become: %s\n", call.Become)
+		}
+
+		if call.Dir != "" {
+			fmt.Fprintf(&b, "  dir: %s\n", call.Dir)
+		}
+
+		for _, k := range sortedKeys(call.Env) {
+			fmt.Fprintf(&b, "  env: %s=%s\n", k, call.Env[k])
+		}
+
+		if call.Mode != 0 {
+			fmt.Fprintf(&b, "  mode: %o\n", call.Mode)
+		}
+
+		// An owner of root or one which is left as it is isn't shown.
+		if call.UID > 0 || call.GID > 0 {
+			fmt.Fprintf(&b, "  owner: %d:%d\n", call.UID, call.GID)
+		}
+
+		if call.Stdin != "" {
+			fmt.Fprintln(&b, "  stdin:")
+			renderContent(&b, call.Stdin)
+		}
+
+		if call.Content != "" {
+			fmt.Fprintln(&b, "  content:")
+			renderContent(&b, call.Content)
+		}
+	}
+
+	s := b.String()
+	for _, m := range masks {
+		s = regexp.MustCompile(m.Pattern).ReplaceAllString(s, m.Replacement)
+	}
+
+	return s
+}
+
+// renderContent writes each line of content prefixed with a bar.
+func renderContent(b *strings.Builder, content string) {
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		fmt.Fprintf(b, "    | %s\n", line)
+	}
+}
+
+// AssertGolden compares the rendered calls with the golden file at
+// file. If UpdateGoldenEnv is set, the file is written instead.
+func AssertGolden(t testing.TB, file string, calls []Call, masks ...Mask) {
+	t.Helper()
+
+	actual := Render(calls, masks...)
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(file, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	expected, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unable to read golden file %s (set %s=1 to create it): %s", file, UpdateGoldenEnv, err)
+	}
+
+	if string(expected) != actual {
+		t.Errorf("calls do not match golden file %s (set %s=1 to update it)\nexpected:\n%s\nactual:\n%s",
+			file, UpdateGoldenEnv, expected, actual)
+	}
+}
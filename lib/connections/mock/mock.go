@@ -0,0 +1,720 @@
+// Package mock implements a connection which does no work on a real
+// host. Commands are answered by scripted responses, files are kept in
+// memory and every call is recorded so resources can be tested offline.
+package mock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtopjian/bagel/lib/connections"
+)
+
+// NotFoundExitCode is the exit code of a command which matches no
+// response, as a shell returns for an unknown command.
+const NotFoundExitCode = 127
+
+// Connection is a scriptable connection. It implements the Connection
+// interface. The zero value is not usable; use New or Replay.
+type Connection struct {
+	mu        sync.Mutex
+	responses []*response
+	files     map[string]*file
+	entries   []Entry
+
+	// replay, if set, holds the entries which are expected to be
+	// called next. See Replay.
+	replay    []Entry
+	replaying bool
+}
+
+// response is a scripted response to the commands matching re.
+type response struct {
+	re      *regexp.Regexp
+	results []connections.RunResult
+	err     error
+	calls   int
+}
+
+// file is a file, directory or symlink held in memory.
+type file struct {
+	content []byte
+	mode    os.FileMode
+	uid     int
+	gid     int
+	typ     string
+	target  string
+	modTime time.Time
+}
+
+// New returns a connection with no responses and an empty root
+// directory.
+func New() *Connection {
+	c := &Connection{
+		files: make(map[string]*file),
+	}
+
+	c.files["/"] = &file{mode: 0755, typ: "directory", modTime: time.Now()}
+
+	return c
+}
+
+// OnCommand adds a response for the commands which match pattern.
+// Each call returns the next of results and the last one is returned
+// once they run out. A command with no results exits successfully
+// with no output.
+//
+// Responses are checked in the order they were added. A command which
+// matches none of them exits with NotFoundExitCode.
+func (r *Connection) OnCommand(pattern string, results ...connections.RunResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.responses = append(r.responses, &response{
+		re:      regexp.MustCompile(pattern),
+		results: results,
+	})
+}
+
+// OnCommandError has the commands which match pattern fail with err,
+// as though the connection had failed.
+func (r *Connection) OnCommandError(pattern string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.responses = append(r.responses, &response{
+		re:  regexp.MustCompile(pattern),
+		err: err,
+	})
+}
+
+// AddFile adds a file with content at p. Missing parent directories
+// are created.
+func (r *Connection) AddFile(p string, content []byte, mode os.FileMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.mkdirAll(path.Dir(path.Clean(p)), 0755)
+	r.files[path.Clean(p)] = &file{
+		content: content,
+		mode:    mode.Perm(),
+		typ:     "file",
+		modTime: time.Now(),
+	}
+}
+
+// AddDir adds a directory at p and any missing parents.
+func (r *Connection) AddDir(p string, mode os.FileMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.mkdirAll(path.Clean(p), mode)
+}
+
+// File returns the content of the file at p and whether it exists.
+func (r *Connection) File(p string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.files[path.Clean(p)]
+	if !ok || f.typ != "file" {
+		return nil, false
+	}
+
+	return f.content, true
+}
+
+// Calls returns every call made to the connection in order.
+func (r *Connection) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	calls := make([]Call, len(r.entries))
+	for i, e := range r.entries {
+		calls[i] = e.Call
+	}
+
+	return calls
+}
+
+// Commands returns the command of every call to RunCommand in order.
+func (r *Connection) Commands() []string {
+	var commands []string
+	for _, call := range r.Calls() {
+		if call.Method == "RunCommand" {
+			commands = append(commands, call.Command)
+		}
+	}
+
+	return commands
+}
+
+// Transcript returns every call made to the connection and its result.
+func (r *Connection) Transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Transcript{Entries: append([]Entry(nil), r.entries...)}
+}
+
+// Connect implements the Connect method of the Connection interface.
+// It performs no action.
+func (r *Connection) Connect(ctx context.Context) error {
+	return nil
+}
+
+// Close implements the Close method of the Connection interface.
+// It performs no action.
+func (r *Connection) Close() {
+	return
+}
+
+// RunCommand implements the RunCommand method of the Connection
+// interface. The command is answered by the first matching response.
+func (r *Connection) RunCommand(ctx context.Context, ro connections.RunOpts) (*connections.RunResult, error) {
+	call, err := runCall(ro)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.replaying {
+		e, err := r.next(call)
+		if err != nil {
+			return nil, err
+		}
+
+		return stdout(ro, e.RunResult), e.err()
+	}
+
+	rr, err := r.respond(ro.Command)
+	r.record(Entry{Call: call, RunResult: rr, Error: errString(err)})
+
+	return stdout(ro, rr), err
+}
+
+// stdout sends the output of rr to ro.Stdout, if it is set, and
+// returns a copy of rr without it.
+func stdout(ro connections.RunOpts, rr *connections.RunResult) *connections.RunResult {
+	if ro.Stdout == nil || rr == nil {
+		return rr
+	}
+
+	out := *rr
+	io.WriteString(ro.Stdout, out.Stdout)
+	out.Stdout = ""
+
+	return &out
+}
+
+// respond returns the result of the first response which matches
+// command.
+func (r *Connection) respond(command string) (*connections.RunResult, error) {
+	for _, resp := range r.responses {
+		if !resp.re.MatchString(command) {
+			continue
+		}
+
+		if resp.err != nil {
+			return nil, resp.err
+		}
+
+		var rr connections.RunResult
+		if len(resp.results) > 0 {
+			i := resp.calls
+			if i >= len(resp.results) {
+				i = len(resp.results) - 1
+			}
+
+			rr = resp.results[i]
+		}
+
+		resp.calls++
+		rr.Applied = true
+
+		return &rr, nil
+	}
+
+	return &connections.RunResult{
+		ExitCode: NotFoundExitCode,
+		Stderr:   fmt.Sprintf("mock: no response for command: %s", command),
+		Applied:  true,
+	}, nil
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+func (r *Connection) FileInfo(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("FileInfo", fo), func() (*connections.FileResult, error) {
+		var fr connections.FileResult
+
+		p := path.Clean(fo.Path)
+		f, ok := r.files[p]
+		if ok {
+			fr.FileInfo = f.info(p, fo.Checksum)
+			fr.Exists = true
+			fr.Applied = true
+		}
+
+		fr.Success = true
+
+		return &fr, nil
+	})
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+func (r *Connection) FileDelete(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("FileDelete", fo), func() (*connections.FileResult, error) {
+		p := path.Clean(fo.Path)
+		if _, err := r.lookup("remove", p); err != nil {
+			return nil, err
+		}
+
+		if len(r.children(p)) > 0 {
+			return nil, &os.PathError{Op: "remove", Path: p, Err: fmt.Errorf("directory not empty")}
+		}
+
+		delete(r.files, p)
+
+		return nil, nil
+	})
+}
+
+// FileUpload implements the FileUpload method of the Connection
+// interface. The local source file is stored at the destination.
+func (r *Connection) FileUpload(ctx context.Context, fo connections.CopyFileOpts) (*connections.FileResult, error) {
+	if fo.Source == "" {
+		return nil, fmt.Errorf("source is required for file copy")
+	}
+
+	if fo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file copy")
+	}
+
+	content, err := ioutil.ReadFile(fo.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	call := copyCall("FileUpload", fo, fo.Destination)
+	call.Content = string(content)
+
+	return r.fileAction(call, func() (*connections.FileResult, error) {
+		fr := &connections.FileResult{
+			Checksum: checksum(content),
+			Verified: true,
+		}
+
+		return fr, r.write(fo.Destination, content, fo.Mode, fo.UID, fo.GID)
+	})
+}
+
+// FileDownload implements the FileDownload method of the Connection
+// interface. The file at the source is written to the local
+// destination.
+func (r *Connection) FileDownload(ctx context.Context, fo connections.CopyFileOpts) (*connections.FileResult, error) {
+	if fo.Source == "" {
+		return nil, fmt.Errorf("source is required for file copy")
+	}
+
+	if fo.Destination == "" {
+		return nil, fmt.Errorf("destination is required for file copy")
+	}
+
+	mode := fo.Mode
+	if mode == 0 {
+		mode = os.FileMode(0640)
+	}
+
+	r.mu.Lock()
+	if r.replaying {
+		defer r.mu.Unlock()
+
+		e, err := r.next(copyCall("FileDownload", fo, fo.Source))
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Error == "" {
+			if err := ioutil.WriteFile(fo.Destination, []byte(e.Content), mode); err != nil {
+				return nil, err
+			}
+		}
+
+		return e.FileResult, e.err()
+	}
+
+	var content []byte
+	f, err := r.lookup("open", path.Clean(fo.Source))
+	if err == nil {
+		content = f.content
+	}
+	r.mu.Unlock()
+
+	call := copyCall("FileDownload", fo, fo.Source)
+	call.Content = string(content)
+
+	return r.fileAction(call, func() (*connections.FileResult, error) {
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(fo.Destination, content, mode); err != nil {
+			return nil, err
+		}
+
+		return &connections.FileResult{
+			Checksum: checksum(content),
+			Verified: true,
+		}, nil
+	})
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r *Connection) MkdirAll(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("MkdirAll", fo), func() (*connections.FileResult, error) {
+		mode := fo.Mode
+		if mode == 0 {
+			mode = os.FileMode(0755)
+		}
+
+		return nil, r.mkdirAll(path.Clean(fo.Path), mode)
+	})
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r *Connection) Chmod(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Chmod", fo), func() (*connections.FileResult, error) {
+		f, err := r.lookup("chmod", path.Clean(fo.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		f.mode = fo.Mode.Perm()
+
+		return nil, nil
+	})
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r *Connection) Chown(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Chown", fo), func() (*connections.FileResult, error) {
+		f, err := r.lookup("chown", path.Clean(fo.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		if fo.UID >= 0 {
+			f.uid = fo.UID
+		}
+
+		if fo.GID >= 0 {
+			f.gid = fo.GID
+		}
+
+		return nil, nil
+	})
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r *Connection) Rename(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	if fo.Target == "" {
+		return nil, fmt.Errorf("target is required for rename")
+	}
+
+	return r.fileAction(fileCall("Rename", fo), func() (*connections.FileResult, error) {
+		oldPath := path.Clean(fo.Path)
+		newPath := path.Clean(fo.Target)
+
+		if _, err := r.lookup("rename", oldPath); err != nil {
+			return nil, err
+		}
+
+		if _, err := r.lookup("rename", path.Dir(newPath)); err != nil {
+			return nil, err
+		}
+
+		for p, f := range r.files {
+			if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+				delete(r.files, p)
+				r.files[newPath+strings.TrimPrefix(p, oldPath)] = f
+			}
+		}
+
+		return nil, nil
+	})
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r *Connection) Symlink(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	if fo.Target == "" {
+		return nil, fmt.Errorf("target is required for symlink")
+	}
+
+	return r.fileAction(fileCall("Symlink", fo), func() (*connections.FileResult, error) {
+		p := path.Clean(fo.Path)
+		if _, ok := r.files[p]; ok {
+			return nil, &os.LinkError{Op: "symlink", Old: fo.Target, New: p, Err: os.ErrExist}
+		}
+
+		if _, err := r.lookup("symlink", path.Dir(p)); err != nil {
+			return nil, err
+		}
+
+		r.files[p] = &file{
+			mode:    0777,
+			typ:     "symlink",
+			target:  fo.Target,
+			modTime: time.Now(),
+		}
+
+		return nil, nil
+	})
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r *Connection) ReadFile(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("ReadFile", fo), func() (*connections.FileResult, error) {
+		f, err := r.lookup("open", path.Clean(fo.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		return &connections.FileResult{Content: f.content}, nil
+	})
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+func (r *Connection) WriteFile(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	call := fileCall("WriteFile", fo)
+	call.Content = string(fo.Content)
+
+	return r.fileAction(call, func() (*connections.FileResult, error) {
+		fr := &connections.FileResult{
+			Checksum: checksum(fo.Content),
+			Verified: true,
+		}
+
+		return fr, r.write(fo.Path, fo.Content, fo.Mode, fo.UID, fo.GID)
+	})
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r *Connection) RemoveAll(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("RemoveAll", fo), func() (*connections.FileResult, error) {
+		p := path.Clean(fo.Path)
+		for name := range r.files {
+			if name == p || strings.HasPrefix(name, p+"/") {
+				delete(r.files, name)
+			}
+		}
+
+		return nil, nil
+	})
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r *Connection) ReadDir(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("ReadDir", fo), func() (*connections.FileResult, error) {
+		p := path.Clean(fo.Path)
+		if _, ok := r.files[p]; !ok {
+			return &connections.FileResult{Success: true}, nil
+		}
+
+		fr := connections.FileResult{Exists: true, Applied: true}
+		for _, name := range r.children(p) {
+			fr.Entries = append(fr.Entries, r.files[name].info(name, fo.Checksum))
+		}
+
+		sort.Slice(fr.Entries, func(i, j int) bool {
+			return fr.Entries[i].Name < fr.Entries[j].Name
+		})
+
+		return &fr, nil
+	})
+}
+
+// fileAction records a file action and runs f with the connection
+// locked. If f returns no result, an empty one is used. When
+// replaying, the recorded result is returned instead.
+func (r *Connection) fileAction(call Call, f func() (*connections.FileResult, error)) (*connections.FileResult, error) {
+	if call.Path == "" {
+		return nil, fmt.Errorf("path is required for %s", call.Method)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.replaying {
+		e, err := r.next(call)
+		if err != nil {
+			return nil, err
+		}
+
+		return e.FileResult, e.err()
+	}
+
+	fr, err := f()
+	if fr == nil {
+		fr = &connections.FileResult{}
+	}
+
+	if err == nil {
+		fr.Success = true
+	}
+
+	// FileInfo and ReadDir only apply if the path exists.
+	if call.Method != "FileInfo" && call.Method != "ReadDir" {
+		fr.Applied = true
+	}
+
+	r.record(Entry{Call: call, FileResult: fr, Error: errString(err)})
+
+	return fr, err
+}
+
+// record adds an entry to the transcript of the connection.
+func (r *Connection) record(e Entry) {
+	r.entries = append(r.entries, e)
+}
+
+// lookup returns the file at p or an error for op if it does not
+// exist.
+func (r *Connection) lookup(op, p string) (*file, error) {
+	f, ok := r.files[p]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+
+	return f, nil
+}
+
+// children returns the paths of the entries directly below p.
+func (r *Connection) children(p string) []string {
+	var names []string
+	for name := range r.files {
+		if name != p && path.Dir(name) == p {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// mkdirAll creates the directory p and any missing parents.
+func (r *Connection) mkdirAll(p string, mode os.FileMode) error {
+	if f, ok := r.files[p]; ok {
+		if f.typ != "directory" {
+			return &os.PathError{Op: "mkdir", Path: p, Err: fmt.Errorf("not a directory")}
+		}
+
+		return nil
+	}
+
+	if err := r.mkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	r.files[p] = &file{mode: mode.Perm(), typ: "directory", modTime: time.Now()}
+
+	return nil
+}
+
+// write stores content in the file at p. Like the other drivers, the
+// parent directory must exist.
+func (r *Connection) write(p string, content []byte, mode os.FileMode, uid, gid int) error {
+	p = path.Clean(p)
+
+	if mode == 0 {
+		mode = os.FileMode(0640)
+	}
+
+	if _, err := r.lookup("open", path.Dir(p)); err != nil {
+		return err
+	}
+
+	// An ID below 0 keeps the owner of the file being replaced.
+	if f, ok := r.files[p]; ok {
+		if uid < 0 {
+			uid = f.uid
+		}
+
+		if gid < 0 {
+			gid = f.gid
+		}
+	}
+
+	if uid < 0 {
+		uid = 0
+	}
+
+	if gid < 0 {
+		gid = 0
+	}
+
+	r.files[p] = &file{
+		content: append([]byte(nil), content...),
+		mode:    mode.Perm(),
+		uid:     uid,
+		gid:     gid,
+		typ:     "file",
+		modTime: time.Now(),
+	}
+
+	return nil
+}
+
+// info describes the file at p.
+func (r *file) info(p string, withChecksum bool) connections.FileInfo {
+	fi := connections.FileInfo{
+		Name:       path.Base(p),
+		UID:        r.uid,
+		GID:        r.gid,
+		Type:       r.typ,
+		Size:       int64(len(r.content)),
+		Mode:       fileMode(r.mode),
+		ModTime:    r.modTime,
+		LinkTarget: r.target,
+	}
+
+	if withChecksum && r.typ == "file" {
+		fi.Checksum = checksum(r.content)
+	}
+
+	return fi
+}
+
+// fileMode converts a mode to the form a FileInfo reports it in, with
+// the octal digits written as a decimal number such as 644.
+func fileMode(mode os.FileMode) int {
+	m, _ := strconv.Atoi(fmt.Sprintf("%o", uint32(mode.Perm())))
+	return m
+}
+
+// checksum returns the SHA-256 checksum of content.
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// errString returns the message of err, or an empty string.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
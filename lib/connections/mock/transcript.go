@@ -0,0 +1,418 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jtopjian/bagel/lib/connections"
+)
+
+// Call represents a call to a connection.
+type Call struct {
+	Method string `json:"method"`
+
+	// Command, Env, Dir and Stdin are the options of a command.
+	Command string            `json:"command,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Dir     string            `json:"dir,omitempty"`
+	Stdin   string            `json:"stdin,omitempty"`
+
+	// Become is the become method and user, such as "sudo root".
+	Become string `json:"become,omitempty"`
+
+	// Path is the path on the target. For a copy, it is the
+	// destination of an upload or the source of a download.
+	Path   string      `json:"path,omitempty"`
+	Target string      `json:"target,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	UID    int         `json:"uid,omitempty"`
+	GID    int         `json:"gid,omitempty"`
+
+	// Content is the data which was copied, written or read.
+	Content string `json:"content,omitempty"`
+}
+
+// String returns the method of a call and what it acted on.
+func (r Call) String() string {
+	switch {
+	case r.Command != "":
+		return r.Method + " " + r.Command
+	case r.Target != "":
+		return r.Method + " " + r.Path + " " + r.Target
+	}
+
+	return r.Method + " " + r.Path
+}
+
+// matches reports whether a call acts on the same thing as r.
+func (r Call) matches(c Call) bool {
+	return r.Method == c.Method && r.Command == c.Command &&
+		r.Path == c.Path && r.Target == c.Target
+}
+
+// Entry is a call and its result.
+type Entry struct {
+	Call
+
+	RunResult  *connections.RunResult  `json:"run_result,omitempty"`
+	FileResult *connections.FileResult `json:"file_result,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+// err returns the error of the entry, if any.
+func (r Entry) err() error {
+	if r.Error == "" {
+		return nil
+	}
+
+	return errors.New(r.Error)
+}
+
+// Transcript is a list of calls to a connection and their results.
+type Transcript struct {
+	Entries []Entry `json:"entries"`
+}
+
+// LoadTranscript reads a transcript saved as JSON.
+func LoadTranscript(file string) (Transcript, error) {
+	var t Transcript
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return t, err
+	}
+
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, fmt.Errorf("unable to parse transcript %s: %s", file, err)
+	}
+
+	return t, nil
+}
+
+// Save writes the transcript to file as JSON.
+func (r Transcript) Save(file string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// Calls returns the call of every entry in the transcript.
+func (r Transcript) Calls() []Call {
+	calls := make([]Call, len(r.Entries))
+	for i, e := range r.Entries {
+		calls[i] = e.Call
+	}
+
+	return calls
+}
+
+// Replay returns a connection which answers calls from a transcript.
+// Each call must act on the same thing as the next entry, or it fails.
+func Replay(t Transcript) *Connection {
+	c := New()
+	c.replay = append([]Entry(nil), t.Entries...)
+	c.replaying = true
+
+	return c
+}
+
+// Done returns an error if a replayed transcript has entries which
+// were not called.
+func (r *Connection) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.replay) > 0 {
+		return fmt.Errorf("mock: %d calls were not made, starting with: %s", len(r.replay), r.replay[0].Call)
+	}
+
+	return nil
+}
+
+// next returns the next entry of a replayed transcript if it matches
+// call.
+func (r *Connection) next(call Call) (Entry, error) {
+	if len(r.replay) == 0 {
+		return Entry{}, fmt.Errorf("mock: unexpected call: %s", call)
+	}
+
+	e := r.replay[0]
+	if !e.Call.matches(call) {
+		return Entry{}, fmt.Errorf("mock: expected call: %s, got: %s", e.Call, call)
+	}
+
+	r.replay = r.replay[1:]
+	r.record(e)
+
+	return e, nil
+}
+
+// Recorder wraps a connection and records every call made through it
+// so it can be saved as a transcript and replayed later.
+type Recorder struct {
+	conn connections.Connection
+
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// Record returns a recorder which wraps conn.
+func Record(conn connections.Connection) *Recorder {
+	return &Recorder{conn: conn}
+}
+
+// Transcript returns every call made through the recorder and its
+// result.
+func (r *Recorder) Transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Transcript{Entries: append([]Entry(nil), r.entries...)}
+}
+
+// Connect implements the Connect method of the Connection interface.
+func (r *Recorder) Connect(ctx context.Context) error {
+	return r.conn.Connect(ctx)
+}
+
+// Close implements the Close method of the Connection interface.
+func (r *Recorder) Close() {
+	r.conn.Close()
+}
+
+// RunCommand implements the RunCommand method of the Connection interface.
+func (r *Recorder) RunCommand(ctx context.Context, ro connections.RunOpts) (*connections.RunResult, error) {
+	call, err := runCall(ro)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stdin was read to record it, so it is sent from the copy.
+	if ro.Stdin != nil {
+		ro.Stdin = strings.NewReader(call.Stdin)
+	}
+
+	rr, err := r.conn.RunCommand(ctx, ro)
+	r.record(Entry{Call: call, RunResult: rr, Error: errString(err)})
+
+	return rr, err
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+func (r *Recorder) FileInfo(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("FileInfo", fo), func() (*connections.FileResult, error) {
+		return r.conn.FileInfo(ctx, fo)
+	})
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+func (r *Recorder) FileDelete(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("FileDelete", fo), func() (*connections.FileResult, error) {
+		return r.conn.FileDelete(ctx, fo)
+	})
+}
+
+// FileUpload implements the FileUpload method of the Connection interface.
+func (r *Recorder) FileUpload(ctx context.Context, fo connections.CopyFileOpts) (*connections.FileResult, error) {
+	call := copyCall("FileUpload", fo, fo.Destination)
+	if content, err := ioutil.ReadFile(fo.Source); err == nil {
+		call.Content = string(content)
+	}
+
+	return r.fileAction(call, func() (*connections.FileResult, error) {
+		return r.conn.FileUpload(ctx, fo)
+	})
+}
+
+// FileDownload implements the FileDownload method of the Connection interface.
+func (r *Recorder) FileDownload(ctx context.Context, fo connections.CopyFileOpts) (*connections.FileResult, error) {
+	call := copyCall("FileDownload", fo, fo.Source)
+
+	fr, err := r.conn.FileDownload(ctx, fo)
+	if err == nil {
+		if content, err := ioutil.ReadFile(fo.Destination); err == nil {
+			call.Content = string(content)
+		}
+	}
+
+	r.record(Entry{Call: call, FileResult: fr, Error: errString(err)})
+
+	return fr, err
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r *Recorder) MkdirAll(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("MkdirAll", fo), func() (*connections.FileResult, error) {
+		return r.conn.MkdirAll(ctx, fo)
+	})
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r *Recorder) Chmod(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Chmod", fo), func() (*connections.FileResult, error) {
+		return r.conn.Chmod(ctx, fo)
+	})
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r *Recorder) Chown(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Chown", fo), func() (*connections.FileResult, error) {
+		return r.conn.Chown(ctx, fo)
+	})
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r *Recorder) Rename(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Rename", fo), func() (*connections.FileResult, error) {
+		return r.conn.Rename(ctx, fo)
+	})
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r *Recorder) Symlink(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("Symlink", fo), func() (*connections.FileResult, error) {
+		return r.conn.Symlink(ctx, fo)
+	})
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r *Recorder) ReadFile(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("ReadFile", fo), func() (*connections.FileResult, error) {
+		return r.conn.ReadFile(ctx, fo)
+	})
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+func (r *Recorder) WriteFile(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	call := fileCall("WriteFile", fo)
+	call.Content = string(fo.Content)
+
+	return r.fileAction(call, func() (*connections.FileResult, error) {
+		return r.conn.WriteFile(ctx, fo)
+	})
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r *Recorder) RemoveAll(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("RemoveAll", fo), func() (*connections.FileResult, error) {
+		return r.conn.RemoveAll(ctx, fo)
+	})
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r *Recorder) ReadDir(ctx context.Context, fo connections.FileOpts) (*connections.FileResult, error) {
+	return r.fileAction(fileCall("ReadDir", fo), func() (*connections.FileResult, error) {
+		return r.conn.ReadDir(ctx, fo)
+	})
+}
+
+// fileAction runs a file action and records it.
+func (r *Recorder) fileAction(call Call, f func() (*connections.FileResult, error)) (*connections.FileResult, error) {
+	fr, err := f()
+	r.record(Entry{Call: call, FileResult: fr, Error: errString(err)})
+
+	return fr, err
+}
+
+// record adds an entry to the transcript of the recorder.
+func (r *Recorder) record(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = append(r.entries, e)
+}
+
+// runCall returns the call for a command. The stdin of the command
+// is read so it can be recorded.
+func runCall(ro connections.RunOpts) (Call, error) {
+	call := Call{
+		Method:  "RunCommand",
+		Command: ro.Command,
+		Dir:     ro.Dir,
+		Become:  become(ro.Become),
+	}
+
+	if len(ro.Env) > 0 {
+		call.Env = make(map[string]string)
+		for k, v := range ro.Env {
+			call.Env[k] = v
+		}
+	}
+
+	if ro.Stdin != nil {
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(ro.Stdin); err != nil {
+			return call, err
+		}
+
+		call.Stdin = buf.String()
+	}
+
+	return call, nil
+}
+
+// fileCall returns the call for a file action.
+func fileCall(method string, fo connections.FileOpts) Call {
+	return Call{
+		Method: method,
+		Path:   fo.Path,
+		Target: fo.Target,
+		Mode:   fo.Mode,
+		UID:    fo.UID,
+		GID:    fo.GID,
+		Become: become(fo.Become),
+	}
+}
+
+// copyCall returns the call for a copy of the file at p.
+func copyCall(method string, fo connections.CopyFileOpts, p string) Call {
+	return Call{
+		Method: method,
+		Path:   p,
+		Mode:   fo.Mode,
+		UID:    fo.UID,
+		GID:    fo.GID,
+		Become: become(fo.Become),
+	}
+}
+
+// become describes the become options of a call.
+func become(b *connections.Become) string {
+	if b == nil {
+		return ""
+	}
+
+	method := b.Method
+	if method == "" {
+		method = connections.BecomeDefaultMethod
+	}
+
+	user := b.User
+	if user == "" {
+		user = connections.BecomeDefaultUser
+	}
+
+	return method + " " + user
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,595 @@
+package connections
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// PluginPrefix is the prefix of the name of the executable which
+	// implements a connection type that is not built in.
+	PluginPrefix = "bagel-connection-"
+
+	// PluginProtocolVersion is the version of the plugin protocol.
+	PluginProtocolVersion = 1
+
+	// PluginCloseTimeout is how long a plugin has to exit once it has
+	// been closed before it is killed.
+	PluginCloseTimeout = 5
+
+	// PluginCommandTimeout is how long a plugin has to answer a
+	// RunCommand request when its options have no timeout.
+	PluginCommandTimeout = 60
+)
+
+// PluginDirs are the directories which are searched, in order, for a
+// plugin before the directories in PATH.
+var PluginDirs []string
+
+// pluginTypeRe matches the connection types which can be implemented
+// by a plugin, so a type can't be used to name a path.
+var pluginTypeRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// pluginMessage is a JSON-RPC 2.0 request, response or notification.
+// Messages are sent one per line.
+type pluginMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *pluginError    `json:"error,omitempty"`
+}
+
+// pluginError is the error of a response. Data holds the result of
+// the method, if it returned one with the error.
+type pluginError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// The error codes of the protocol.
+const (
+	pluginErrorParse    = -32700
+	pluginErrorMethod   = -32601
+	pluginErrorParams   = -32602
+	pluginErrorInternal = -32000
+)
+
+// pluginInitParams are the parameters of the Init method.
+type pluginInitParams struct {
+	Version int                    `json:"version"`
+	Options map[string]interface{} `json:"options"`
+}
+
+// pluginInitResult is the result of the Init method.
+type pluginInitResult struct {
+	Version int `json:"version"`
+}
+
+// pluginRunOpts are the parameters of the RunCommand method. The
+// stdin of the command is sent with them, and Log asks for the output
+// to be sent as it is read.
+type pluginRunOpts struct {
+	RunOpts
+	Stdin []byte `json:"stdin,omitempty"`
+	Log   bool   `json:"log,omitempty"`
+}
+
+// pluginLogParams are the parameters of a Log notification, which
+// carries output of the RunCommand request with ID.
+type pluginLogParams struct {
+	ID     int64  `json:"id"`
+	Output string `json:"output"`
+}
+
+// pluginCancelParams are the parameters of a Cancel notification,
+// which stops the request with ID.
+type pluginCancelParams struct {
+	ID int64 `json:"id"`
+}
+
+// Plugin represents a connection implemented by an external program.
+// The program is started when the connection connects and is sent
+// requests over its stdin. See docs/plugins.md for the protocol.
+type Plugin struct {
+	Type    string
+	Path    string
+	Options map[string]interface{}
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	pending map[int64]*pluginCall
+	nextID  int64
+	done    chan struct{}
+	err     error
+	closed  bool
+
+	writeMu sync.Mutex
+}
+
+// pluginCall is a request which is waiting for its response.
+type pluginCall struct {
+	response chan pluginMessage
+	log      io.Writer
+}
+
+// FindPlugin returns the path of the plugin which implements connType.
+// PluginDirs are searched before PATH.
+func FindPlugin(connType string) (string, error) {
+	if !pluginTypeRe.MatchString(connType) {
+		return "", fmt.Errorf("unsupported connection type: %s", connType)
+	}
+
+	name := PluginPrefix + connType
+	for _, dir := range PluginDirs {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+
+	if p, err := exec.LookPath(name); err == nil {
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unsupported connection type: %s: %s was not found", connType, name)
+}
+
+// NewPlugin returns a connection implemented by the plugin at path.
+func NewPlugin(connType, path string, options map[string]interface{}) (*Plugin, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a plugin path was not specified")
+	}
+
+	plugin := Plugin{
+		Type:    connType,
+		Path:    path,
+		Options: options,
+	}
+
+	return &plugin, nil
+}
+
+// Connect implements the Connect method of the Connection interface.
+// It starts the plugin and sends it the connection options.
+func (r *Plugin) Connect(ctx context.Context) error {
+	started, err := r.start()
+	if err != nil {
+		return err
+	}
+
+	if started {
+		params := pluginInitParams{
+			Version: PluginProtocolVersion,
+			Options: pluginOptions(r.Options),
+		}
+
+		var init pluginInitResult
+		if _, err := r.call(ctx, "Init", params, &init, nil); err != nil {
+			return fmt.Errorf("unable to initialize plugin %s: %s", r.Path, err)
+		}
+
+		if init.Version != PluginProtocolVersion {
+			return fmt.Errorf("plugin %s uses protocol version %d, expected %d",
+				r.Path, init.Version, PluginProtocolVersion)
+		}
+	}
+
+	_, err = r.call(ctx, "Connect", struct{}{}, nil, nil)
+	return err
+}
+
+// RunCommand implements the RunCommand method of the Connection interface.
+func (r *Plugin) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
+	var rr RunResult
+
+	params := pluginRunOpts{RunOpts: ro}
+	if ro.Stdin != nil {
+		stdin, err := ioutil.ReadAll(ro.Stdin)
+		if err != nil {
+			return nil, err
+		}
+
+		params.Stdin = stdin
+	}
+
+	var log io.Writer
+	if ro.Log != nil {
+		log = *ro.Log
+		params.Log = true
+	}
+
+	timeout := PluginCommandTimeout
+	if ro.Timeout > 0 {
+		timeout = ro.Timeout
+	}
+
+	err := timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		_, err := r.call(ctx, "RunCommand", params, &rr, log)
+		return err
+	})
+
+	if err != nil && err.Error() == "timeout" {
+		rr.Timeout = true
+	}
+
+	// The plugin returns all of the output at once.
+	if ro.Stdout != nil && rr.Stdout != "" {
+		if _, err := io.WriteString(ro.Stdout, rr.Stdout); err != nil {
+			return nil, err
+		}
+
+		rr.Stdout = ""
+	}
+
+	return &rr, err
+}
+
+// FileInfo implements the FileInfo method of the Connection interface.
+func (r *Plugin) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "FileInfo", fo)
+}
+
+// FileDelete implements the FileDelete method of the Connection interface.
+func (r *Plugin) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "FileDelete", fo)
+}
+
+// FileUpload implements the FileUpload method of the Connection interface.
+// The plugin reads the source from the local host itself.
+func (r *Plugin) FileUpload(ctx context.Context, fo CopyFileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "FileUpload", fo)
+}
+
+// FileDownload implements the FileDownload method of the Connection interface.
+// The plugin writes the destination on the local host itself.
+func (r *Plugin) FileDownload(ctx context.Context, fo CopyFileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "FileDownload", fo)
+}
+
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r *Plugin) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "MkdirAll", fo)
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r *Plugin) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "Chmod", fo)
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r *Plugin) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "Chown", fo)
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r *Plugin) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "Rename", fo)
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r *Plugin) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "Symlink", fo)
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r *Plugin) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "ReadFile", fo)
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+func (r *Plugin) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "WriteFile", fo)
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r *Plugin) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "RemoveAll", fo)
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r *Plugin) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	return r.fileCall(ctx, "ReadDir", fo)
+}
+
+// Close implements the Close method of the Connection interface.
+// The plugin is asked to close and is killed if it doesn't exit in
+// time.
+func (r *Plugin) Close() {
+	r.mu.Lock()
+	if r.cmd == nil || r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+
+	// A request which timed out may not have been cancelled yet. The
+	// plugin finishes its requests before it closes, so they are
+	// cancelled first.
+	var ids []int64
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.send(nil, "Cancel", pluginCancelParams{ID: id})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PluginCloseTimeout*time.Second)
+	defer cancel()
+
+	r.call(ctx, "Close", struct{}{}, nil, nil)
+	r.stdin.Close()
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		r.cmd.Process.Kill()
+		<-r.done
+	}
+}
+
+// fileCall sends a file action to the plugin.
+func (r *Plugin) fileCall(ctx context.Context, method string, params interface{}) (*FileResult, error) {
+	var fr FileResult
+
+	ok, err := r.call(ctx, method, params, &fr, nil)
+	if !ok {
+		return nil, err
+	}
+
+	return &fr, err
+}
+
+// start starts the plugin if it is not running. It reports whether
+// the plugin was started.
+func (r *Plugin) start() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false, fmt.Errorf("plugin %s is closed", r.Path)
+	}
+
+	if r.cmd != nil {
+		return false, nil
+	}
+
+	cmd := exec.Command(r.Path)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("unable to start plugin %s: %s", r.Path, err)
+	}
+
+	r.cmd = cmd
+	r.stdin = stdin
+	r.pending = make(map[int64]*pluginCall)
+	r.done = make(chan struct{})
+
+	go r.read(stdout)
+
+	return true, nil
+}
+
+// read reads messages from the plugin until it exits.
+func (r *Plugin) read(stdout io.Reader) {
+	dec := json.NewDecoder(stdout)
+
+	var err error
+	for {
+		var msg pluginMessage
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+
+		switch {
+		case msg.Method == "Log":
+			var params pluginLogParams
+			if json.Unmarshal(msg.Params, &params) != nil {
+				continue
+			}
+
+			r.mu.Lock()
+			call := r.pending[params.ID]
+			r.mu.Unlock()
+
+			if call != nil && call.log != nil {
+				io.WriteString(call.log, params.Output)
+			}
+
+		case msg.ID != nil:
+			r.mu.Lock()
+			call := r.pending[*msg.ID]
+			delete(r.pending, *msg.ID)
+			r.mu.Unlock()
+
+			if call != nil {
+				call.response <- msg
+			}
+		}
+	}
+
+	// Drain the output so the plugin isn't blocked writing to it.
+	io.Copy(ioutil.Discard, stdout)
+	waitErr := r.cmd.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.closed:
+		r.err = fmt.Errorf("plugin %s is closed", r.Path)
+	case waitErr != nil:
+		r.err = fmt.Errorf("plugin %s exited: %s", r.Path, waitErr)
+	case err != io.EOF:
+		r.err = fmt.Errorf("unable to read from plugin %s: %s", r.Path, err)
+	default:
+		r.err = fmt.Errorf("plugin %s exited", r.Path)
+	}
+
+	r.pending = nil
+	close(r.done)
+}
+
+// call sends a request to the plugin and waits for its response. If
+// ctx is cancelled, the plugin is told to stop the request and an
+// "interrupted" error is returned. It reports whether a result was
+// decoded into result.
+func (r *Plugin) call(ctx context.Context, method string, params, result interface{}, log io.Writer) (bool, error) {
+	r.mu.Lock()
+	if r.cmd == nil {
+		r.mu.Unlock()
+		return false, fmt.Errorf("plugin %s is not connected", r.Path)
+	}
+
+	if r.pending == nil {
+		err := r.err
+		r.mu.Unlock()
+		return false, err
+	}
+
+	r.nextID++
+	id := r.nextID
+	call := &pluginCall{
+		response: make(chan pluginMessage, 1),
+		log:      log,
+	}
+	r.pending[id] = call
+	r.mu.Unlock()
+
+	if err := r.send(&id, method, params); err != nil {
+		r.forget(id)
+		return false, err
+	}
+
+	select {
+	case msg := <-call.response:
+		return pluginResult(msg, result)
+
+	case <-ctx.Done():
+		// The request is forgotten after it is cancelled so Close
+		// sees it until then.
+		r.send(nil, "Cancel", pluginCancelParams{ID: id})
+		r.forget(id)
+		return false, fmt.Errorf("interrupted")
+
+	case <-r.done:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return false, r.err
+	}
+}
+
+// send writes a message to the plugin. A message with no id is a
+// notification.
+func (r *Plugin) send(id *int64, method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	msg := pluginMessage{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+		Params:  data,
+	}
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	if err := json.NewEncoder(r.stdin).Encode(msg); err != nil {
+		return fmt.Errorf("unable to write to plugin %s: %s", r.Path, err)
+	}
+
+	return nil
+}
+
+// forget stops waiting for the response to the request with id.
+func (r *Plugin) forget(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending != nil {
+		delete(r.pending, id)
+	}
+}
+
+// pluginResult decodes the result of a response into result. An error
+// response may carry a result as its data.
+func pluginResult(msg pluginMessage, result interface{}) (bool, error) {
+	data := msg.Result
+
+	var err error
+	if msg.Error != nil {
+		data = msg.Error.Data
+		err = fmt.Errorf("%s", msg.Error.Message)
+	}
+
+	if result == nil || len(data) == 0 || string(data) == "null" {
+		return false, err
+	}
+
+	if jsonErr := json.Unmarshal(data, result); jsonErr != nil {
+		return false, fmt.Errorf("unable to parse plugin result: %s", jsonErr)
+	}
+
+	return true, err
+}
+
+// pluginOptions converts the maps decoded from YAML, which have keys
+// of any type, so options can be sent as JSON.
+func pluginOptions(options map[string]interface{}) map[string]interface{} {
+	converted := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		converted[k] = pluginValue(v)
+	}
+
+	return converted
+}
+
+// pluginValue converts a value of the options for JSON.
+func pluginValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = pluginValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		return pluginOptions(v)
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = pluginValue(val)
+		}
+		return s
+	}
+
+	return v
+}
@@ -0,0 +1,301 @@
+package connections
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pluginFileMethods are the file actions which take FileOpts, by the
+// name of their method in the protocol.
+var pluginFileMethods = map[string]func(Connection, context.Context, FileOpts) (*FileResult, error){
+	"FileInfo":   Connection.FileInfo,
+	"FileDelete": Connection.FileDelete,
+	"MkdirAll":   Connection.MkdirAll,
+	"Chmod":      Connection.Chmod,
+	"Chown":      Connection.Chown,
+	"Rename":     Connection.Rename,
+	"Symlink":    Connection.Symlink,
+	"ReadFile":   Connection.ReadFile,
+	"WriteFile":  Connection.WriteFile,
+	"RemoveAll":  Connection.RemoveAll,
+	"ReadDir":    Connection.ReadDir,
+}
+
+// pluginCopyMethods are the file actions which take CopyFileOpts, by
+// the name of their method in the protocol.
+var pluginCopyMethods = map[string]func(Connection, context.Context, CopyFileOpts) (*FileResult, error){
+	"FileUpload":   Connection.FileUpload,
+	"FileDownload": Connection.FileDownload,
+}
+
+// pluginServer answers the requests of bagel in a plugin.
+type pluginServer struct {
+	newConn func(map[string]interface{}) (Connection, error)
+
+	out     io.Writer
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	conn    Connection
+	cancels map[int64]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// ServePlugin implements the plugin protocol for a connection type.
+// It is meant to be called by the main function of a plugin written
+// in Go, with the stdin and stdout of the plugin. Init creates the
+// connection with newConn and every other request is passed to it.
+// ServePlugin returns once in is closed.
+func ServePlugin(in io.Reader, out io.Writer, newConn func(map[string]interface{}) (Connection, error)) error {
+	s := pluginServer{
+		newConn: newConn,
+		out:     out,
+		cancels: make(map[int64]context.CancelFunc),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dec := json.NewDecoder(in)
+	for {
+		var msg pluginMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			s.respond(nil, nil, &pluginError{Code: pluginErrorParse, Message: err.Error()})
+			return err
+		}
+
+		switch {
+		case msg.Method == "Cancel":
+			var params pluginCancelParams
+			if json.Unmarshal(msg.Params, &params) == nil {
+				s.cancel(params.ID)
+			}
+
+		case msg.ID == nil:
+			// Other notifications are ignored.
+
+		case msg.Method == "Init" || msg.Method == "Close":
+			// These change the connection, so the requests before
+			// them are finished first.
+			s.wg.Wait()
+			s.handle(ctx, msg)
+
+		default:
+			reqCtx, reqCancel := context.WithCancel(ctx)
+			s.mu.Lock()
+			s.cancels[*msg.ID] = reqCancel
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func(msg pluginMessage) {
+				defer s.wg.Done()
+				defer s.cancel(*msg.ID)
+
+				s.handle(reqCtx, msg)
+			}(msg)
+		}
+	}
+
+	cancel()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return nil
+}
+
+// handle answers a request.
+func (r *pluginServer) handle(ctx context.Context, msg pluginMessage) {
+	result, err := r.dispatch(ctx, msg)
+	if err != nil {
+		if _, ok := err.(*pluginError); !ok {
+			err = &pluginError{Code: pluginErrorInternal, Message: err.Error(), Data: r.marshal(result)}
+		}
+
+		r.respond(msg.ID, nil, err.(*pluginError))
+		return
+	}
+
+	r.respond(msg.ID, r.marshal(result), nil)
+}
+
+// dispatch calls the method of the connection which a request names.
+// It returns a *pluginError if the request itself is invalid.
+func (r *pluginServer) dispatch(ctx context.Context, msg pluginMessage) (interface{}, error) {
+	if msg.Method == "Init" {
+		var params pluginInitParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &pluginError{Code: pluginErrorParams, Message: err.Error()}
+		}
+
+		if params.Version != PluginProtocolVersion {
+			return nil, fmt.Errorf("unsupported protocol version: %d", params.Version)
+		}
+
+		conn, err := r.newConn(params.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.conn = conn
+		r.mu.Unlock()
+
+		return pluginInitResult{Version: PluginProtocolVersion}, nil
+	}
+
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn == nil {
+		return nil, fmt.Errorf("the plugin has not been initialized")
+	}
+
+	switch msg.Method {
+	case "Connect":
+		return nil, conn.Connect(ctx)
+
+	case "Close":
+		conn.Close()
+		return nil, nil
+
+	case "RunCommand":
+		var params pluginRunOpts
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &pluginError{Code: pluginErrorParams, Message: err.Error()}
+		}
+
+		ro := params.RunOpts
+		if params.Stdin != nil {
+			ro.Stdin = bytes.NewReader(params.Stdin)
+		}
+
+		if params.Log {
+			var log io.Writer = pluginLogWriter{s: r, id: *msg.ID}
+			ro.Log = &log
+		}
+
+		rr, err := conn.RunCommand(ctx, ro)
+		if rr == nil {
+			return nil, err
+		}
+
+		return rr, err
+	}
+
+	if f, ok := pluginFileMethods[msg.Method]; ok {
+		var fo FileOpts
+		if err := json.Unmarshal(msg.Params, &fo); err != nil {
+			return nil, &pluginError{Code: pluginErrorParams, Message: err.Error()}
+		}
+
+		return pluginFileResult(f(conn, ctx, fo))
+	}
+
+	if f, ok := pluginCopyMethods[msg.Method]; ok {
+		var fo CopyFileOpts
+		if err := json.Unmarshal(msg.Params, &fo); err != nil {
+			return nil, &pluginError{Code: pluginErrorParams, Message: err.Error()}
+		}
+
+		return pluginFileResult(f(conn, ctx, fo))
+	}
+
+	return nil, &pluginError{Code: pluginErrorMethod, Message: fmt.Sprintf("method not found: %s", msg.Method)}
+}
+
+// cancel stops the request with id.
+func (r *pluginServer) cancel(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+		delete(r.cancels, id)
+	}
+}
+
+// respond writes the response to the request with id.
+func (r *pluginServer) respond(id *int64, result json.RawMessage, perr *pluginError) {
+	if id == nil && perr == nil {
+		return
+	}
+
+	if result == nil && perr == nil {
+		result = json.RawMessage("null")
+	}
+
+	r.write(pluginMessage{JSONRPC: "2.0", ID: id, Result: result, Error: perr})
+}
+
+// write writes a message to bagel.
+func (r *pluginServer) write(msg pluginMessage) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	json.NewEncoder(r.out).Encode(msg)
+}
+
+// marshal encodes the result of a method. It returns nil if there is
+// no result.
+func (r *pluginServer) marshal(result interface{}) json.RawMessage {
+	if result == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Error implements the error interface.
+func (r *pluginError) Error() string {
+	return r.Message
+}
+
+// pluginFileResult returns the result of a file action, avoiding a
+// nil *FileResult in a non-nil interface.
+func pluginFileResult(fr *FileResult, err error) (interface{}, error) {
+	if fr == nil {
+		return nil, err
+	}
+
+	return fr, err
+}
+
+// pluginLogWriter sends the output of a command to bagel as Log
+// notifications.
+type pluginLogWriter struct {
+	s  *pluginServer
+	id int64
+}
+
+// Write implements the io.Writer interface.
+func (r pluginLogWriter) Write(p []byte) (int, error) {
+	params, err := json.Marshal(pluginLogParams{ID: r.id, Output: string(p)})
+	if err != nil {
+		return 0, err
+	}
+
+	r.s.write(pluginMessage{JSONRPC: "2.0", Method: "Log", Params: params})
+
+	return len(p), nil
+}
@@ -2,19 +2,21 @@ package connections
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-
-	"github.com/mitchellh/go-homedir"
 
 	"github.com/pkg/sftp"
 
@@ -29,8 +31,10 @@ const (
 	SSHCommandTimeout    = 60
 	SSHConnectionTimeout = 300
 
+	SSHKeepaliveInterval = 30
+	SSHKeepaliveCountMax = 3
+
 	SCPMaxPacketSize = 32768
-	SCPMaxBytes      = 4096
 )
 
 // SSH represents an SSH connection.
@@ -43,16 +47,57 @@ type SSH struct {
 	Timeout    int    `mapstructure:"timeout"`
 	User       string `mapstructure:"user"`
 
+	AuthMethods                []string          `mapstructure:"auth_methods"`
+	Certificate                string            `mapstructure:"certificate"`
+	KeyboardInteractiveAnswers map[string]string `mapstructure:"keyboard_interactive_answers"`
+	Password                   string            `mapstructure:"password"`
+	PrivateKeyPassphrase       string            `mapstructure:"private_key_passphrase"`
+
 	BastionUser       string `mapstructure:"bastion_user"`
 	BastionPrivateKey string `mapstructure:"bastion_private_key"`
 	BastionHost       string `mapstructure:"bastion_host"`
 	BastionPort       int    `mapstructure:"bastion_port"`
+	BastionHostKey    string `mapstructure:"bastion_host_key"`
+
+	JumpHosts []SSHJumpHost `mapstructure:"jump_hosts"`
 
-	bastionConfig *ssh.ClientConfig
-	bastionConn   *net.Conn
+	HostKey         string `mapstructure:"host_key"`
+	HostKeyChecking string `mapstructure:"host_key_checking"`
+	KnownHostsFile  string `mapstructure:"known_hosts_file"`
+
+	SSHConfig     *bool  `mapstructure:"ssh_config"`
+	SSHConfigFile string `mapstructure:"ssh_config_file"`
+
+	KeepaliveInterval int `mapstructure:"keepalive_interval"`
+	KeepaliveCountMax int `mapstructure:"keepalive_count_max"`
+
+	// mu guards the clients, which are replaced if the
+	// connection is lost.
+	mu            sync.Mutex
 	client        *ssh.Client
 	config        *ssh.ClientConfig
+	jumpClients   []*ssh.Client
+	jumpHosts     []*SSHJumpHost
 	sftp          *sftp.Client
+	keepaliveStop chan struct{}
+}
+
+// SSHJumpHost represents a host to tunnel through to reach the target.
+type SSHJumpHost struct {
+	Host                 string `mapstructure:"host" required:"true"`
+	Port                 int    `mapstructure:"port"`
+	User                 string `mapstructure:"user"`
+	PrivateKey           string `mapstructure:"private_key"`
+	PrivateKeyPassphrase string `mapstructure:"private_key_passphrase"`
+	Certificate          string `mapstructure:"certificate"`
+	HostKey              string `mapstructure:"host_key"`
+
+	config *ssh.ClientConfig
+}
+
+// address returns the host:port of the jump host.
+func (r SSHJumpHost) address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
 }
 
 // NewSSH will return an SSH client.
@@ -64,130 +109,203 @@ func NewSSH(options map[string]interface{}) (*SSH, error) {
 		return nil, err
 	}
 
-	var signer ssh.Signer
-	if sshConfig.PrivateKey == "" {
-		// If no private_key was specified, try using $user/.ssh/id_rsa.
-		if homeDir, err := homedir.Dir(); err == nil {
-			privateKey := filepath.Join(homeDir, ".ssh", "id_rsa")
-			if _, err := os.Stat(privateKey); err == nil {
-				sshConfig.PrivateKey = privateKey
-			}
+	if sshConfig.BastionHost != "" && len(sshConfig.JumpHosts) > 0 {
+		return nil, fmt.Errorf("only one of bastion_host or jump_hosts can be specified")
+	}
+
+	// A bastion host is a single jump host.
+	if sshConfig.BastionHost != "" {
+		sshConfig.jumpHosts = append(sshConfig.jumpHosts, &SSHJumpHost{
+			Host:       sshConfig.BastionHost,
+			Port:       sshConfig.BastionPort,
+			User:       sshConfig.BastionUser,
+			PrivateKey: sshConfig.BastionPrivateKey,
+			HostKey:    sshConfig.BastionHostKey,
+		})
+	}
+
+	for i := range sshConfig.JumpHosts {
+		if sshConfig.JumpHosts[i].Host == "" {
+			return nil, fmt.Errorf("jump_hosts entry %d is missing a host", i)
 		}
+
+		sshConfig.jumpHosts = append(sshConfig.jumpHosts, &sshConfig.JumpHosts[i])
 	}
 
-	if sshConfig.PrivateKey != "" {
-		privateKey, err := homedir.Expand(sshConfig.PrivateKey)
-		if err != nil {
+	// Settings from ssh_config are applied before any defaults
+	// so that explicit options take precedence over them.
+	if sshConfig.SSHConfig == nil || *sshConfig.SSHConfig {
+		if err := sshConfig.applySSHConfig(); err != nil {
 			return nil, err
 		}
+	}
+
+	if sshConfig.Port == 0 {
+		sshConfig.Port = SSHDefaultPort
+	}
+
+	if sshConfig.User == "" {
+		sshConfig.User = SSHDefaultUser
+	}
+
+	if sshConfig.Shell == "" {
+		sshConfig.Shell = SSHDefaultShell
+	}
 
-		if _, err := os.Stat(privateKey); os.IsNotExist(err) {
-			return nil, fmt.Errorf("private_key %s does not exist", privateKey)
+	if sshConfig.KeepaliveInterval == 0 {
+		sshConfig.KeepaliveInterval = SSHKeepaliveInterval
+	}
+
+	if sshConfig.KeepaliveCountMax == 0 {
+		sshConfig.KeepaliveCountMax = SSHKeepaliveCountMax
+	}
+
+	if sshConfig.HostKeyChecking == "" {
+		sshConfig.HostKeyChecking = SSHDefaultHostKeyChecking
+	}
+
+	if sshConfig.KnownHostsFile == "" {
+		sshConfig.KnownHostsFile = SSHDefaultKnownHostsFile
+	}
+
+	hostKeyCallback, err := newHostKeyCallback(
+		sshConfig.HostKeyChecking, sshConfig.KnownHostsFile, sshConfig.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := sshAuth{
+		Agent:                      sshConfig.Agent,
+		PrivateKey:                 sshConfig.PrivateKey,
+		PrivateKeyPassphrase:       sshConfig.PrivateKeyPassphrase,
+		Certificate:                sshConfig.Certificate,
+		Password:                   sshConfig.Password,
+		KeyboardInteractiveAnswers: sshConfig.KeyboardInteractiveAnswers,
+		Methods:                    sshConfig.AuthMethods,
+	}
+
+	authMethods, err := auth.authMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	sshConfig.config = &ssh.ClientConfig{
+		User:            sshConfig.User,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	for _, jh := range sshConfig.jumpHosts {
+		if jh.Port == 0 {
+			jh.Port = SSHDefaultPort
+		}
+
+		if jh.User == "" {
+			jh.User = SSHDefaultUser
 		}
 
-		key, err := ioutil.ReadFile(privateKey)
+		// Jump hosts without their own key use the key of the target.
+		jumpAuth := sshAuth{
+			Name:                 fmt.Sprintf("jump host %s ", jh.Host),
+			Agent:                sshConfig.Agent,
+			PrivateKey:           jh.PrivateKey,
+			PrivateKeyPassphrase: jh.PrivateKeyPassphrase,
+			Certificate:          jh.Certificate,
+		}
+
+		if jumpAuth.PrivateKey == "" {
+			jumpAuth.PrivateKey = sshConfig.PrivateKey
+			jumpAuth.PrivateKeyPassphrase = sshConfig.PrivateKeyPassphrase
+			jumpAuth.Certificate = sshConfig.Certificate
+		}
+
+		jumpAuthMethods, err := jumpAuth.authMethods()
 		if err != nil {
 			return nil, err
 		}
 
-		signer, err = ssh.ParsePrivateKey(key)
+		jumpHostKeyCallback, err := newHostKeyCallback(
+			sshConfig.HostKeyChecking, sshConfig.KnownHostsFile, jh.HostKey)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	var bastionSigner ssh.Signer
-	if sshConfig.BastionHost != "" {
-		if sshConfig.BastionPrivateKey == "" {
-			// If no bastion private_key was specified, try using $user/.ssh/id_rsa.
-			if homeDir, err := homedir.Dir(); err == nil {
-				privateKey := filepath.Join(homeDir, ".ssh", "id_rsa")
-				if _, err := os.Stat(privateKey); err == nil {
-					sshConfig.BastionPrivateKey = privateKey
-				}
-			}
+		jh.config = &ssh.ClientConfig{
+			User:            jh.User,
+			Auth:            jumpAuthMethods,
+			HostKeyCallback: jumpHostKeyCallback,
 		}
+	}
 
-		if sshConfig.BastionPrivateKey != "" {
-			privateKey, err := homedir.Expand(sshConfig.PrivateKey)
-			if err != nil {
-				return nil, err
-			}
-
-			if _, err := os.Stat(privateKey); os.IsNotExist(err) {
-				return nil, fmt.Errorf("bastion_private_key %s does not exist", privateKey)
-			}
-
-			key, err := ioutil.ReadFile(privateKey)
-			if err != nil {
-				return nil, err
-			}
+	return &sshConfig, nil
+}
 
-			bastionSigner, err = ssh.ParsePrivateKey(key)
-			if err != nil {
-				return nil, err
-			}
-		}
+// applySSHConfig resolves the host against an ssh_config file and
+// sets any options which were not explicitly given.
+func (r *SSH) applySSHConfig() error {
+	configFile := r.SSHConfigFile
+	if configFile == "" {
+		configFile = SSHDefaultConfigFile
 	}
 
-	if sshConfig.Port == 0 {
-		sshConfig.Port = SSHDefaultPort
+	config, err := readSSHConfig(configFile)
+	if err != nil {
+		return err
 	}
 
-	if sshConfig.BastionPort == 0 {
-		sshConfig.BastionPort = SSHDefaultPort
+	configHost, err := lookupSSHConfigHost(config, r.Host)
+	if err != nil {
+		return err
 	}
 
-	if sshConfig.User == "" {
-		sshConfig.User = SSHDefaultUser
+	if configHost.HostName != "" {
+		r.Host = configHost.HostName
 	}
 
-	if sshConfig.BastionUser == "" {
-		sshConfig.BastionUser = SSHDefaultUser
+	if r.User == "" {
+		r.User = configHost.User
 	}
 
-	if sshConfig.Shell == "" {
-		sshConfig.Shell = SSHDefaultShell
+	if r.Port == 0 {
+		r.Port = configHost.Port
 	}
 
-	authMethod := ssh.PublicKeys(signer)
-	if sshConfig.Agent {
-		if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-			authMethod = ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
-		}
-	}
+	if r.PrivateKey == "" {
+		r.PrivateKey = configHost.IdentityFile
 
-	sshConfig.config = &ssh.ClientConfig{
-		User: sshConfig.User,
-		Auth: []ssh.AuthMethod{
-			authMethod,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		if r.Certificate == "" {
+			r.Certificate = configHost.CertificateFile
+		}
 	}
 
-	if sshConfig.BastionHost != "" {
-		bastionAuthMethod := ssh.PublicKeys(bastionSigner)
-		if sshConfig.Agent {
-			if bastionAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-				bastionAuthMethod = ssh.PublicKeysCallback(agent.NewClient(bastionAgent).Signers)
+	// An explicit bastion_host or jump_hosts takes precedence over ProxyJump.
+	if len(r.jumpHosts) == 0 {
+		for _, hop := range configHost.ProxyJump {
+			jh, err := parseJumpHost(config, hop)
+			if err != nil {
+				return err
 			}
-		}
 
-		sshConfig.bastionConfig = &ssh.ClientConfig{
-			User: sshConfig.BastionUser,
-			Auth: []ssh.AuthMethod{
-				bastionAuthMethod,
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			r.jumpHosts = append(r.jumpHosts, jh)
 		}
 	}
 
-	return &sshConfig, nil
+	return nil
 }
 
 // Connect implements the Connect method of the Connection interface.
-// It will connect to a host via SSH.
-func (r *SSH) Connect() error {
+// It will connect to a host via SSH. The connection is kept alive
+// and is reused by every action until it is closed.
+func (r *SSH) Connect(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.connect(ctx)
+}
+
+// connect connects to the host if there is no connection. r.mu
+// must be held.
+func (r *SSH) connect(ctx context.Context) error {
 	var err error
 
 	// If a connection has already been made, don't do anything.
@@ -201,43 +319,286 @@ func (r *SSH) Connect() error {
 	}
 
 	host := fmt.Sprintf("%s:%d", r.Host, r.Port)
-	bastionHost := fmt.Sprintf("%s:%d", r.BastionHost, r.BastionPort)
-
-	err = retryFunc(connectTimeout, func() error {
-		if r.BastionHost != "" {
-			r.client, err = ssh.Dial("tcp", bastionHost, r.bastionConfig)
-			if err != nil {
-				return err
-			}
-
-			conn, err := r.client.Dial("tcp", host)
-			if err != nil {
-				return err
-			}
-			r.bastionConn = &conn
 
-			return nil
+	// An attempt may still be running when retryFunc gives up, so
+	// its clients are only kept if it finished in time.
+	var mu sync.Mutex
+	var client *ssh.Client
+	var jumpClients []*ssh.Client
+
+	err = retryFunc(ctx, connectTimeout, func(ctx context.Context) error {
+		var c *ssh.Client
+		var jcs []*ssh.Client
+		var err error
+
+		if len(r.jumpHosts) > 0 {
+			c, jcs, err = r.dialViaJumpHosts(ctx, host)
+		} else {
+			c, err = sshDial(ctx, host, r.config)
 		}
 
-		r.client, err = ssh.Dial("tcp", host, r.config)
 		if err != nil {
 			return err
 		}
 
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ctx.Err() != nil {
+			closeClients(c, jcs)
+			return ctx.Err()
+		}
+
+		client, jumpClients = c, jcs
+
 		return nil
 	})
 
+	mu.Lock()
+	defer mu.Unlock()
+
 	if err != nil {
+		if client != nil {
+			closeClients(client, jumpClients)
+		}
+
 		if err.Error() == "timeout" {
 			return fmt.Errorf("timed out connecting to %s", host)
 		}
+
+		return err
+	}
+
+	r.client = client
+	r.jumpClients = jumpClients
+
+	if r.KeepaliveInterval > 0 {
+		r.keepaliveStop = make(chan struct{})
+		go r.keepalive(r.client, r.keepaliveStop)
 	}
 
 	return nil
 }
 
+// keepalive sends keepalive requests over client until stop is closed.
+// If too many requests go unanswered, the connection is dropped so the
+// next action reconnects.
+func (r *SSH) keepalive(client *ssh.Client, stop chan struct{}) {
+	interval := time.Duration(r.KeepaliveInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A server which has gone away may never reply.
+		replyCh := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replyCh <- err
+		}()
+
+		var err error
+		select {
+		case <-stop:
+			return
+		case err = <-replyCh:
+		case <-time.After(interval):
+			err = fmt.Errorf("timeout")
+		}
+
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= r.KeepaliveCountMax {
+			r.drop(client)
+			return
+		}
+	}
+}
+
+// drop closes the connection if client is still the current client.
+func (r *SSH) drop(client *ssh.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client == client {
+		r.close()
+	}
+}
+
+// close closes the SFTP client, the SSH connection and any jump host
+// connections. r.mu must be held.
+func (r *SSH) close() {
+	if r.keepaliveStop != nil {
+		close(r.keepaliveStop)
+		r.keepaliveStop = nil
+	}
+
+	if r.sftp != nil {
+		r.sftp.Close()
+		r.sftp = nil
+	}
+
+	if r.client != nil {
+		r.client.Close()
+		r.client = nil
+	}
+
+	for i := len(r.jumpClients) - 1; i >= 0; i-- {
+		r.jumpClients[i].Close()
+	}
+	r.jumpClients = nil
+}
+
+// session opens a new session. If the connection has been lost,
+// it reconnects once.
+func (r *SSH) session(ctx context.Context) (*ssh.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	session, err := r.client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	r.close()
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.client.NewSession()
+}
+
+// sftpClient returns the SFTP client of the connection. It is created
+// the first time it is needed and reused by later file actions. If
+// the connection has been lost, it reconnects once.
+func (r *SSH) sftpClient(ctx context.Context) (*sftp.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	if r.sftp != nil {
+		return r.sftp, nil
+	}
+
+	client, err := sftp.NewClient(r.client, sftp.MaxPacket(SCPMaxPacketSize))
+	if err != nil {
+		r.close()
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+
+		client, err = sftp.NewClient(r.client, sftp.MaxPacket(SCPMaxPacketSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.sftp = client
+
+	return client, nil
+}
+
+// dialViaJumpHosts connects to the host by tunneling through each
+// jump host in order. It returns the client and the jump host clients.
+func (r *SSH) dialViaJumpHosts(ctx context.Context, host string) (*ssh.Client, []*ssh.Client, error) {
+	var clients []*ssh.Client
+
+	first := r.jumpHosts[0]
+	client, err := sshDial(ctx, first.address(), first.config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to jump host %s: %s", first.address(), err)
+	}
+	clients = append(clients, client)
+
+	for _, jh := range r.jumpHosts[1:] {
+		client, err = sshDialThrough(client, jh.address(), jh.config)
+		if err != nil {
+			closeClients(nil, clients)
+			return nil, nil, fmt.Errorf("unable to connect to jump host %s: %s", jh.address(), err)
+		}
+		clients = append(clients, client)
+	}
+
+	client, err = sshDialThrough(client, host, r.config)
+	if err != nil {
+		closeClients(nil, clients)
+		return nil, nil, err
+	}
+
+	return client, clients, nil
+}
+
+// closeClients closes a client and then the jump host clients it
+// was reached through, innermost first.
+func closeClients(client *ssh.Client, jumpClients []*ssh.Client) {
+	if client != nil {
+		client.Close()
+	}
+
+	for i := len(jumpClients) - 1; i >= 0; i-- {
+		jumpClients[i].Close()
+	}
+}
+
+// sshDial opens an SSH connection to addr. The dial and handshake
+// are abandoned if ctx is cancelled.
+func sshDial(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: config.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshDialThrough opens an SSH connection to addr tunneled over
+// an existing SSH client.
+func sshDialThrough(client *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 // RunCommand implements the Run method of the Connection interface.
-func (r SSH) RunCommand(ro RunOpts) (*RunResult, error) {
+func (r *SSH) RunCommand(ctx context.Context, ro RunOpts) (*RunResult, error) {
 	var rr RunResult
 	var outBuf, errBuf bytes.Buffer
 
@@ -251,13 +612,57 @@ func (r SSH) RunCommand(ro RunOpts) (*RunResult, error) {
 		timeout = ro.Timeout
 	}
 
+	if _, err := envList(ro.Env); err != nil {
+		return nil, err
+	}
+
+	// Run the command as another user if requested. The directory
+	// and environment are set by the command so they apply to the
+	// become user.
+	var become *becomeSession
+	if ro.Become != nil {
+		if ro.Become.Password != "" && ro.Stdin != nil {
+			return nil, fmt.Errorf("stdin can't be used with a become password")
+		}
+
+		command, err := wrapCommand(ro.Command, ro.Dir, ro.Env)
+		if err != nil {
+			return nil, err
+		}
+
+		become, err = newBecomeSession(ro.Become, r.Shell, command)
+		if err != nil {
+			return nil, err
+		}
+
+		ro.Command = become.command
+		ro.Dir = ""
+		ro.Env = nil
+	}
+
 	// Set up a session
-	session, err := r.client.NewSession()
+	session, err := r.session(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer session.Close()
 
+	session.Stdin = ro.Stdin
+
+	// Servers only accept the variables allowed by AcceptEnv, so
+	// any which are refused are exported by the command instead.
+	refused := make(map[string]string)
+	for k, v := range ro.Env {
+		if err := session.Setenv(k, v); err != nil {
+			refused[k] = v
+		}
+	}
+
+	ro.Command, err = wrapCommand(ro.Command, ro.Dir, refused)
+	if err != nil {
+		return nil, err
+	}
+
 	// Set up the output
 	log := ioutil.Discard
 	if ro.Log != nil {
@@ -270,21 +675,60 @@ func (r SSH) RunCommand(ro RunOpts) (*RunResult, error) {
 	session.Stdout = outW
 	session.Stderr = errW
 
-	outTee := io.TeeReader(outR, &outBuf)
+	if become != nil {
+		session.Stdout = become.filter(outW)
+		session.Stderr = become.filter(errW)
+
+		// su and doas read passwords from a terminal. Echo is
+		// disabled so the password is not written back.
+		if become.tty {
+			modes := ssh.TerminalModes{ssh.ECHO: 0}
+			if err := session.RequestPty("xterm", 40, 80, modes); err != nil {
+				return nil, err
+			}
+		}
+
+		if become.password != "" {
+			become.stdin, err = session.StdinPipe()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var output io.Writer = &outBuf
+	if ro.Stdout != nil {
+		output = ro.Stdout
+	}
+
+	outTee := io.TeeReader(outR, output)
 	errTee := io.TeeReader(errR, &errBuf)
 	outDoneCh := make(chan struct{})
 	errDoneCh := make(chan struct{})
-	go printOutput(log, outTee, outDoneCh)
-	go printOutput(log, errTee, errDoneCh)
+	go printOutput(log, "stdout", outTee, outDoneCh)
+	go printOutput(log, "stderr", errTee, errDoneCh)
 
-	//cmd := strings.Replace(ro.Command, `"`, `\"`, -1)
-	cmd := fmt.Sprintf(`%s -c "%s"`, r.Shell, ro.Command)
+	cmd := fmt.Sprintf("%s -c %s", r.Shell, shellQuote(ro.Command))
 
-	err = timeoutFunc(timeout, func() error {
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
 		if err := session.Start(cmd); err != nil {
 			return err
 		}
 
+		waitCh := make(chan struct{})
+		defer close(waitCh)
+
+		// Not all servers honour signals, so the session is closed
+		// as well to stop waiting on the command.
+		go func() {
+			select {
+			case <-ctx.Done():
+				session.Signal(ssh.SIGKILL)
+				session.Close()
+			case <-waitCh:
+			}
+		}()
+
 		if err := session.Wait(); err != nil {
 			if exit, ok := err.(*ssh.ExitError); ok {
 				rr.ExitCode = exit.Waitmsg.ExitStatus()
@@ -303,6 +747,10 @@ func (r SSH) RunCommand(ro RunOpts) (*RunResult, error) {
 		}
 	}
 
+	if become != nil {
+		become.flush()
+	}
+
 	outW.Close()
 	errW.Close()
 	<-outDoneCh
@@ -312,21 +760,33 @@ func (r SSH) RunCommand(ro RunOpts) (*RunResult, error) {
 	rr.Stderr = strings.TrimSpace(errBuf.String())
 	rr.Applied = true
 
+	if become != nil && err == nil {
+		err = become.err(rr.Stderr)
+	}
+
 	return &rr, err
 }
 
 // FileUpload implements the FileUpload method of the Connection interface.
-func (r SSH) FileUpload(cfo CopyFileOpts) (*FileResult, error) {
-	return r.copyFile(cfo, "upload")
+func (r *SSH) FileUpload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	if cfo.Become != nil {
+		return becomeFileUpload(ctx, r, cfo)
+	}
+
+	return r.copyFile(ctx, cfo, "upload")
 }
 
 // FileDownload implements the FileUpload method of the Connection interface.
-func (r SSH) FileDownload(cfo CopyFileOpts) (*FileResult, error) {
-	return r.copyFile(cfo, "download")
+func (r *SSH) FileDownload(ctx context.Context, cfo CopyFileOpts) (*FileResult, error) {
+	if cfo.Become != nil {
+		return becomeFileDownload(ctx, r, cfo)
+	}
+
+	return r.copyFile(ctx, cfo, "download")
 }
 
 // FileInfo implements the FileInfo method of the Connection interface.
-func (r SSH) FileInfo(fo FileOpts) (*FileResult, error) {
+func (r *SSH) FileInfo(ctx context.Context, fo FileOpts) (*FileResult, error) {
 	var fr FileResult
 	var fi FileInfo
 	var err error
@@ -335,46 +795,34 @@ func (r SSH) FileInfo(fo FileOpts) (*FileResult, error) {
 		return nil, fmt.Errorf("path is required for file info")
 	}
 
+	if fo.Become != nil {
+		return becomeFileInfo(ctx, r, fo)
+	}
+
 	timeout := SSHCommandTimeout
 	if fo.Timeout > 0 {
 		timeout = fo.Timeout
 	}
 
-	client, err := sftp.NewClient(r.client, sftp.MaxPacket(SCPMaxPacketSize))
+	client, err := r.sftpClient(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
-
-	err = timeoutFunc(timeout, func() error {
-		stat, err := client.Stat(fo.Path)
-		if err == nil {
-			fi.Name = stat.Name()
-			fi.Size = stat.Size()
-			fi.UID = int(stat.Sys().(*sftp.FileStat).UID)
-			fi.GID = int(stat.Sys().(*sftp.FileStat).GID)
-
-			mode := fmt.Sprintf("%o", int(stat.Mode().Perm()))
-			fi.Mode, _ = strconv.Atoi(mode)
-
-			if stat.IsDir() {
-				fi.Type = "directory"
-			}
 
-			if stat.Mode() == os.ModeSymlink {
-				fi.Type = "symlink"
-			}
-
-			if stat.Mode() == os.ModeSocket {
-				fi.Type = "socket"
-			}
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		stat, err := client.Lstat(fo.Path)
+		if err != nil {
+			return err
+		}
 
-			if fi.Type == "" {
-				fi.Type = "file"
-			}
+		fi, err = r.fileInfo(ctx, client, fo.Path, stat, fo.Checksum)
+		if err != nil {
+			return err
 		}
 
-		return err
+		fi.Owner, fi.Group = r.ownerNames(ctx, fi.UID, fi.GID)
+
+		return nil
 	})
 
 	if err != nil {
@@ -398,7 +846,7 @@ func (r SSH) FileInfo(fo FileOpts) (*FileResult, error) {
 }
 
 // FileDelete implements the FileDelete method of the Connection interface.
-func (r SSH) FileDelete(fo FileOpts) (*FileResult, error) {
+func (r *SSH) FileDelete(ctx context.Context, fo FileOpts) (*FileResult, error) {
 	var fr FileResult
 
 	// validate options
@@ -406,18 +854,21 @@ func (r SSH) FileDelete(fo FileOpts) (*FileResult, error) {
 		return nil, fmt.Errorf("path is required for file delete")
 	}
 
+	if fo.Become != nil {
+		return becomeFileDelete(ctx, r, fo)
+	}
+
 	timeout := SSHCommandTimeout
 	if fo.Timeout > 0 {
 		timeout = fo.Timeout
 	}
 
-	client, err := sftp.NewClient(r.client, sftp.MaxPacket(SCPMaxPacketSize))
+	client, err := r.sftpClient(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
 
-	err = timeoutFunc(timeout, func() error {
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
 		if err := client.Remove(fo.Path); err != nil {
 			return err
 		}
@@ -440,23 +891,221 @@ func (r SSH) FileDelete(fo FileOpts) (*FileResult, error) {
 	return &fr, err
 }
 
-// Close implements the Close method of the Connection interface.
-// It will close an SSH and bastion connection if they are opened.
-func (r SSH) Close() {
-	if r.bastionConn != nil {
-		(*r.bastionConn).Close()
-		r.bastionConn = nil
+// MkdirAll implements the MkdirAll method of the Connection interface.
+func (r *SSH) MkdirAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellMkdirAll(ctx, r, fo)
 	}
 
-	if r.client != nil {
-		r.client.Close()
-		r.client = nil
+	return r.fileAction(ctx, "mkdir", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		if err := client.MkdirAll(fo.Path); err != nil {
+			return err
+		}
+
+		if fo.Mode != 0 {
+			return client.Chmod(fo.Path, fo.Mode)
+		}
+
+		return nil
+	})
+}
+
+// Chmod implements the Chmod method of the Connection interface.
+func (r *SSH) Chmod(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellChmod(ctx, r, fo)
+	}
+
+	return r.fileAction(ctx, "chmod", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		return client.Chmod(fo.Path, fo.Mode)
+	})
+}
+
+// Chown implements the Chown method of the Connection interface.
+func (r *SSH) Chown(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellChown(ctx, r, fo)
+	}
+
+	return r.fileAction(ctx, "chown", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		return sftpChown(client, fo.Path, fo.UID, fo.GID)
+	})
+}
+
+// Rename implements the Rename method of the Connection interface.
+func (r *SSH) Rename(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellRename(ctx, r, fo)
+	}
+
+	return r.fileAction(ctx, "rename", fo, true, func(ctx context.Context, client *sftp.Client) error {
+		return sftpRename(client, fo.Path, fo.Target)
+	})
+}
+
+// Symlink implements the Symlink method of the Connection interface.
+func (r *SSH) Symlink(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellSymlink(ctx, r, fo)
+	}
+
+	return r.fileAction(ctx, "symlink", fo, true, func(ctx context.Context, client *sftp.Client) error {
+		return client.Symlink(fo.Target, fo.Path)
+	})
+}
+
+// ReadFile implements the ReadFile method of the Connection interface.
+func (r *SSH) ReadFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return downloadReadFile(ctx, r, fo)
+	}
+
+	var content []byte
+	fr, err := r.fileAction(ctx, "read", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		f, err := client.Open(fo.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		content, err = ioutil.ReadAll(contextReader{ctx, f})
+		return err
+	})
+
+	if fr != nil {
+		fr.Content = content
+	}
+
+	return fr, err
+}
+
+// WriteFile implements the WriteFile method of the Connection interface.
+// Like FileUpload, the content is written to a temporary file which is
+// verified and renamed into place.
+func (r *SSH) WriteFile(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return uploadWriteFile(ctx, r, fo)
+	}
+
+	if fo.Mode == 0 {
+		fo.Mode = os.FileMode(0640)
+	}
+
+	var sum string
+	fr, err := r.fileAction(ctx, "write", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		var err error
+		sum, err = r.write(ctx, client, bytes.NewReader(fo.Content), fo.Path, fo.Mode, fo.UID, fo.GID)
+		return err
+	})
+
+	if err == nil {
+		fr.Checksum = sum
+		fr.Verified = true
+	}
+
+	return fr, err
+}
+
+// RemoveAll implements the RemoveAll method of the Connection interface.
+func (r *SSH) RemoveAll(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellRemoveAll(ctx, r, fo)
+	}
+
+	return r.fileAction(ctx, "remove", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		err := client.RemoveAll(fo.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// ReadDir implements the ReadDir method of the Connection interface.
+func (r *SSH) ReadDir(ctx context.Context, fo FileOpts) (*FileResult, error) {
+	if fo.Become != nil {
+		return shellReadDir(ctx, r, fo)
+	}
+
+	var entries []FileInfo
+	fr, err := r.fileAction(ctx, "read dir", fo, false, func(ctx context.Context, client *sftp.Client) error {
+		stats, err := client.ReadDir(fo.Path)
+		if err != nil {
+			return err
+		}
+
+		// Names are looked up once for each owner and group.
+		names := make(map[[2]int][2]string)
+		for _, stat := range stats {
+			fi, err := r.fileInfo(ctx, client, path.Join(fo.Path, stat.Name()), stat, fo.Checksum)
+			if err != nil {
+				return err
+			}
+
+			ids := [2]int{fi.UID, fi.GID}
+			if _, ok := names[ids]; !ok {
+				owner, group := r.ownerNames(ctx, fi.UID, fi.GID)
+				names[ids] = [2]string{owner, group}
+			}
+			fi.Owner, fi.Group = names[ids][0], names[ids][1]
+
+			entries = append(entries, fi)
+		}
+
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return &FileResult{Success: true}, nil
+	}
+
+	if err == nil {
+		sortEntries(entries)
+		fr.Entries = entries
+		fr.Exists = true
+	}
+
+	return fr, err
+}
+
+// fileAction validates fo and runs f with the SFTP client and the
+// timeout of the action.
+func (r *SSH) fileAction(ctx context.Context, action string, fo FileOpts, needsTarget bool, f func(context.Context, *sftp.Client) error) (*FileResult, error) {
+	if err := validateFileOpts(action, fo, needsTarget); err != nil {
+		return nil, err
+	}
+
+	timeout := SSHCommandTimeout
+	if fo.Timeout > 0 {
+		timeout = fo.Timeout
+	}
+
+	client, err := r.sftpClient(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	return fileAction(ctx, timeout, func(ctx context.Context) error {
+		return f(ctx, client)
+	})
+}
+
+// Close implements the Close method of the Connection interface.
+// It will close an SSH connection and any jump host connections
+// if they are opened.
+func (r *SSH) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.close()
 }
 
 // copyFile is an internal function to manage both Upload and Download.
-func (r SSH) copyFile(cfo CopyFileOpts, action string) (*FileResult, error) {
+// Files of any size are streamed to a temporary file next to the
+// destination, verified against the SHA-256 checksum of the data which
+// was sent and then renamed into place.
+func (r *SSH) copyFile(ctx context.Context, cfo CopyFileOpts, action string) (*FileResult, error) {
 	var fr FileResult
 
 	// validate options
@@ -477,54 +1126,21 @@ func (r SSH) copyFile(cfo CopyFileOpts, action string) (*FileResult, error) {
 		timeout = cfo.Timeout
 	}
 
-	client, err := sftp.NewClient(r.client, sftp.MaxPacket(SCPMaxPacketSize))
+	client, err := r.sftpClient(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
-
-	var remote *sftp.File
-	var local *os.File
-	switch action {
-	case "upload":
-		remote, err = client.OpenFile(cfo.Destination, os.O_RDWR|os.O_CREATE)
-		if err != nil {
-			return nil, err
-		}
-		defer remote.Close()
-
-		local, err = os.Open(cfo.Source)
-		if err != nil {
-			return nil, err
-		}
-		defer local.Close()
-	case "download":
-		local, err = os.OpenFile(cfo.Destination, os.O_RDWR|os.O_CREATE, cfo.Mode)
-		if err != nil {
-			return nil, err
-		}
-		defer local.Close()
 
-		remote, err = client.Open(cfo.Source)
-		if err != nil {
-			return nil, err
-		}
-		defer remote.Close()
-	}
-
-	err = timeoutFunc(timeout, func() error {
+	err = timeoutFunc(ctx, timeout, func(ctx context.Context) error {
+		var err error
 		switch action {
 		case "upload":
-			if _, err := io.Copy(remote, io.LimitReader(local, SCPMaxBytes)); err != nil {
-				return err
-			}
+			fr.Checksum, err = r.upload(ctx, client, cfo)
 		case "download":
-			if _, err := io.Copy(local, io.LimitReader(remote, SCPMaxBytes)); err != nil {
-				return err
-			}
+			fr.Checksum, err = r.download(ctx, client, cfo)
 		}
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -534,6 +1150,7 @@ func (r SSH) copyFile(cfo CopyFileOpts, action string) (*FileResult, error) {
 	}
 
 	if err == nil {
+		fr.Verified = true
 		fr.Success = true
 	}
 
@@ -541,3 +1158,195 @@ func (r SSH) copyFile(cfo CopyFileOpts, action string) (*FileResult, error) {
 
 	return &fr, err
 }
+
+// upload streams a local file to a temporary remote file, verifies it
+// and renames it to the destination. It returns the checksum of the file.
+func (r *SSH) upload(ctx context.Context, client *sftp.Client, cfo CopyFileOpts) (string, error) {
+	local, err := os.Open(cfo.Source)
+	if err != nil {
+		return "", err
+	}
+	defer local.Close()
+
+	return r.write(ctx, client, local, cfo.Destination, cfo.Mode, cfo.UID, cfo.GID)
+}
+
+// write streams src to a temporary remote file, verifies it and renames
+// it to dst. A uid or gid below 0 is left as it is. It returns the
+// checksum of the file.
+func (r *SSH) write(ctx context.Context, client *sftp.Client, src io.Reader, dst string, mode os.FileMode, uid, gid int) (string, error) {
+	tmp := path.Join(path.Dir(dst), tempName(path.Base(dst)))
+	remote, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC)
+	if err != nil {
+		return "", err
+	}
+
+	renamed := false
+	defer func() {
+		remote.Close()
+		if !renamed {
+			client.Remove(tmp)
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(remote, io.TeeReader(contextReader{ctx, src}, h)); err != nil {
+		return "", err
+	}
+
+	if err := remote.Close(); err != nil {
+		return "", err
+	}
+
+	if err := client.Chmod(tmp, mode); err != nil {
+		return "", err
+	}
+
+	if uid >= 0 || gid >= 0 {
+		if err := sftpChown(client, tmp, uid, gid); err != nil {
+			return "", err
+		}
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	actual, err := r.remoteChecksum(ctx, client, tmp)
+	if err != nil {
+		return "", err
+	}
+
+	if actual != sum {
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", dst, sum, actual)
+	}
+
+	if err := sftpRename(client, tmp, dst); err != nil {
+		return "", err
+	}
+	renamed = true
+
+	return sum, nil
+}
+
+// sftpChown sets the owner of a remote file. SFTP can only set both
+// IDs, so one below 0 is filled from the file's current owner.
+func sftpChown(client *sftp.Client, file string, uid, gid int) error {
+	if uid < 0 || gid < 0 {
+		fi, err := client.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		stat := fi.Sys().(*sftp.FileStat)
+		if uid < 0 {
+			uid = int(stat.UID)
+		}
+
+		if gid < 0 {
+			gid = int(stat.GID)
+		}
+	}
+
+	return client.Chown(file, uid, gid)
+}
+
+// sftpRename renames oldpath to newpath, replacing newpath if it exists.
+func sftpRename(client *sftp.Client, oldpath, newpath string) error {
+	// Without the posix-rename extension, SFTP renames fail if the
+	// destination exists.
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldpath, newpath)
+	}
+
+	client.Remove(newpath)
+	return client.Rename(oldpath, newpath)
+}
+
+// download streams a remote file to a temporary local file, verifies it
+// and renames it to the destination. It returns the checksum of the file.
+func (r *SSH) download(ctx context.Context, client *sftp.Client, cfo CopyFileOpts) (string, error) {
+	remote, err := client.Open(cfo.Source)
+	if err != nil {
+		return "", err
+	}
+	defer remote.Close()
+
+	return writeLocalFile(cfo.Destination, contextReader{ctx, remote}, cfo.Mode, nil)
+}
+
+// fileInfo describes the remote file at p from its stat. The names of
+// its owner and group are not set.
+func (r *SSH) fileInfo(ctx context.Context, client *sftp.Client, p string, stat os.FileInfo, withChecksum bool) (FileInfo, error) {
+	var fi FileInfo
+	var err error
+
+	sys := stat.Sys().(*sftp.FileStat)
+	fi.Name = stat.Name()
+	fi.Size = stat.Size()
+	fi.UID = int(sys.UID)
+	fi.GID = int(sys.GID)
+	fi.Mode = fileMode(stat.Mode())
+	fi.Type = fileType(stat.Mode())
+	fi.ModTime = stat.ModTime()
+
+	if fi.Type == "symlink" {
+		fi.LinkTarget, err = client.ReadLink(p)
+		if err != nil {
+			return fi, err
+		}
+	}
+
+	if withChecksum && fi.Type == "file" {
+		fi.Checksum, err = r.remoteChecksum(ctx, client, p)
+		if err != nil {
+			return fi, err
+		}
+	}
+
+	return fi, nil
+}
+
+// ownerNames returns the names of a UID and GID on the host. SFTP
+// only reports IDs, so they are looked up with a command. Names which
+// can't be found are returned empty.
+func (r *SSH) ownerNames(ctx context.Context, uid, gid int) (string, string) {
+	session, err := r.session(ctx)
+	if err != nil {
+		return "", ""
+	}
+	defer session.Close()
+
+	out, err := session.Output(ownerNamesCommand(uid, gid))
+	if err != nil {
+		return "", ""
+	}
+
+	names := strings.SplitN(strings.TrimSpace(string(out)), "|", 2)
+	if len(names) != 2 {
+		return "", ""
+	}
+
+	return names[0], names[1]
+}
+
+// remoteChecksum returns the SHA-256 checksum of a remote file. The
+// checksum is calculated on the remote host with sha256sum if possible
+// so the file does not need to be read back over the connection.
+func (r *SSH) remoteChecksum(ctx context.Context, client *sftp.Client, p string) (string, error) {
+	if session, err := r.session(ctx); err == nil {
+		out, err := session.Output("sha256sum -- " + shellQuote(p))
+		session.Close()
+
+		if err == nil {
+			if fields := strings.Fields(string(out)); len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+				return fields[0], nil
+			}
+		}
+	}
+
+	f, err := client.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return checksum(f)
+}
@@ -0,0 +1,260 @@
+package connections
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	SSHAuthAgent               = "agent"
+	SSHAuthPublicKey           = "publickey"
+	SSHAuthPassword            = "password"
+	SSHAuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// sshAuth represents the credentials used to authenticate to a host.
+type sshAuth struct {
+	// Name prefixes the options named in error messages. It is ""
+	// for the target host and "jump host <host> " for a jump host.
+	Name string
+
+	Agent                      bool
+	PrivateKey                 string
+	PrivateKeyPassphrase       string
+	Certificate                string
+	Password                   string
+	KeyboardInteractiveAnswers map[string]string
+
+	// Methods is the ordered list of auth methods to try.
+	// If empty, every method with credentials is tried in the
+	// order agent, publickey, password, keyboard-interactive.
+	Methods []string
+}
+
+// authMethods builds the list of ssh.AuthMethods to try, in order.
+// The ssh package will try each method the server accepts until
+// authentication succeeds, which also allows servers requiring
+// several methods to be satisfied.
+func (r sshAuth) authMethods() ([]ssh.AuthMethod, error) {
+	// If no private key was specified, try using $user/.ssh/id_rsa.
+	// An encrypted default key is skipped rather than treated as an error.
+	privateKey := r.PrivateKey
+	defaultKey := false
+	if privateKey == "" {
+		if homeDir, err := homedir.Dir(); err == nil {
+			k := filepath.Join(homeDir, ".ssh", "id_rsa")
+			if _, err := os.Stat(k); err == nil {
+				privateKey = k
+				defaultKey = true
+			}
+		}
+	}
+
+	var signer ssh.Signer
+	if privateKey != "" {
+		var err error
+		signer, err = r.parsePrivateKey(privateKey)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			if !defaultKey {
+				return nil, fmt.Errorf("%sprivate_key %s is encrypted: %sprivate_key_passphrase is required",
+					r.Name, privateKey, r.Name)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Certificate != "" {
+		if signer == nil {
+			return nil, fmt.Errorf("%scertificate requires a %sprivate_key", r.Name, r.Name)
+		}
+
+		var err error
+		signer, err = r.certSigner(signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	methods := r.Methods
+	if len(methods) == 0 {
+		methods = []string{
+			SSHAuthAgent, SSHAuthPublicKey, SSHAuthPassword, SSHAuthKeyboardInteractive,
+		}
+	}
+
+	var authMethods []ssh.AuthMethod
+	for _, method := range methods {
+		switch method {
+		case SSHAuthAgent:
+			if !r.Agent {
+				continue
+			}
+
+			if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+				authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+			}
+		case SSHAuthPublicKey:
+			if signer != nil {
+				authMethods = append(authMethods, ssh.PublicKeys(signer))
+			}
+		case SSHAuthPassword:
+			if r.Password != "" {
+				authMethods = append(authMethods, ssh.Password(r.Password))
+			}
+		case SSHAuthKeyboardInteractive:
+			if r.Password != "" || len(r.KeyboardInteractiveAnswers) > 0 {
+				authMethods = append(authMethods, ssh.KeyboardInteractive(r.keyboardInteractive))
+			}
+		default:
+			return nil, fmt.Errorf("unsupported %sauth_methods entry: %s", r.Name, method)
+		}
+	}
+
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("no %sauth methods are available: "+
+			"specify a private_key, password, or enable agent", r.Name)
+	}
+
+	return authMethods, nil
+}
+
+// parsePrivateKey reads a private key file, decrypting it if needed.
+func (r sshAuth) parsePrivateKey(path string) (ssh.Signer, error) {
+	privateKey, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(privateKey); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%sprivate_key %s does not exist", r.Name, privateKey)
+	}
+
+	key, err := ioutil.ReadFile(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return nil, err
+	}
+
+	if r.PrivateKeyPassphrase == "" {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(r.PrivateKeyPassphrase))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %sprivate_key %s: %s", r.Name, privateKey, err)
+	}
+
+	return signer, nil
+}
+
+// certSigner returns a signer which presents the certificate
+// along with the private key.
+func (r sshAuth) certSigner(signer ssh.Signer) (ssh.Signer, error) {
+	certificate, err := homedir.Expand(r.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(certificate); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%scertificate %s does not exist", r.Name, certificate)
+	}
+
+	b, err := ioutil.ReadFile(certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %scertificate %s: %s", r.Name, certificate, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%scertificate %s is not an SSH certificate", r.Name, certificate)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use %scertificate %s: %s", r.Name, certificate, err)
+	}
+
+	return certSigner, nil
+}
+
+// keyboardInteractive answers keyboard-interactive challenges.
+// A prompt containing a key of KeyboardInteractiveAnswers is given
+// that answer. Any other prompt which does not echo is given the
+// password.
+func (r sshAuth) keyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+
+	for i, question := range questions {
+		if answer, ok := r.keyboardInteractiveAnswer(question); ok {
+			answers[i] = answer
+			continue
+		}
+
+		if !echos[i] && r.Password != "" {
+			answers[i] = r.Password
+			continue
+		}
+
+		return nil, fmt.Errorf("no answer for keyboard-interactive prompt %q", question)
+	}
+
+	return answers, nil
+}
+
+// keyboardInteractiveAnswer returns the answer for a prompt. A key
+// which is the whole prompt, apart from case and a trailing colon,
+// is preferred. Otherwise the longest key the prompt contains is
+// used, so the answer doesn't depend on the order of the map.
+func (r sshAuth) keyboardInteractiveAnswer(question string) (string, bool) {
+	question = strings.ToLower(question)
+	bare := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(question), ":"))
+
+	var match string
+	var matchExact, found bool
+	for prompt := range r.KeyboardInteractiveAnswers {
+		p := strings.ToLower(prompt)
+		exact := p == bare
+		if !exact && !strings.Contains(question, p) {
+			continue
+		}
+
+		// Keys which match equally well are compared so the
+		// same one always wins.
+		better := !found ||
+			(exact && !matchExact) ||
+			(exact == matchExact && (len(prompt) > len(match) || (len(prompt) == len(match) && prompt < match)))
+
+		if better {
+			match, matchExact, found = prompt, exact, true
+		}
+	}
+
+	if !found {
+		return "", false
+	}
+
+	return r.KeyboardInteractiveAnswers[match], true
+}
@@ -0,0 +1,175 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	SSHDefaultConfigFile = "~/.ssh/config"
+)
+
+// sshConfigHost represents the settings of a host in an ssh_config file.
+type sshConfigHost struct {
+	HostName        string
+	User            string
+	Port            int
+	IdentityFile    string
+	CertificateFile string
+	ProxyJump       []string
+}
+
+// readSSHConfig parses an ssh_config file. A missing file is not
+// an error and returns a nil config.
+func readSSHConfig(path string) (*ssh_config.Config, error) {
+	p, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	config, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", p, err)
+	}
+
+	return config, nil
+}
+
+// lookupSSHConfigHost returns the settings for a host alias.
+func lookupSSHConfigHost(config *ssh_config.Config, alias string) (host sshConfigHost, err error) {
+	if config == nil {
+		return
+	}
+
+	// The ssh_config package panics on directives it doesn't support,
+	// such as Match.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to read ssh config for %s: %v", alias, r)
+		}
+	}()
+
+	get := func(key string) (string, error) {
+		v, err := config.Get(alias, key)
+		return strings.TrimSpace(v), err
+	}
+
+	if host.HostName, err = get("HostName"); err != nil {
+		return
+	}
+	host.HostName = strings.Replace(host.HostName, "%h", alias, -1)
+
+	if host.User, err = get("User"); err != nil {
+		return
+	}
+
+	var port string
+	if port, err = get("Port"); err != nil {
+		return
+	}
+
+	if port != "" {
+		if host.Port, err = strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("invalid Port for %s in ssh config: %s", alias, port)
+			return
+		}
+	}
+
+	var identityFile string
+	if identityFile, err = get("IdentityFile"); err != nil {
+		return
+	}
+
+	if identityFile != "" {
+		if host.IdentityFile, err = homedir.Expand(identityFile); err != nil {
+			return
+		}
+	}
+
+	var certificateFile string
+	if certificateFile, err = get("CertificateFile"); err != nil {
+		return
+	}
+
+	if certificateFile != "" {
+		if host.CertificateFile, err = homedir.Expand(certificateFile); err != nil {
+			return
+		}
+	}
+
+	var proxyJump string
+	if proxyJump, err = get("ProxyJump"); err != nil {
+		return
+	}
+
+	if proxyJump != "" && proxyJump != "none" {
+		for _, hop := range strings.Split(proxyJump, ",") {
+			host.ProxyJump = append(host.ProxyJump, strings.TrimSpace(hop))
+		}
+	}
+
+	return
+}
+
+// parseJumpHost parses a jump host in the [user@]host[:port] format
+// and resolves the host against an ssh_config file.
+func parseJumpHost(config *ssh_config.Config, spec string) (*SSHJumpHost, error) {
+	var jh SSHJumpHost
+
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		jh.User = spec[:i]
+		spec = spec[i+1:]
+	}
+
+	jh.Host = spec
+	if strings.HasPrefix(spec, "[") || strings.Count(spec, ":") == 1 {
+		if host, port, err := net.SplitHostPort(spec); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in jump host %s", spec)
+			}
+
+			jh.Host = host
+			jh.Port = p
+		}
+	}
+	jh.Host = strings.Trim(jh.Host, "[]")
+
+	configHost, err := lookupSSHConfigHost(config, jh.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if configHost.HostName != "" {
+		jh.Host = configHost.HostName
+	}
+
+	if jh.User == "" {
+		jh.User = configHost.User
+	}
+
+	if jh.Port == 0 {
+		jh.Port = configHost.Port
+	}
+
+	jh.PrivateKey = configHost.IdentityFile
+	jh.Certificate = configHost.CertificateFile
+
+	return &jh, nil
+}
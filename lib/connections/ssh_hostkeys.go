@@ -0,0 +1,147 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	SSHHostKeyCheckingStrict    = "strict"
+	SSHHostKeyCheckingAcceptNew = "accept-new"
+	SSHHostKeyCheckingOff       = "off"
+
+	SSHDefaultHostKeyChecking = SSHHostKeyCheckingAcceptNew
+	SSHDefaultKnownHostsFile  = "~/.ssh/known_hosts"
+)
+
+// knownHostsMux serializes access to known_hosts files since
+// several targets are usually connected to in parallel.
+var knownHostsMux sync.Mutex
+
+// HostKeyError represents a host key which could not be verified.
+type HostKeyError struct {
+	Host string
+	Err  error
+}
+
+func (r *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s: %s", r.Host, r.Err)
+}
+
+// Permanent implements the permanentError interface. There is no
+// point in retrying a connection to a host with a bad host key.
+func (r *HostKeyError) Permanent() bool {
+	return true
+}
+
+// newHostKeyCallback returns an ssh.HostKeyCallback for the given
+// host key checking mode. If hostKey is set, the remote key must
+// match that fingerprint and the known_hosts file is not consulted.
+func newHostKeyCallback(mode, knownHostsFile, hostKey string) (ssh.HostKeyCallback, error) {
+	if hostKey != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !hostKeyFingerprintMatches(hostKey, key) {
+				return &HostKeyError{
+					Host: hostname,
+					Err: fmt.Errorf("fingerprint %s does not match host_key %s",
+						ssh.FingerprintSHA256(key), hostKey),
+				}
+			}
+
+			return nil
+		}, nil
+	}
+
+	switch mode {
+	case SSHHostKeyCheckingOff:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case SSHHostKeyCheckingStrict, SSHHostKeyCheckingAcceptNew:
+	default:
+		return nil, fmt.Errorf("invalid host_key_checking %q: must be one of %s, %s, or %s",
+			mode, SSHHostKeyCheckingStrict, SSHHostKeyCheckingAcceptNew, SSHHostKeyCheckingOff)
+	}
+
+	path, err := homedir.Expand(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMux.Lock()
+		defer knownHostsMux.Unlock()
+
+		// The file is read on every verification so keys which were
+		// accepted by other connections are seen.
+		callback, err := readKnownHosts(path)
+		if err != nil {
+			return &HostKeyError{Host: hostname, Err: err}
+		}
+
+		err = callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			if mode == SSHHostKeyCheckingAcceptNew {
+				return appendKnownHost(path, hostname, key)
+			}
+
+			err = fmt.Errorf("host is not in %s", path)
+		}
+
+		return &HostKeyError{Host: hostname, Err: err}
+	}, nil
+}
+
+// readKnownHosts returns a known_hosts callback for path. A missing
+// file is treated as an empty one.
+func readKnownHosts(path string) (ssh.HostKeyCallback, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return knownhosts.New()
+	}
+
+	return knownhosts.New(path)
+}
+
+// appendKnownHost adds a host key to a known_hosts file.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// hostKeyFingerprintMatches compares a key to a fingerprint in
+// either the SHA256:... or the legacy MD5 aa:bb:... format.
+func hostKeyFingerprintMatches(fingerprint string, key ssh.PublicKey) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return fingerprint == ssh.FingerprintSHA256(key)
+	}
+
+	fingerprint = strings.TrimPrefix(fingerprint, "MD5:")
+	return strings.EqualFold(fingerprint, ssh.FingerprintLegacyMD5(key))
+}
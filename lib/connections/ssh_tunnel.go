@@ -0,0 +1,85 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnel implements the Tunneler interface. A forward tunnel listens
+// locally and forwards each connection to the remote address through
+// the SSH connection. A reverse tunnel has the host listen on the
+// remote address and forwards each connection to the local address.
+func (r *SSH) Tunnel(ctx context.Context, to TunnelOpts) (*Tunnel, error) {
+	if to.Remote == "" {
+		return nil, fmt.Errorf("a remote address is required for a tunnel")
+	}
+
+	if to.Reverse {
+		return r.reverseTunnel(ctx, to)
+	}
+
+	local := to.Local
+	if local == "" {
+		local = TunnelDefaultLocal
+	}
+
+	if _, err := r.sshClient(ctx); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %s", local, err)
+	}
+
+	dial := func() (net.Conn, error) {
+		client, err := r.sshClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Dial("tcp", to.Remote)
+	}
+
+	return newTunnel(ctx, listener, dial, listener.Addr().String(), to.Remote), nil
+}
+
+// reverseTunnel opens a tunnel from the host to the local host.
+func (r *SSH) reverseTunnel(ctx context.Context, to TunnelOpts) (*Tunnel, error) {
+	if to.Local == "" {
+		return nil, fmt.Errorf("a local address is required for a reverse tunnel")
+	}
+
+	client, err := r.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := client.Listen("tcp", to.Remote)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %s", to.Remote, err)
+	}
+
+	dial := func() (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", to.Local)
+	}
+
+	return newTunnel(ctx, listener, dial, to.Local, listener.Addr().String()), nil
+}
+
+// sshClient returns the SSH client of the connection, connecting
+// first if needed.
+func (r *SSH) sshClient(ctx context.Context) (*ssh.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.client, nil
+}
@@ -0,0 +1,358 @@
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withFakeSudo puts a fake sudo which expects the password
+// "bagel" first in the PATH.
+func withFakeSudo(t *testing.T) func() {
+	dir, err := filepath.Abs("fixtures/become")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+
+	return func() {
+		os.Setenv("PATH", path)
+	}
+}
+
+func TestBecome_SudoPassword(t *testing.T) {
+	defer withFakeSudo(t)()
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro := connections.RunOpts{
+		Command: "echo foo; echo bar >&2",
+		Become: &connections.Become{
+			Password: "bagel",
+		},
+	}
+
+	rr, err := local.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "foo", rr.Stdout)
+	assert.Equal(t, "bar", rr.Stderr)
+	assert.Equal(t, 0, rr.ExitCode)
+
+	ro.Become.Password = "wrong"
+	rr, err = local.RunCommand(context.Background(), ro)
+	assert.Contains(t, err.Error(), "unable to become root: Sorry, try again.")
+	assert.Equal(t, 1, rr.ExitCode)
+}
+
+func TestBecome_Su(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("su without a password must be run as root")
+	}
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro := connections.RunOpts{
+		Command: "id -un",
+		Become: &connections.Become{
+			Method: "su",
+			User:   "nobody",
+		},
+	}
+
+	rr, err := local.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "nobody", rr.Stdout)
+
+	ro.Become.Password = "secret"
+	_, err = local.RunCommand(context.Background(), ro)
+	assert.Contains(t, err.Error(), "needs a terminal")
+}
+
+func TestBecome_Files(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("su without a password must be run as root")
+	}
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	become := &connections.Become{
+		Method: "su",
+	}
+
+	remote := filepath.Join(dir, "remote.txt")
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		UID:         65534,
+		GID:         65534,
+		Mode:        0600,
+		Become:      become,
+	}
+
+	fr, err := local.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+
+	fo := connections.FileOpts{
+		Path:     remote,
+		Become:   become,
+		Checksum: true,
+	}
+
+	fr, err = local.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "remote.txt", fr.FileInfo.Name)
+	assert.Equal(t, "file", fr.FileInfo.Type)
+	assert.Equal(t, 65534, fr.FileInfo.UID)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+	assert.Equal(t, int64(14), fr.FileInfo.Size)
+	assert.Equal(t, "c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31", fr.FileInfo.Checksum)
+	assert.False(t, fr.FileInfo.ModTime.IsZero())
+
+	local2 := filepath.Join(dir, "local.txt")
+	cfo = connections.CopyFileOpts{
+		Source:      remote,
+		Destination: local2,
+		Become:      become,
+	}
+
+	fr, err = local.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(local2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	fr, err = local.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fr, err = local.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, false, fr.Exists)
+
+	// Only the downloaded file should remain.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(files))
+}
+
+func TestBecome_ReadDir(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("su without a password must be run as root")
+	}
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, ".hidden"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("missing", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fo := connections.FileOpts{
+		Path:     dir,
+		Become:   &connections.Become{Method: "su"},
+		Checksum: true,
+	}
+
+	// The last entry has empty lines which must survive trimming.
+	fr, err := local.ReadDir(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, 2, len(fr.Entries))
+	assert.Equal(t, ".hidden", fr.Entries[0].Name)
+	assert.Equal(t, "directory", fr.Entries[0].Type)
+	assert.Equal(t, 700, fr.Entries[0].Mode)
+	assert.Equal(t, "link", fr.Entries[1].Name)
+	assert.Equal(t, "missing", fr.Entries[1].LinkTarget)
+
+	fo.Path = filepath.Join(dir, "missing")
+	fr, err = local.ReadDir(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+}
+
+func TestBecome_FilesAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("su without a password must be run as root")
+	}
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only nobody can write to the private directory.
+	if err := os.Chmod(dir, 0711); err != nil {
+		t.Fatal(err)
+	}
+
+	private := filepath.Join(dir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chown(private, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+
+	become := &connections.Become{
+		Method: "su",
+		User:   "nobody",
+	}
+
+	remote := filepath.Join(private, "remote.txt")
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		UID:         -1,
+		GID:         -1,
+		Mode:        0600,
+		Become:      become,
+	}
+
+	fr, err := local.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, "c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31", fr.Checksum)
+
+	fo := connections.FileOpts{
+		Path:   remote,
+		Become: become,
+	}
+
+	fr, err = local.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, 65534, fr.FileInfo.UID)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+
+	local2 := filepath.Join(dir, "local.txt")
+	cfo = connections.CopyFileOpts{
+		Source:      remote,
+		Destination: local2,
+		Become:      become,
+	}
+
+	fr, err = local.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(local2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, "c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31", fr.Checksum)
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	// A file the become user can't read isn't downloaded.
+	cfo.Source = filepath.Join(private, "missing.txt")
+	_, err = local.FileDownload(context.Background(), cfo)
+	assert.Error(t, err)
+
+	fr, err = local.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	// Only the downloaded file should remain.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(files))
+	// Deleting a missing file is an error, as without become.
+	_, err = local.FileDelete(context.Background(), fo)
+	assert.Error(t, err)
+}
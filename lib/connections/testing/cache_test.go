@@ -0,0 +1,92 @@
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/testing/sshserver"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_Get(t *testing.T) {
+	cache := connections.NewCache()
+	defer cache.Close()
+
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	ctx := context.Background()
+
+	c1, err := cache.Get(ctx, "local/a", "local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := cache.Get(ctx, "local/a", "local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c3, err := cache.Get(ctx, "local/b", "local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, c1 == c2)
+	assert.True(t, c1 != c3)
+}
+
+func TestCache_ConnectError(t *testing.T) {
+	cache := connections.NewCache()
+	defer cache.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := map[string]interface{}{
+		"root": filepath.Join(dir, "root"),
+	}
+
+	ctx := context.Background()
+
+	_, err1 := cache.Get(ctx, "chroot/a", "chroot", options)
+	assert.Error(t, err1)
+
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The error is cached, so the target isn't connected to again.
+	_, err2 := cache.Get(ctx, "chroot/a", "chroot", options)
+	assert.Equal(t, err1, err2)
+
+	_, err = cache.Get(ctx, "chroot/b", "chroot", options)
+	assert.NoError(t, err)
+}
+
+func TestCache_Interrupted(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	cache := connections.NewCache()
+	defer cache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cache.Get(ctx, "ssh/a", "ssh", server.Options())
+	assert.Error(t, err)
+
+	// An interrupted connection is tried again.
+	_, err = cache.Get(context.Background(), "ssh/a", "ssh", server.Options())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,261 @@
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newChrootConnection(t *testing.T) (connections.Connection, string) {
+	root, err := ioutil.TempDir("", "bagel-chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	options := map[string]interface{}{
+		"host": root,
+	}
+
+	chroot, err := connections.New("chroot", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chroot.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return chroot, root
+}
+
+func TestChroot_NoSuchRoot(t *testing.T) {
+	options := map[string]interface{}{
+		"root": "/does/not/exist",
+	}
+
+	chroot, err := connections.New("chroot", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chroot.Connect(context.Background())
+	assert.Contains(t, err.Error(), "unable to use root /does/not/exist")
+
+	options["method"] = "jail"
+	_, err = connections.New("chroot", options)
+	assert.Equal(t, "unsupported chroot method: jail", err.Error())
+}
+
+func TestChroot_CopyFileDelete(t *testing.T) {
+	chroot, root := newChrootConnection(t)
+	defer os.RemoveAll(root)
+	defer chroot.Close()
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: "/etc/hello.txt",
+		UID:         os.Getuid(),
+		GID:         os.Getgid(),
+		Mode:        0600,
+	}
+
+	fr, err := chroot.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	actual, err := ioutil.ReadFile(filepath.Join(root, "etc", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	fo := connections.FileOpts{
+		Path: "/etc/hello.txt",
+	}
+
+	fr, err = chroot.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "hello.txt", fr.FileInfo.Name)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+
+	fr, err = chroot.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fr, err = chroot.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+}
+
+func TestChroot_Symlinks(t *testing.T) {
+	chroot, root := newChrootConnection(t)
+	defer os.RemoveAll(root)
+	defer chroot.Close()
+
+	outside, err := ioutil.TempDir("", "bagel-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	// An absolute link resolves inside the root, not on the host.
+	link := filepath.Join(root, "etc", "link.txt")
+	if err := os.Symlink(filepath.Join(outside, "target.txt"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: "/etc/link.txt",
+		UID:         os.Getuid(),
+		GID:         os.Getgid(),
+		Mode:        0644,
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, outside), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := chroot.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	_, err = os.Stat(filepath.Join(outside, "target.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	actual, err := ioutil.ReadFile(filepath.Join(root, outside, "target.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	// A relative link can't climb above the root.
+	if err := os.Symlink("../../../../../../etc", filepath.Join(root, "etc", "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = chroot.FileInfo(context.Background(), connections.FileOpts{Path: "/etc/up/hostname"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+
+	// The link itself is described.
+	fr, err = chroot.FileInfo(context.Background(), connections.FileOpts{Path: "/etc/up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "symlink", fr.FileInfo.Type)
+	assert.Equal(t, "../../../../../../etc", fr.FileInfo.LinkTarget)
+
+	// Deleting a link removes the link itself.
+	fr, err = chroot.FileDelete(context.Background(), connections.FileOpts{Path: "/etc/link.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	_, err = os.Lstat(link)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(root, outside, "target.txt"))
+	assert.Nil(t, err)
+}
+
+func TestChroot_FileOps(t *testing.T) {
+	chroot, root := newChrootConnection(t)
+	defer os.RemoveAll(root)
+	defer chroot.Close()
+
+	ctx := context.Background()
+
+	fr, err := chroot.MkdirAll(ctx, connections.FileOpts{Path: "/etc/app/conf.d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fo := connections.FileOpts{
+		Path:    "/etc/app/conf.d/app.conf",
+		Content: []byte("Hello, World!\n"),
+		UID:     os.Getuid(),
+		GID:     os.Getgid(),
+	}
+
+	if _, err := chroot.WriteFile(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(filepath.Join(root, "etc", "app", "conf.d", "app.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	// An absolute link target is resolved inside the root.
+	fr, err = chroot.Symlink(ctx, connections.FileOpts{Path: "/etc/app.conf", Target: "/etc/app/conf.d/app.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = chroot.ReadFile(ctx, connections.FileOpts{Path: "/etc/app.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(fr.Content))
+
+	fr, err = chroot.Rename(ctx, connections.FileOpts{Path: "/etc/app.conf", Target: "/etc/app-link.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "etc", "app-link.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "/etc/app/conf.d/app.conf", target)
+
+	fr, err = chroot.RemoveAll(ctx, connections.FileOpts{Path: "/etc/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(root, "etc", "app"))
+	assert.True(t, os.IsNotExist(err))
+}
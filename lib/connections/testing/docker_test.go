@@ -0,0 +1,394 @@
+package testing
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDocker is a stand-in for the parts of the Docker Engine API
+// which the docker driver uses. Commands are run on the local host
+// and archive paths refer to the local filesystem.
+type fakeDocker struct {
+	mu    sync.Mutex
+	execs map[string][]string
+	codes map[string]int
+}
+
+func newFakeDocker(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bagel-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd := &fakeDocker{
+		execs: make(map[string][]string),
+		codes: make(map[string]int),
+	}
+
+	srv := &http.Server{Handler: fd}
+	go srv.Serve(l)
+
+	return "unix://" + socket, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (r *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, req)
+		return
+	}
+
+	if parts[0] == "containers" && parts[1] != "bagel" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message": "No such container: %s"}`, parts[1])
+		return
+	}
+
+	switch fmt.Sprintf("%s %s %s", req.Method, parts[0], parts[2]) {
+	case "GET containers json":
+		fmt.Fprint(w, `{"State": {"Running": true}}`)
+	case "POST containers exec":
+		var body struct{ Cmd []string }
+		json.NewDecoder(req.Body).Decode(&body)
+
+		r.mu.Lock()
+		id := fmt.Sprintf("exec%d", len(r.execs))
+		r.execs[id] = body.Cmd
+		r.mu.Unlock()
+
+		fmt.Fprintf(w, `{"Id": "%s"}`, id)
+	case "POST exec start":
+		r.mu.Lock()
+		cmdArgs := r.execs[parts[1]]
+		r.mu.Unlock()
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		var code int
+		if err := cmd.Run(); err != nil {
+			code = int(err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus())
+		}
+
+		r.mu.Lock()
+		r.codes[parts[1]] = code
+		r.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 1, stdout.Bytes())
+		writeFrame(w, 2, stderr.Bytes())
+	case "GET exec json":
+		r.mu.Lock()
+		code := r.codes[parts[1]]
+		r.mu.Unlock()
+
+		fmt.Fprintf(w, `{"ExitCode": %d}`, code)
+	case "PUT containers archive":
+		dir := req.URL.Query().Get("path")
+		tr := tar.NewReader(req.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+
+			f, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			io.Copy(f, tr)
+			f.Close()
+		}
+	case "GET containers archive":
+		p := req.URL.Query().Get("path")
+		stat, err := os.Lstat(p)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"message": "%s"}`, err)
+			return
+		}
+
+		hdr, _ := tar.FileInfoHeader(stat, "")
+		hdr.Uid = int(stat.Sys().(*syscall.Stat_t).Uid)
+		hdr.Gid = int(stat.Sys().(*syscall.Stat_t).Gid)
+
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(hdr)
+		if stat.Mode().IsRegular() {
+			f, _ := os.Open(p)
+			io.Copy(tw, f)
+			f.Close()
+		}
+		tw.Close()
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeFrame(w io.Writer, stream byte, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	hdr := make([]byte, 8)
+	hdr[0] = stream
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(b)))
+	w.Write(hdr)
+	w.Write(b)
+}
+
+func newDockerConnection(t *testing.T, socket, container string) connections.Connection {
+	options := map[string]interface{}{
+		"host":   container,
+		"socket": socket,
+		"shell":  "/bin/bash",
+	}
+
+	docker, err := connections.New("docker", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return docker
+}
+
+func TestDocker_Basic(t *testing.T) {
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	docker := newDockerConnection(t, socket, "bagel")
+	if err := docker.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	ro := connections.RunOpts{
+		Command: "echo hi",
+	}
+
+	rr, err := docker.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+	assert.Equal(t, 0, rr.ExitCode)
+
+	ro.Command = "foo=bar; echo foobar >&2; echo $foo; exit 3"
+	rr, err = docker.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "bar", rr.Stdout)
+	assert.Equal(t, "foobar", rr.Stderr)
+	assert.Equal(t, 3, rr.ExitCode)
+}
+
+func TestDocker_NoSuchContainer(t *testing.T) {
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	docker := newDockerConnection(t, socket, "missing")
+	err := docker.Connect(context.Background())
+	assert.Equal(t, "unable to inspect container missing: No such container: missing", err.Error())
+}
+
+func TestDocker_CopyFileDelete(t *testing.T) {
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	docker := newDockerConnection(t, socket, "bagel")
+	if err := docker.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote.txt")
+	local := filepath.Join(dir, "local.txt")
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		Mode:        0600,
+	}
+
+	fr, err := docker.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fo := connections.FileOpts{
+		Path: remote,
+	}
+
+	fr, err = docker.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "file", fr.FileInfo.Type)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+	assert.Equal(t, int64(14), fr.FileInfo.Size)
+
+	cfo = connections.CopyFileOpts{
+		Source:      remote,
+		Destination: local,
+	}
+
+	fr, err = docker.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, "c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31", fr.Checksum)
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	fr, err = docker.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fr, err = docker.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+}
+
+func TestDocker_BecomeFiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("su without a password must be run as root")
+	}
+
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	docker := newDockerConnection(t, socket, "bagel")
+	if err := docker.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	become := &connections.Become{
+		Method: "su",
+		User:   "root",
+	}
+
+	remote := filepath.Join(dir, "remote.txt")
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		UID:         65534,
+		GID:         -1,
+		Mode:        0600,
+		Become:      become,
+	}
+
+	fr, err := docker.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fo := connections.FileOpts{
+		Path:   remote,
+		Become: become,
+	}
+
+	fr, err = docker.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner is set by the become user rather than the archive.
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, 65534, fr.FileInfo.UID)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+
+	cfo = connections.CopyFileOpts{
+		Source:      remote,
+		Destination: filepath.Join(dir, "local.txt"),
+		Become:      become,
+	}
+
+	fr, err = docker.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(cfo.Destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	fr, err = docker.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	_, err = os.Stat(remote)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,9 +1,19 @@
 package testing
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/jtopjian/bagel/lib/connections"
 
@@ -24,7 +34,7 @@ func TestLocal_Basic(t *testing.T) {
 		Command: "echo hi",
 	}
 
-	rr, err := local.RunCommand(ro)
+	rr, err := local.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,7 +42,7 @@ func TestLocal_Basic(t *testing.T) {
 	assert.Equal(t, "hi", rr.Stdout)
 
 	ro.Command = "asdf"
-	rr, err = local.RunCommand(ro)
+	rr, err = local.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,7 +50,7 @@ func TestLocal_Basic(t *testing.T) {
 	assert.Equal(t, "/bin/bash: asdf: command not found", rr.Stderr)
 
 	ro.Command = "foo=bar; sleep 1; echo foobar >&2; echo $foo ; echo 123 >&2"
-	rr, err = local.RunCommand(ro)
+	rr, err = local.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,6 +59,98 @@ func TestLocal_Basic(t *testing.T) {
 	assert.Equal(t, "foobar\n123", rr.Stderr)
 }
 
+func TestLocal_Log(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var log io.Writer = &buf
+
+	ro := connections.RunOpts{
+		Command: "echo foo; sleep 1; echo bar >&2",
+		Log:     &log,
+	}
+
+	rr, err := local.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "foo", rr.Stdout)
+	assert.Equal(t, "bar", rr.Stderr)
+	assert.Equal(t, "stdout: foo\nstderr: bar\n", buf.String())
+}
+
+func TestLocal_Stdout(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	ro := connections.RunOpts{
+		Command: "echo foo; echo bar >&2",
+		Stdout:  &buf,
+	}
+
+	rr, err := local.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "", rr.Stdout)
+	assert.Equal(t, "bar", rr.Stderr)
+	assert.Equal(t, "foo\n", buf.String())
+}
+
+func TestLocal_StdinEnvDir(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ro := connections.RunOpts{
+		Command: `cat; echo "$FOO"; pwd`,
+		Stdin:   strings.NewReader("in \"put\"\n"),
+		Env: map[string]string{
+			"FOO": `it's "quoted" $HOME`,
+		},
+		Dir: dir,
+	}
+
+	rr, err := local.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "in \"put\"\nit's \"quoted\" $HOME\n" + dir
+	assert.Equal(t, expected, rr.Stdout)
+
+	ro.Env = map[string]string{"FOO BAR": "baz"}
+	_, err = local.RunCommand(context.Background(), ro)
+	assert.Error(t, err)
+}
+
 func TestLocal_CommandTimeout(t *testing.T) {
 	options := map[string]interface{}{
 		"shell": "/bin/bash",
@@ -64,10 +166,46 @@ func TestLocal_CommandTimeout(t *testing.T) {
 		Timeout: 5,
 	}
 
-	_, err = local.RunCommand(ro)
+	_, err = local.RunCommand(context.Background(), ro)
 	assert.Equal(t, err.Error(), "timeout")
 }
 
+func TestLocal_CommandInterrupted(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The background child would write the file if it was not killed
+	// along with the shell.
+	marker := filepath.Join(dir, "marker")
+	ro := connections.RunOpts{
+		Command: "(sleep 2; touch " + marker + ") & sleep 30",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = local.RunCommand(ctx, ro)
+	assert.Equal(t, "interrupted", err.Error())
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	time.Sleep(3 * time.Second)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestLocal_CopyFile(t *testing.T) {
 	options := map[string]interface{}{
 		"shell": "/bin/bash",
@@ -89,7 +227,7 @@ func TestLocal_CopyFile(t *testing.T) {
 		Destination: tmpfile.Name(),
 	}
 
-	fr, err := local.FileUpload(cfo)
+	fr, err := local.FileUpload(context.Background(), cfo)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -103,6 +241,71 @@ func TestLocal_CopyFile(t *testing.T) {
 	assert.Equal(t, "Hello, World!\n", string(actual))
 }
 
+func TestLocal_CopyLargeFile(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	destination := filepath.Join(dir, "destination")
+
+	expected := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	if err := ioutil.WriteFile(source, expected, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale data past the end of the new contents must not remain.
+	stale := append(expected, []byte("stale")...)
+	if err := ioutil.WriteFile(destination, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfo := connections.CopyFileOpts{
+		Source:      source,
+		Destination: destination,
+		UID:         os.Getuid(),
+		GID:         os.Getgid(),
+		Mode:        0600,
+	}
+
+	fr, err := local.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(expected)
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Checksum)
+	assert.Equal(t, len(expected), len(actual))
+	assert.Equal(t, expected, actual)
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(files))
+}
+
 func TestLocal_FileDelete(t *testing.T) {
 	options := map[string]interface{}{
 		"shell": "/bin/bash",
@@ -123,7 +326,7 @@ func TestLocal_FileDelete(t *testing.T) {
 		Destination: tmpfile.Name(),
 	}
 
-	fr, err := local.FileUpload(cfo)
+	fr, err := local.FileUpload(context.Background(), cfo)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,7 +343,7 @@ func TestLocal_FileDelete(t *testing.T) {
 		Path: tmpfile.Name(),
 	}
 
-	fr, err = local.FileDelete(fo)
+	fr, err = local.FileDelete(context.Background(), fo)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,7 +367,7 @@ func TestLocal_FileInfo(t *testing.T) {
 		Path: "fixtures/hello.txt",
 	}
 
-	fr, err := local.FileInfo(fo)
+	fr, err := local.FileInfo(context.Background(), fo)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,3 +376,236 @@ func TestLocal_FileInfo(t *testing.T) {
 	assert.Equal(t, 644, fr.FileInfo.Mode)
 	assert.Equal(t, int64(14), fr.FileInfo.Size)
 }
+
+func TestLocal_FileInfoDetails(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("Hello, World!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := local.FileInfo(context.Background(), connections.FileOpts{Path: file, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("Hello, World!\n"))
+	assert.Equal(t, "file", fr.FileInfo.Type)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.FileInfo.Checksum)
+	assert.Equal(t, mtime.Unix(), fr.FileInfo.ModTime.Unix())
+	assert.Equal(t, u.Username, fr.FileInfo.Owner)
+
+	fr, err = local.FileInfo(context.Background(), connections.FileOpts{Path: link, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "symlink", fr.FileInfo.Type)
+	assert.Equal(t, "file", fr.FileInfo.LinkTarget)
+	assert.Equal(t, "", fr.FileInfo.Checksum)
+
+	fr, err = local.FileInfo(context.Background(), connections.FileOpts{Path: fifo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "fifo", fr.FileInfo.Type)
+}
+
+func TestLocal_FileOps(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	sub := filepath.Join(dir, "a", "b")
+
+	fr, err := local.MkdirAll(ctx, connections.FileOpts{Path: sub, Mode: 0700})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	stat, err := os.Stat(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, stat.IsDir())
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	file := filepath.Join(sub, "file")
+	fo := connections.FileOpts{
+		Path:    file,
+		Content: []byte("Hello, World!\n"),
+		UID:     os.Getuid(),
+		GID:     os.Getgid(),
+		Mode:    0600,
+	}
+
+	fr, err = local.WriteFile(ctx, fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("Hello, World!\n"))
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Checksum)
+
+	fr, err = local.Chmod(ctx, connections.FileOpts{Path: file, Mode: 0640})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err = os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+
+	fr, err = local.Chown(ctx, connections.FileOpts{Path: file, UID: os.Getuid(), GID: os.Getgid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	renamed := filepath.Join(sub, "renamed")
+	fr, err = local.Rename(ctx, connections.FileOpts{Path: file, Target: renamed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	link := filepath.Join(dir, "link")
+	fr, err = local.Symlink(ctx, connections.FileOpts{Path: link, Target: "a/b/renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = local.Symlink(ctx, connections.FileOpts{Path: link, Target: "a/b/renamed"})
+	assert.NotNil(t, err)
+
+	fr, err = local.ReadFile(ctx, connections.FileOpts{Path: link})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(fr.Content))
+
+	_, err = local.Rename(ctx, connections.FileOpts{Path: renamed})
+	assert.Equal(t, "target is required for rename", err.Error())
+
+	fr, err = local.RemoveAll(ctx, connections.FileOpts{Path: filepath.Join(dir, "a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Lstat(link)
+	assert.Nil(t, err)
+}
+
+func TestLocal_ReadDir(t *testing.T) {
+	options := map[string]interface{}{
+		"shell": "/bin/bash",
+	}
+
+	local, err := connections.New("local", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("Hello, World!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, ".hidden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := local.ReadDir(context.Background(), connections.FileOpts{Path: dir, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("Hello, World!\n"))
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, 3, len(fr.Entries))
+	assert.Equal(t, ".hidden", fr.Entries[0].Name)
+	assert.Equal(t, "directory", fr.Entries[0].Type)
+	assert.Equal(t, "file", fr.Entries[1].Name)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Entries[1].Checksum)
+	assert.Equal(t, "link", fr.Entries[2].Name)
+	assert.Equal(t, "file", fr.Entries[2].LinkTarget)
+
+	fr, err = local.ReadDir(context.Background(), connections.FileOpts{Path: filepath.Join(dir, "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+}
@@ -0,0 +1,472 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jtopjian/bagel/lib/connections"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLXD is a stand-in for the parts of the LXD REST API which the
+// lxd driver uses. Commands are run on the local host and file paths
+// refer to the local filesystem.
+type fakeLXD struct {
+	mu       sync.Mutex
+	ops      map[string]*fakeLXDOperation
+	upgrader websocket.Upgrader
+}
+
+type fakeLXDOperation struct {
+	cmd      []string
+	secrets  map[string]string
+	conns    map[string]*websocket.Conn
+	exitCode int
+	done     chan struct{}
+}
+
+func newFakeLXD(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bagel-lxd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "unix.socket")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fl := &fakeLXD{
+		ops: make(map[string]*fakeLXDOperation),
+	}
+
+	srv := &http.Server{Handler: fl}
+	go srv.Serve(l)
+
+	return socket, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func lxdSync(w http.ResponseWriter, metadata interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "sync",
+		"status_code": 200,
+		"metadata":    metadata,
+	})
+}
+
+func lxdError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":       "error",
+		"error_code": code,
+		"error":      msg,
+	})
+}
+
+func (r *fakeLXD) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := req.URL.Path
+
+	switch {
+	case p == "/1.0/instances/bagel" && req.Method == "GET":
+		lxdSync(w, map[string]string{"status": "Running"})
+	case strings.HasPrefix(p, "/1.0/instances/") && !strings.HasPrefix(p, "/1.0/instances/bagel"):
+		lxdError(w, http.StatusNotFound, "Instance not found")
+	case p == "/1.0/instances/bagel/exec":
+		r.handleExec(w, req)
+	case strings.HasSuffix(p, "/websocket"):
+		r.handleWebsocket(w, req)
+	case strings.HasSuffix(p, "/wait"):
+		id := strings.Split(p, "/")[3]
+		r.mu.Lock()
+		op := r.ops[id]
+		r.mu.Unlock()
+
+		<-op.done
+		lxdSync(w, map[string]interface{}{
+			"id":       id,
+			"status":   "Success",
+			"metadata": map[string]interface{}{"return": op.exitCode},
+		})
+	case p == "/1.0/instances/bagel/files":
+		r.handleFiles(w, req)
+	default:
+		lxdError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (r *fakeLXD) handleExec(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Command []string `json:"command"`
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+
+	r.mu.Lock()
+	id := fmt.Sprintf("op%d", len(r.ops))
+	op := &fakeLXDOperation{
+		cmd:     body.Command,
+		secrets: make(map[string]string),
+		conns:   make(map[string]*websocket.Conn),
+		done:    make(chan struct{}),
+	}
+	for _, fd := range []string{"control", "0", "1", "2"} {
+		op.secrets[fd] = id + "-" + fd
+	}
+	r.ops[id] = op
+	r.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "async",
+		"status_code": 100,
+		"operation":   "/1.0/operations/" + id,
+		"metadata": map[string]interface{}{
+			"id":       id,
+			"metadata": map[string]interface{}{"fds": op.secrets},
+		},
+	})
+}
+
+func (r *fakeLXD) handleWebsocket(w http.ResponseWriter, req *http.Request) {
+	id := strings.Split(req.URL.Path, "/")[3]
+	secret := req.URL.Query().Get("secret")
+
+	r.mu.Lock()
+	op := r.ops[id]
+	r.mu.Unlock()
+
+	var fd string
+	for k, v := range op.secrets {
+		if v == secret {
+			fd = k
+		}
+	}
+
+	conn, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	op.conns[fd] = conn
+	ready := len(op.conns) == len(op.secrets)
+	r.mu.Unlock()
+
+	if ready {
+		go op.run()
+	}
+}
+
+func (r *fakeLXDOperation) run() {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(r.cmd[0], r.cmd[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		r.exitCode = err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	}
+
+	for fd, b := range map[string][]byte{"1": stdout.Bytes(), "2": stderr.Bytes()} {
+		if len(b) > 0 {
+			r.conns[fd].WriteMessage(websocket.BinaryMessage, b)
+		}
+
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		r.conns[fd].WriteMessage(websocket.CloseMessage, msg)
+	}
+
+	close(r.done)
+}
+
+func (r *fakeLXD) handleFiles(w http.ResponseWriter, req *http.Request) {
+	p := req.URL.Query().Get("path")
+
+	switch req.Method {
+	case "GET":
+		stat, err := os.Stat(p)
+		if err != nil {
+			lxdError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		w.Header().Set("X-LXD-uid", strconv.Itoa(int(stat.Sys().(*syscall.Stat_t).Uid)))
+		w.Header().Set("X-LXD-gid", strconv.Itoa(int(stat.Sys().(*syscall.Stat_t).Gid)))
+		w.Header().Set("X-LXD-mode", fmt.Sprintf("%04o", stat.Mode().Perm()))
+
+		if stat.IsDir() {
+			w.Header().Set("X-LXD-type", "directory")
+			lxdSync(w, []string{})
+			return
+		}
+
+		w.Header().Set("X-LXD-type", "file")
+		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+		f, _ := os.Open(p)
+		io.Copy(w, f)
+		f.Close()
+	case "POST":
+		// An owner which isn't sent is left as it is.
+		owner := map[string]int{"X-LXD-uid": -1, "X-LXD-gid": -1}
+		for k := range owner {
+			v := req.Header.Get(k)
+			if v == "" {
+				continue
+			}
+
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 0 {
+				lxdError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", k, v))
+				return
+			}
+
+			owner[k] = id
+		}
+
+		mode, _ := strconv.ParseUint(req.Header.Get("X-LXD-mode"), 8, 32)
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			lxdError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		io.Copy(f, req.Body)
+		f.Close()
+		os.Chmod(p, os.FileMode(mode))
+
+		if err := os.Chown(p, owner["X-LXD-uid"], owner["X-LXD-gid"]); err != nil {
+			lxdError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		lxdSync(w, nil)
+	case "DELETE":
+		if err := os.Remove(p); err != nil {
+			lxdError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		lxdSync(w, nil)
+	}
+}
+
+func newLXDConnection(t *testing.T, socket, instance string) connections.Connection {
+	options := map[string]interface{}{
+		"host":   instance,
+		"socket": socket,
+		"shell":  "/bin/bash",
+	}
+
+	lxd, err := connections.New("lxd", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lxd
+}
+
+func TestLXD_Basic(t *testing.T) {
+	socket, cleanup := newFakeLXD(t)
+	defer cleanup()
+
+	lxd := newLXDConnection(t, socket, "bagel")
+	if err := lxd.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer lxd.Close()
+
+	ro := connections.RunOpts{
+		Command: "echo hi",
+	}
+
+	rr, err := lxd.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+	assert.Equal(t, 0, rr.ExitCode)
+
+	ro.Command = "foo=bar; echo foobar >&2; echo $foo; exit 3"
+	rr, err = lxd.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "bar", rr.Stdout)
+	assert.Equal(t, "foobar", rr.Stderr)
+	assert.Equal(t, 3, rr.ExitCode)
+}
+
+func TestLXD_NoSuchInstance(t *testing.T) {
+	socket, cleanup := newFakeLXD(t)
+	defer cleanup()
+
+	lxd := newLXDConnection(t, socket, "missing")
+	err := lxd.Connect(context.Background())
+	assert.Contains(t, err.Error(), "unable to get instance missing")
+}
+
+func TestLXD_CopyFileDelete(t *testing.T) {
+	socket, cleanup := newFakeLXD(t)
+	defer cleanup()
+
+	lxd := newLXDConnection(t, socket, "bagel")
+	if err := lxd.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer lxd.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote.txt")
+	local := filepath.Join(dir, "local.txt")
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		UID:         os.Getuid(),
+		GID:         os.Getgid(),
+		Mode:        0600,
+	}
+
+	fr, err := lxd.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fo := connections.FileOpts{
+		Path: remote,
+	}
+
+	fr, err = lxd.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "remote.txt", fr.FileInfo.Name)
+	assert.Equal(t, "file", fr.FileInfo.Type)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+	assert.Equal(t, int64(14), fr.FileInfo.Size)
+
+	cfo = connections.CopyFileOpts{
+		Source:      remote,
+		Destination: local,
+	}
+
+	fr, err = lxd.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	fr, err = lxd.FileDelete(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fr, err = lxd.FileInfo(context.Background(), fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+}
+
+func TestLXD_UploadOwner(t *testing.T) {
+	socket, cleanup := newFakeLXD(t)
+	defer cleanup()
+
+	lxd := newLXDConnection(t, socket, "bagel")
+	if err := lxd.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer lxd.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote.txt")
+	if err := ioutil.WriteFile(remote, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An owner below 0 isn't sent, so the existing one is kept.
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: remote,
+		UID:         -1,
+		GID:         -1,
+	}
+
+	fr, err := lxd.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+
+	fr, err = lxd.FileInfo(context.Background(), connections.FileOpts{Path: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.Getuid(), fr.FileInfo.UID)
+	assert.Equal(t, os.Getgid(), fr.FileInfo.GID)
+
+	if os.Getuid() != 0 {
+		return
+	}
+
+	// Only the requested ID is changed.
+	cfo.UID = 65534
+	if _, err := lxd.FileUpload(context.Background(), cfo); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = lxd.FileInfo(context.Background(), connections.FileOpts{Path: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 65534, fr.FileInfo.UID)
+	assert.Equal(t, os.Getgid(), fr.FileInfo.GID)
+}
@@ -0,0 +1,258 @@
+package testing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/mock"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMock_RunCommand(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy`,
+		connections.RunResult{Stdout: "first"},
+		connections.RunResult{Stdout: "second"},
+	)
+	conn.OnCommand(`^true$`)
+	conn.OnCommandError(`^fail$`, fmt.Errorf("connection lost"))
+
+	ctx := context.Background()
+
+	var stdout []string
+	for i := 0; i < 3; i++ {
+		rr, err := conn.RunCommand(ctx, connections.RunOpts{Command: "apt-cache policy foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stdout = append(stdout, rr.Stdout)
+	}
+
+	assert.Equal(t, []string{"first", "second", "second"}, stdout)
+
+	rr, err := conn.RunCommand(ctx, connections.RunOpts{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, rr.ExitCode)
+	assert.Equal(t, true, rr.Applied)
+
+	rr, err = conn.RunCommand(ctx, connections.RunOpts{Command: "asdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, mock.NotFoundExitCode, rr.ExitCode)
+
+	_, err = conn.RunCommand(ctx, connections.RunOpts{Command: "fail"})
+	assert.EqualError(t, err, "connection lost")
+
+	assert.Equal(t, []string{
+		"apt-cache policy foo",
+		"apt-cache policy foo",
+		"apt-cache policy foo",
+		"true",
+		"asdf",
+		"fail",
+	}, conn.Commands())
+}
+
+func TestMock_Files(t *testing.T) {
+	conn := mock.New()
+	ctx := context.Background()
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: "/etc/hello.txt",
+		Mode:        0600,
+	}
+
+	_, err := conn.FileUpload(ctx, cfo)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = conn.MkdirAll(ctx, connections.FileOpts{Path: "/etc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := conn.FileUpload(ctx, cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+
+	content, ok := conn.File("/etc/hello.txt")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "Hello, World!\n", string(content))
+
+	fr, err = conn.FileInfo(ctx, connections.FileOpts{Path: "/etc/hello.txt", Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+	sum := sha256.Sum256([]byte("Hello, World!\n"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.FileInfo.Checksum)
+
+	fo := connections.FileOpts{Path: "/etc/hello.txt", Target: "/etc/world.txt"}
+	if _, err := conn.Rename(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	fo = connections.FileOpts{Path: "/etc/link", Target: "world.txt"}
+	if _, err := conn.Symlink(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = conn.ReadDir(ctx, connections.FileOpts{Path: "/etc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(fr.Entries))
+	assert.Equal(t, "link", fr.Entries[0].Name)
+	assert.Equal(t, "world.txt", fr.Entries[0].LinkTarget)
+	assert.Equal(t, "world.txt", fr.Entries[1].Name)
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfo = connections.CopyFileOpts{
+		Source:      "/etc/world.txt",
+		Destination: filepath.Join(dir, "world.txt"),
+	}
+
+	if _, err := conn.FileDownload(ctx, cfo); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(cfo.Destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(actual))
+
+	if _, err := conn.RemoveAll(ctx, connections.FileOpts{Path: "/etc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = conn.FileInfo(ctx, connections.FileOpts{Path: "/etc/world.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Exists)
+
+	mock.AssertGolden(t, "fixtures/mock/files.golden", conn.Calls())
+}
+
+func TestMock_RecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	recorder := mock.Record(local)
+
+	ro := connections.RunOpts{
+		Command: "cat; echo $FOO",
+		Env:     map[string]string{"FOO": "bar"},
+		Stdin:   strings.NewReader("hi\n"),
+	}
+
+	rr, err := recorder.RunCommand(ctx, ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi\nbar", rr.Stdout)
+
+	fo := connections.FileOpts{
+		Path:    filepath.Join(dir, "hello.txt"),
+		Content: []byte("Hello, World!\n"),
+	}
+
+	if _, err := recorder.WriteFile(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := recorder.ReadFile(ctx, connections.FileOpts{Path: fo.Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, fo.Content, fr.Content)
+
+	file := filepath.Join(dir, "transcript.json")
+	if err := recorder.Transcript().Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	transcript, err := mock.LoadTranscript(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, recorder.Transcript().Calls(), transcript.Calls())
+
+	// The replayed calls return what was recorded without touching
+	// the local host.
+	if err := os.Remove(fo.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := mock.Replay(transcript)
+
+	ro.Stdin = strings.NewReader("hi\n")
+	rr, err = replay.RunCommand(ctx, ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi\nbar", rr.Stdout)
+
+	assert.Error(t, replay.Done())
+
+	_, err = replay.ReadFile(ctx, connections.FileOpts{Path: fo.Path})
+	assert.EqualError(t, err, "mock: expected call: WriteFile "+fo.Path+", got: ReadFile "+fo.Path)
+
+	if _, err := replay.WriteFile(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = replay.ReadFile(ctx, connections.FileOpts{Path: fo.Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, fo.Content, fr.Content)
+	assert.NoError(t, replay.Done())
+
+	_, err = os.Stat(fo.Path)
+	assert.True(t, os.IsNotExist(err))
+}
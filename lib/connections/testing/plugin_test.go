@@ -0,0 +1,276 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jtopjian/bagel/lib/connections"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pluginEnv has the test binary serve a local connection as a plugin
+// instead of running the tests.
+const pluginEnv = "BAGEL_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(pluginEnv) != "" {
+		err := connections.ServePlugin(os.Stdin, os.Stdout, func(options map[string]interface{}) (connections.Connection, error) {
+			if options["fail"] == true {
+				return nil, fmt.Errorf("unable to open the console")
+			}
+
+			local, err := connections.NewLocal(options)
+			if options["hang"] == true {
+				return hangingConnection{local}, err
+			}
+
+			return local, err
+		})
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// hangingConnection is a connection whose commands never finish
+// until they are cancelled, whatever their timeout.
+type hangingConnection struct {
+	connections.Connection
+}
+
+func (r hangingConnection) RunCommand(ctx context.Context, ro connections.RunOpts) (*connections.RunResult, error) {
+	<-ctx.Done()
+	return nil, fmt.Errorf("interrupted")
+}
+
+// newPluginConnection installs the test binary as the plugin for the
+// "fake" connection type and returns a connection of that type.
+func newPluginConnection(t *testing.T, options map[string]interface{}) connections.Connection {
+	dir, err := ioutil.TempDir("", "bagel-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\n%s=1 exec %s\n", pluginEnv, exe)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bagel-connection-fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := connections.PluginDirs
+	connections.PluginDirs = []string{dir}
+	defer func() { connections.PluginDirs = dirs }()
+
+	conn, err := connections.New("fake", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	})
+
+	return conn
+}
+
+func TestPlugin_RunCommand(t *testing.T) {
+	conn := newPluginConnection(t, map[string]interface{}{
+		"shell": "/bin/sh",
+	})
+
+	ctx := context.Background()
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var log io.Writer = &buf
+
+	ro := connections.RunOpts{
+		Command: "cat; echo $FOO; echo oops >&2; exit 3",
+		Stdin:   strings.NewReader("hi\n"),
+		Env:     map[string]string{"FOO": "bar"},
+		Log:     &log,
+	}
+
+	rr, err := conn.RunCommand(ctx, ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi\nbar", rr.Stdout)
+	assert.Equal(t, "oops", rr.Stderr)
+	assert.Equal(t, 3, rr.ExitCode)
+	assert.Contains(t, buf.String(), "stdout: bar\n")
+	assert.Contains(t, buf.String(), "stderr: oops\n")
+
+	ro = connections.RunOpts{
+		Command: "sleep 5",
+		Timeout: 1,
+	}
+
+	rr, err = conn.RunCommand(ctx, ro)
+	assert.EqualError(t, err, "timeout")
+	assert.Equal(t, true, rr.Timeout)
+}
+
+func TestPlugin_CommandTimeout(t *testing.T) {
+	conn := newPluginConnection(t, map[string]interface{}{
+		"hang": true,
+	})
+
+	if err := conn.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timeout is kept even if the plugin doesn't keep it.
+	start := time.Now()
+	rr, err := conn.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi", Timeout: 1})
+	assert.EqualError(t, err, "timeout")
+	assert.Equal(t, true, rr.Timeout)
+
+	// Closing doesn't wait for the plugin to kill it.
+	conn.Close()
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestPlugin_Interrupt(t *testing.T) {
+	conn := newPluginConnection(t, nil)
+
+	if err := conn.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := conn.RunCommand(ctx, connections.RunOpts{Command: "sleep 10"})
+	assert.EqualError(t, err, "interrupted")
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// The plugin keeps serving requests.
+	rr, err := conn.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+}
+
+func TestPlugin_FileOps(t *testing.T) {
+	conn := newPluginConnection(t, nil)
+
+	ctx := context.Background()
+	if err := conn.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: filepath.Join(dir, "hello.txt"),
+		UID:         os.Getuid(),
+		GID:         os.Getgid(),
+		Mode:        0600,
+	}
+
+	fr, err := conn.FileUpload(ctx, cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+
+	fo := connections.FileOpts{
+		Path:     cfo.Destination,
+		Checksum: true,
+	}
+
+	fr, err = conn.FileInfo(ctx, fo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Exists)
+	assert.Equal(t, "hello.txt", fr.FileInfo.Name)
+	assert.Equal(t, 600, fr.FileInfo.Mode)
+	assert.Equal(t, false, fr.FileInfo.ModTime.IsZero())
+
+	fo = connections.FileOpts{
+		Path:    filepath.Join(dir, "sub", "world.txt"),
+		Content: []byte("Hello, World!\n"),
+	}
+
+	if _, err := conn.MkdirAll(ctx, connections.FileOpts{Path: filepath.Join(dir, "sub")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.WriteFile(ctx, fo); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = conn.ReadFile(ctx, connections.FileOpts{Path: fo.Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, fo.Content, fr.Content)
+
+	fr, err = conn.ReadDir(ctx, connections.FileOpts{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(fr.Entries))
+	assert.Equal(t, "hello.txt", fr.Entries[0].Name)
+	assert.Equal(t, "directory", fr.Entries[1].Type)
+
+	_, err = conn.ReadFile(ctx, connections.FileOpts{Path: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+
+	_, err = conn.FileInfo(ctx, connections.FileOpts{})
+	assert.EqualError(t, err, "path is required for file exists")
+}
+
+func TestPlugin_Errors(t *testing.T) {
+	_, err := connections.New("nosuch", nil)
+	assert.EqualError(t, err, "unsupported connection type: nosuch: bagel-connection-nosuch was not found")
+
+	_, err = connections.New("../fake", nil)
+	assert.EqualError(t, err, "unsupported connection type: ../fake")
+
+	conn := newPluginConnection(t, map[string]interface{}{
+		"fail": true,
+	})
+
+	err = conn.Connect(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to open the console")
+}
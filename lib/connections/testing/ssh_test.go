@@ -1,35 +1,58 @@
 package testing
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/testing/sshserver"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-func TestSSH_Basic(t *testing.T) {
-	options := map[string]interface{}{
-		"host":        "localhost",
-		"user":        "ubuntu",
-		"private_key": "/root/.ssh/id_rsa",
-		"shell":       "/bin/bash",
-		"timeout":     5,
-	}
+func newSSHConnection(t *testing.T, server *sshserver.Server) connections.Connection {
+	return newSSHConnectionWithOptions(t, server.Options())
+}
 
+// newSSHConnectionWithOptions returns a connected ssh connection.
+func newSSHConnectionWithOptions(t *testing.T, options map[string]interface{}) connections.Connection {
 	ssh, err := connections.New("ssh", options)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ssh.Connect(); err != nil {
+	if err := ssh.Connect(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
+	return ssh
+}
+
+func TestSSH_Basic(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
 	ro := connections.RunOpts{
 		Command: "echo hi",
 	}
 
-	rr, err := ssh.RunCommand(ro)
+	rr, err := ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,15 +60,16 @@ func TestSSH_Basic(t *testing.T) {
 	assert.Equal(t, "hi", rr.Stdout)
 
 	ro.Command = "asdf"
-	rr, err = ssh.RunCommand(ro)
+	rr, err = ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, "/bin/bash: asdf: command not found", rr.Stderr)
+	assert.Contains(t, rr.Stderr, "asdf: command not found")
+	assert.Equal(t, 127, rr.ExitCode)
 
-	ro.Command = `foo=bar; sleep 1; echo foobar >&2; echo \$foo ; echo 123 >&2`
-	rr, err = ssh.RunCommand(ro)
+	ro.Command = `foo=bar; sleep 1; echo foobar >&2; echo $foo ; echo 123 >&2`
+	rr, err = ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,39 +78,108 @@ func TestSSH_Basic(t *testing.T) {
 	assert.Equal(t, "foobar\n123", rr.Stderr)
 }
 
-func TestSSH_CommandTimeout(t *testing.T) {
-	options := map[string]interface{}{
-		"host":        "localhost",
-		"user":        "ubuntu",
-		"private_key": "/root/.ssh/id_rsa",
-		"shell":       "/bin/bash",
-	}
+func TestSSH_Password(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{Password: "secret"})
+	defer server.Close()
 
-	ssh, err := connections.New("ssh", options)
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ssh.Connect(); err != nil {
+	assert.Equal(t, "hi", rr.Stdout)
+
+	options := server.Options()
+	options["password"] = "wrong"
+	options["timeout"] = 1
+
+	ssh2, err := connections.New("ssh", options)
+	if err != nil {
 		t.Fatal(err)
 	}
 
+	err = ssh2.Connect(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestSSH_StdinEnvDir(t *testing.T) {
+	for _, rejectEnv := range []bool{false, true} {
+		server := sshserver.New(t, sshserver.Config{PublicKey: true, RejectEnv: rejectEnv})
+		defer server.Close()
+
+		ssh := newSSHConnection(t, server)
+		defer ssh.Close()
+
+		if err := os.Mkdir(filepath.Join(server.Root, "work dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		ro := connections.RunOpts{
+			Command: `cat; echo "$GREETING"; basename "$PWD"`,
+			Stdin:   strings.NewReader("from stdin\n"),
+			Env:     map[string]string{"GREETING": "it's here"},
+			Dir:     filepath.Join(server.Root, "work dir"),
+		}
+
+		rr, err := ssh.RunCommand(context.Background(), ro)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "from stdin\nit's here\nwork dir", rr.Stdout)
+	}
+}
+
+func TestSSH_CommandTimeout(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
 	ro := connections.RunOpts{
-		Command: "sleep 6; echo timeout",
-		Timeout: 5,
+		Command: "sleep 3; echo timeout",
+		Timeout: 1,
 	}
 
-	rr, err := ssh.RunCommand(ro)
+	rr, err := ssh.RunCommand(context.Background(), ro)
+	assert.NotNil(t, err)
 	assert.Equal(t, true, rr.Timeout)
+	assert.Equal(t, "", rr.Stdout)
 }
 
 func TestSSH_ConnectTimeout(t *testing.T) {
+	// A listener which never completes a handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	sshConfig := false
 	options := map[string]interface{}{
-		"host":        "localhost2",
-		"user":        "ubuntu",
-		"private_key": "/root/.ssh/id_rsa",
-		"shell":       "/bin/bash",
-		"timeout":     5,
+		"host":              addr.IP.String(),
+		"port":              addr.Port,
+		"user":              "ubuntu",
+		"password":          "secret",
+		"shell":             "/bin/bash",
+		"timeout":           1,
+		"host_key_checking": "off",
+		"ssh_config":        &sshConfig,
 	}
 
 	ssh, err := connections.New("ssh", options)
@@ -94,76 +187,477 @@ func TestSSH_ConnectTimeout(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = ssh.Connect()
-	assert.Equal(t, "timed out connecting to localhost2:22", err.Error())
+	err = ssh.Connect(context.Background())
+	assert.Equal(t, fmt.Sprintf("timed out connecting to %s", addr), err.Error())
 }
 
 func TestSSH_Bastion(t *testing.T) {
+	bastion := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer bastion.Close()
 
-	options := map[string]interface{}{
-		"host":                "localhost",
-		"user":                "ubuntu",
-		"private_key":         "/root/.ssh/id_rsa",
-		"shell":               "/bin/bash",
-		"timeout":             5,
-		"bastion_host":        "localhost",
-		"bastion_user":        "ubuntu",
-		"bastion_private_key": "/root/.ssh/id_rsa",
+	server := sshserver.New(t, sshserver.Config{Password: "secret", NoForwarding: true})
+	defer server.Close()
+
+	// Both host keys must be trusted.
+	knownHosts, err := ioutil.ReadFile(bastion.KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	f, err := os.OpenFile(server.KnownHostsFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(knownHosts)
+	f.Close()
+
+	options := server.Options()
+	options["bastion_host"] = bastion.Host
+	options["bastion_port"] = bastion.Port
+	options["bastion_user"] = "bagel"
+	options["bastion_private_key"] = bastion.PrivateKeyFile
+
 	ssh, err := connections.New("ssh", options)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ssh.Connect(); err != nil {
+	if err := ssh.Connect(context.Background()); err != nil {
 		t.Fatal(err)
 	}
+	defer ssh.Close()
 
 	ro := connections.RunOpts{
 		Command: "echo hi",
 	}
 
-	rr, err := ssh.RunCommand(ro)
+	rr, err := ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	assert.Equal(t, "hi", rr.Stdout)
+	assert.Equal(t, 1, bastion.Connections())
+	assert.Equal(t, 0, len(bastion.Commands()))
+	assert.Equal(t, 1, server.Connections())
 }
 
-func TestSSH_CopyFileDelete(t *testing.T) {
-	options := map[string]interface{}{
-		"host":        "localhost",
-		"user":        "ubuntu",
-		"private_key": "/root/.ssh/id_rsa",
-		"shell":       "/bin/bash",
+// fingerprint returns the SHA256 fingerprint of a host key, as
+// printed by ssh-keygen -l.
+func fingerprint(key interface{ Marshal() []byte }) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func TestSSH_HostKeyRejected(t *testing.T) {
+	trusted, err := sshserver.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	presented, err := sshserver.NewSigner()
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	server := sshserver.New(t, sshserver.Config{PublicKey: true, HostKey: presented})
+	defer server.Close()
+
+	// The known_hosts file has another key for the server.
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr())}, trusted.PublicKey())
+	if err := ioutil.WriteFile(server.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"strict", "accept-new"} {
+		options := server.Options()
+		options["host_key_checking"] = mode
+
+		ssh, err := connections.New("ssh", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ssh.Connect(context.Background())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "host key verification failed")
+			assert.Contains(t, err.Error(), "key mismatch")
+		}
+	}
+
+	// An unknown host is only rejected in strict mode.
+	options := server.Options()
+	options["known_hosts_file"] = filepath.Join(server.Root, "known_hosts")
+
 	ssh, err := connections.New("ssh", options)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := ssh.Connect(); err != nil {
+	err = ssh.Connect(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "host is not in")
+	}
+
+	assert.Equal(t, 0, len(server.Commands()))
+}
+
+func TestSSH_HostKeyAcceptNew(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	// The file and its directory are created.
+	knownHosts := filepath.Join(server.Root, ".ssh", "known_hosts")
+
+	options := server.Options()
+	options["host_key_checking"] = "accept-new"
+	options["known_hosts_file"] = knownHosts
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	ssh.Close()
+
+	actual, err := ioutil.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr())}, server.HostKey)
+	assert.Equal(t, line+"\n", string(actual))
+
+	// The key is trusted from now on and isn't added again.
+	options["host_key_checking"] = "strict"
+	ssh = newSSHConnectionWithOptions(t, options)
+	ssh.Close()
+
+	options["host_key_checking"] = "accept-new"
+	ssh = newSSHConnectionWithOptions(t, options)
+	ssh.Close()
+
+	actual, err = ioutil.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, line+"\n", string(actual))
+}
+
+func TestSSH_HostKeyPinned(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	// A pinned key is used instead of the known_hosts file.
+	options := server.Options()
+	options["known_hosts_file"] = filepath.Join(server.Root, "known_hosts")
+	options["host_key"] = fingerprint(server.HostKey)
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	ssh.Close()
+
+	other, err := sshserver.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pinned key is checked even if host key checking is off.
+	options["host_key"] = fingerprint(other.PublicKey())
+	options["host_key_checking"] = "off"
+
+	ssh, err = connections.New("ssh", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ssh.Connect(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not match host_key "+fingerprint(other.PublicKey()))
+	}
+}
+
+func TestSSH_KeyboardInteractive(t *testing.T) {
+	challenge := func(user string, ask func([]string, []bool) ([]string, error)) error {
+		answers, err := ask([]string{"Password: ", "Verification code: "}, []bool{false, true})
+		if err != nil {
+			return err
+		}
+
+		if len(answers) != 2 || answers[0] != "secret" || answers[1] != "123456" {
+			return fmt.Errorf("wrong answers for %s", user)
+		}
+
+		return nil
+	}
+
+	server := sshserver.New(t, sshserver.Config{KeyboardInteractive: challenge})
+	defer server.Close()
+
+	// The password answers the prompt which doesn't echo.
+	options := server.Options()
+	options["password"] = "secret"
+	options["keyboard_interactive_answers"] = map[string]string{"verification code": "123456"}
+	options["auth_methods"] = []string{"keyboard-interactive"}
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+
+	// The longest key which matches wins, and the password prompt
+	// can be answered by a key too. Map order is random, so this is
+	// tried a few times.
+	delete(options, "password")
+	options["keyboard_interactive_answers"] = map[string]string{
+		"code":              "000000",
+		"verification code": "123456",
+		"password":          "secret",
+		"pass":              "wrong",
+	}
+
+	for i := 0; i < 5; i++ {
+		ssh := newSSHConnectionWithOptions(t, options)
+		ssh.Close()
+	}
+
+	// A prompt without an answer fails.
+	delete(options, "keyboard_interactive_answers")
+	options["password"] = "secret"
+	options["timeout"] = 1
+
+	ssh2, err := connections.New("ssh", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, ssh2.Connect(context.Background()))
+}
+
+func TestSSH_PrivateKeyPassphrase(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true, PrivateKeyPassphrase: "open sesame"})
+	defer server.Close()
+
+	options := server.Options()
+	_, err := connections.New("ssh", options)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "private_key_passphrase is required")
+	}
+
+	options["private_key_passphrase"] = "wrong"
+	_, err = connections.New("ssh", options)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to decrypt private_key")
+	}
+
+	options["private_key_passphrase"] = "open sesame"
+	ssh := newSSHConnectionWithOptions(t, options)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+}
+
+// trustHosts adds the host keys of others to the known_hosts file of
+// server, so a connection to it through them is trusted.
+func trustHosts(t *testing.T, server *sshserver.Server, others ...*sshserver.Server) {
+	f, err := os.OpenFile(server.KnownHostsFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, other := range others {
+		knownHosts, err := ioutil.ReadFile(other.KnownHostsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.Write(knownHosts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSSH_SSHConfig(t *testing.T) {
+	bastion := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer bastion.Close()
+
+	server := sshserver.New(t, sshserver.Config{PublicKey: true, NoForwarding: true})
+	defer server.Close()
+
+	trustHosts(t, server, bastion)
+
+	config := fmt.Sprintf(`Host web
+  HostName %s
+  Port %d
+  User bagel
+  IdentityFile %s
+  ProxyJump jump
+
+Host jump
+  HostName %s
+  Port %d
+  User bagel
+  IdentityFile %s
+`, server.Host, server.Port, server.PrivateKeyFile, bastion.Host, bastion.Port, bastion.PrivateKeyFile)
+
+	configFile := filepath.Join(server.Root, "ssh_config")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything but the alias comes from the config file.
+	sshConfig := true
+	options := server.Options()
+	options["host"] = "web"
+	options["ssh_config"] = &sshConfig
+	options["ssh_config_file"] = configFile
+	delete(options, "port")
+	delete(options, "user")
+	delete(options, "private_key")
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+	assert.Equal(t, 1, bastion.Connections())
+	assert.Equal(t, 0, len(bastion.Commands()))
+	assert.Equal(t, 1, server.Connections())
+
+	// Explicit options take precedence over the config file.
+	options["user"] = "nobody"
+	options["timeout"] = 1
+
+	ssh2, err := connections.New("ssh", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, ssh2.Connect(context.Background()))
+}
+
+func TestSSH_JumpHosts(t *testing.T) {
+	first := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer first.Close()
+
+	// The second hop only accepts a certificate.
+	second := sshserver.New(t, sshserver.Config{PublicKey: true, Certificate: true})
+	defer second.Close()
+
+	server := sshserver.New(t, sshserver.Config{Password: "secret", NoForwarding: true})
+	defer server.Close()
+
+	trustHosts(t, server, first, second)
+
+	options := server.Options()
+	options["jump_hosts"] = []map[string]interface{}{
+		{
+			"host":        first.Host,
+			"port":        first.Port,
+			"user":        "bagel",
+			"private_key": first.PrivateKeyFile,
+		},
+		{
+			"host":        second.Host,
+			"port":        second.Port,
+			"user":        "bagel",
+			"private_key": second.PrivateKeyFile,
+			"certificate": second.CertificateFile,
+		},
+	}
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+
+	// Each hop is connected to once and runs nothing.
+	for _, hop := range []*sshserver.Server{first, second, server} {
+		assert.Equal(t, 1, hop.Connections())
+	}
+
+	assert.Equal(t, 0, len(first.Commands()))
+	assert.Equal(t, 0, len(second.Commands()))
+	assert.Equal(t, 1, len(server.Commands()))
+}
+
+func TestSSH_Certificate(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true, Certificate: true})
+	defer server.Close()
+
+	options := server.Options()
+	options["certificate"] = server.CertificateFile
+
+	ssh := newSSHConnectionWithOptions(t, options)
+	defer ssh.Close()
+
+	rr, err := ssh.RunCommand(context.Background(), connections.RunOpts{Command: "echo hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+
+	// The key alone is rejected.
+	delete(options, "certificate")
+	options["timeout"] = 1
+
+	ssh2, err := connections.New("ssh", options)
+	if err != nil {
 		t.Fatal(err)
 	}
 
+	assert.Error(t, ssh2.Connect(context.Background()))
+
+	// A certificate needs its private key.
+	options["certificate"] = server.CertificateFile
+	delete(options, "private_key")
+
+	_, err = connections.New("ssh", options)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate requires a private_key")
+	}
+}
+
+func TestSSH_CopyFileDelete(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	destination := filepath.Join(server.Root, "bagelfoo.txt")
 	cfo := connections.CopyFileOpts{
 		Source:      "fixtures/hello.txt",
-		Destination: "/tmp/bagelfoo.txt",
+		Destination: destination,
 	}
 
-	fr, err := ssh.FileUpload(cfo)
+	fr, err := ssh.FileUpload(context.Background(), cfo)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	ro := connections.RunOpts{
-		Command: "cat /tmp/bagelfoo.txt",
+		Command: "cat " + destination,
 	}
 
-	rr, err := ssh.RunCommand(ro)
+	rr, err := ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,16 +666,16 @@ func TestSSH_CopyFileDelete(t *testing.T) {
 	assert.Equal(t, "Hello, World!", rr.Stdout)
 
 	fo := connections.FileOpts{
-		Path: "/tmp/bagelfoo.txt",
+		Path: destination,
 	}
 
-	fr, err = ssh.FileDelete(fo)
+	fr, err = ssh.FileDelete(context.Background(), fo)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	ro.Command = "stat /tmp/bagelfoo.txt"
-	rr, err = ssh.RunCommand(ro)
+	ro.Command = "stat " + destination
+	rr, err = ssh.RunCommand(context.Background(), ro)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -189,5 +683,354 @@ func TestSSH_CopyFileDelete(t *testing.T) {
 	if rr.ExitCode != 1 {
 		t.Fatalf("file still exists")
 	}
+}
+
+func TestSSH_CopyLargeFile(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	destination := filepath.Join(server.Root, "destination")
+
+	expected := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	if err := ioutil.WriteFile(source, expected, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale data past the end of the new contents must not remain.
+	stale := append(expected, []byte("stale")...)
+	if err := ioutil.WriteFile(destination, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfo := connections.CopyFileOpts{
+		Source:      source,
+		Destination: destination,
+		Mode:        0600,
+	}
+
+	fr, err := ssh.FileUpload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(expected)
+
+	assert.Equal(t, true, fr.Success)
+	assert.Equal(t, true, fr.Verified)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Checksum)
+	assert.Equal(t, expected, actual)
+
+	cfo = connections.CopyFileOpts{
+		Source:      destination,
+		Destination: filepath.Join(dir, "downloaded"),
+	}
+
+	fr, err = ssh.FileDownload(context.Background(), cfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err = ioutil.ReadFile(cfo.Destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Checksum)
+	assert.Equal(t, expected, actual)
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(server.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(files))
+}
+
+func TestSSH_UploadOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of a file requires root")
+	}
+
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	destination := filepath.Join(server.Root, "owned.txt")
+	cfo := connections.CopyFileOpts{
+		Source:      "fixtures/hello.txt",
+		Destination: destination,
+		UID:         65534,
+		GID:         -1,
+	}
+
+	if _, err := ssh.FileUpload(context.Background(), cfo); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A GID below 0 is left as the connection user's.
+	stat := fi.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(65534), stat.Uid)
+	assert.Equal(t, uint32(os.Getgid()), stat.Gid)
+}
+
+func TestSSH_FileOps(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	ctx := context.Background()
+	dir := filepath.Join(server.Root, "a", "b")
+
+	if _, err := ssh.MkdirAll(ctx, connections.FileOpts{Path: dir, Mode: 0700}); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "file")
+	fr, err := ssh.WriteFile(ctx, connections.FileOpts{Path: file, Content: []byte("Hello, World!\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Verified)
+
+	if _, err := ssh.Symlink(ctx, connections.FileOpts{Path: filepath.Join(dir, "link"), Target: "file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = ssh.ReadFile(ctx, connections.FileOpts{Path: filepath.Join(dir, "link")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Hello, World!\n", string(fr.Content))
+
+	fr, err = ssh.ReadDir(ctx, connections.FileOpts{Path: dir, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("Hello, World!\n"))
+	assert.Equal(t, 2, len(fr.Entries))
+	assert.Equal(t, "file", fr.Entries[0].Name)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fr.Entries[0].Checksum)
+	assert.Equal(t, "link", fr.Entries[1].Name)
+	assert.Equal(t, "file", fr.Entries[1].LinkTarget)
+
+	fr, err = ssh.FileInfo(ctx, connections.FileOpts{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 700, fr.FileInfo.Mode)
+	assert.NotEqual(t, "", fr.FileInfo.Owner)
+
+	if _, err := ssh.RemoveAll(ctx, connections.FileOpts{Path: filepath.Join(server.Root, "a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(server.Root, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSSH_Reconnect(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	ro := connections.RunOpts{
+		Command: "echo hi",
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := ssh.RunCommand(context.Background(), ro); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ssh.FileInfo(context.Background(), connections.FileOpts{Path: server.Root}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Commands and file actions share one connection.
+	assert.Equal(t, 1, server.Connections())
+
+	server.Drop()
+
+	rr, err := ssh.RunCommand(context.Background(), ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hi", rr.Stdout)
+	assert.Equal(t, 2, server.Connections())
+}
+
+// newEchoListener starts a TCP server on the loopback interface which
+// answers each line with "echo: " and the line.
+func newEchoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				scanner := bufio.NewScanner(c)
+				for scanner.Scan() {
+					fmt.Fprintf(c, "echo: %s\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// echo sends a line to addr and returns the reply.
+func echo(addr, line string) (string, error) {
+	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(c, line)
+
+	return bufio.NewReader(c).ReadString('\n')
+}
+
+func TestSSH_Tunnel(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	// The fixture runs on the local host, so the service is on the
+	// target's loopback interface too.
+	service := newEchoListener(t)
+	defer service.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel, err := ssh.(connections.Tunneler).Tunnel(ctx, connections.TunnelOpts{
+		Remote: service.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEqual(t, 0, tunnel.Port)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", tunnel.Port), tunnel.Local)
+
+	for i := 0; i < 3; i++ {
+		reply, err := echo(tunnel.Local, fmt.Sprintf("hello %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, fmt.Sprintf("echo: hello %d\n", i), reply)
+	}
+
+	// The tunnel is closed with its context.
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", tunnel.Local)
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.NoError(t, tunnel.Close())
+}
+
+func TestSSH_ReverseTunnel(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
+
+	service := newEchoListener(t)
+	defer service.Close()
+
+	tunneler := ssh.(connections.Tunneler)
+
+	_, err := tunneler.Tunnel(context.Background(), connections.TunnelOpts{
+		Remote:  "127.0.0.1:0",
+		Reverse: true,
+	})
+	assert.EqualError(t, err, "a local address is required for a reverse tunnel")
+
+	tunnel, err := tunneler.Tunnel(context.Background(), connections.TunnelOpts{
+		Remote:  "127.0.0.1:0",
+		Local:   service.Addr().String(),
+		Reverse: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEqual(t, 0, tunnel.Port)
+
+	reply, err := echo(tunnel.Remote, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "echo: hello\n", reply)
+
+	assert.NoError(t, tunnel.Close())
+	_, err = echo(tunnel.Remote, "hello")
+	assert.Error(t, err)
+}
+
+func TestSSH_TunnelNoForwarding(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true, NoForwarding: true})
+	defer server.Close()
+
+	ssh := newSSHConnection(t, server)
+	defer ssh.Close()
 
+	_, err := ssh.(connections.Tunneler).Tunnel(context.Background(), connections.TunnelOpts{
+		Remote:  "127.0.0.1:0",
+		Local:   "127.0.0.1:1",
+		Reverse: true,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to listen on 127.0.0.1:0")
 }
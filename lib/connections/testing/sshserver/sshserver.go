@@ -0,0 +1,723 @@
+// Package sshserver provides an in-process SSH server for tests.
+//
+// The server supports the exec and sftp subsystems, direct-tcpip
+// forwarding and tcpip-forward requests, so it can be used as both a
+// target and a bastion host and can serve remote port forwards.
+// Commands are run with /bin/sh on the local host, starting in a
+// temporary directory which is removed when the server is closed, and
+// files are read and written on the local host.
+package sshserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config configures a Server.
+type Config struct {
+	// User is the user which may log in. Defaults to "bagel".
+	User string
+
+	// Password enables password authentication with this password.
+	Password string
+
+	// HostKey is the server's host key. One is generated if it isn't
+	// set.
+	HostKey ssh.Signer
+
+	// PublicKey enables public key authentication. A key pair is
+	// generated and the private key is written to PrivateKeyFile.
+	PublicKey bool
+
+	// PrivateKeyPassphrase encrypts PrivateKeyFile.
+	PrivateKeyPassphrase string
+
+	// Certificate enables certificate authentication. A CA is
+	// generated and a certificate for the client key is written to
+	// CertificateFile. The client key is only accepted with the
+	// certificate. It requires PublicKey.
+	Certificate bool
+
+	// KeyboardInteractive enables keyboard-interactive
+	// authentication. It is called with the user and a function
+	// which asks the client questions, and accepts the user if it
+	// returns nil.
+	KeyboardInteractive func(user string, ask func(questions []string, echos []bool) ([]string, error)) error
+
+	// NoExec refuses exec requests, like a server which only
+	// allows SFTP.
+	NoExec bool
+
+	// NoForwarding refuses direct-tcpip channels and tcpip-forward
+	// requests, so the server can't be used as a bastion host or
+	// serve remote port forwards.
+	NoForwarding bool
+
+	// RejectEnv refuses env requests, like a server without an
+	// AcceptEnv setting.
+	RejectEnv bool
+}
+
+// Server is an SSH server listening on the loopback interface.
+type Server struct {
+	// Host and Port are the address the server listens on.
+	Host string
+	Port int
+
+	// Root is the temporary directory commands start in.
+	Root string
+
+	// PrivateKeyFile is the client key for public key
+	// authentication. It is only set if Config.PublicKey is.
+	PrivateKeyFile string
+
+	// CertificateFile is the client certificate. It is only set if
+	// Config.Certificate is.
+	CertificateFile string
+
+	// KnownHostsFile lists the server's host key.
+	KnownHostsFile string
+
+	// HostKey is the server's host key.
+	HostKey ssh.PublicKey
+
+	config   Config
+	dir      string
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       map[net.Conn]bool
+	connections int
+	execs       []string
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// New starts a Server. The test fails if the server can't be started.
+func New(t testing.TB, config Config) *Server {
+	t.Helper()
+
+	if config.User == "" {
+		config.User = "bagel"
+	}
+
+	s := &Server{
+		config: config,
+		conns:  make(map[net.Conn]bool),
+	}
+
+	dir, err := ioutil.TempDir("", "bagel-sshserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dir = dir
+
+	s.Root = filepath.Join(dir, "root")
+	if err := os.Mkdir(s.Root, 0755); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	serverConfig, err := s.serverConfig()
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+	s.Host = addr.IP.String()
+	s.Port = addr.Port
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, s.HostKey)
+	s.KnownHostsFile = filepath.Join(s.dir, "known_hosts")
+	if err := ioutil.WriteFile(s.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	s.wg.Add(1)
+	go s.serve(serverConfig)
+
+	return s
+}
+
+// Addr returns the host:port of the server.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Options returns connection options for the ssh driver which
+// connect to the server and trust its host key.
+func (s *Server) Options() map[string]interface{} {
+	sshConfig := false
+
+	options := map[string]interface{}{
+		"host":              s.Host,
+		"port":              s.Port,
+		"user":              s.config.User,
+		"shell":             "/bin/bash",
+		"timeout":           5,
+		"host_key_checking": "strict",
+		"known_hosts_file":  s.KnownHostsFile,
+		"ssh_config":        &sshConfig,
+	}
+
+	if s.config.Password != "" {
+		options["password"] = s.config.Password
+	}
+
+	if s.PrivateKeyFile != "" {
+		options["private_key"] = s.PrivateKeyFile
+	}
+
+	return options
+}
+
+// Connections returns the number of connections which have been
+// accepted.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections
+}
+
+// Commands returns the commands which have been run.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.execs...)
+}
+
+// Drop closes every open connection without stopping the server,
+// as if the network had failed.
+func (s *Server) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server, closes every connection and removes Root
+// and the key files.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+		s.wg.Wait()
+	}
+
+	os.RemoveAll(s.dir)
+}
+
+// serverConfig generates the host key and any client key and returns
+// the configuration of the server.
+func (s *Server) serverConfig() (*ssh.ServerConfig, error) {
+	hostSigner := s.config.HostKey
+	if hostSigner == nil {
+		var err error
+		hostSigner, err = NewSigner()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.HostKey = hostSigner.PublicKey()
+
+	config := &ssh.ServerConfig{}
+	config.AddHostKey(hostSigner)
+
+	if s.config.Password != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == s.config.User && string(password) == s.config.Password {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		}
+	}
+
+	if s.config.PublicKey {
+		clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		authorized, err := ssh.NewPublicKey(clientPub)
+		if err != nil {
+			return nil, err
+		}
+
+		var block *pem.Block
+		if s.config.PrivateKeyPassphrase != "" {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(clientPriv, "", []byte(s.config.PrivateKeyPassphrase))
+		} else {
+			block, err = ssh.MarshalPrivateKey(clientPriv, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s.PrivateKeyFile = filepath.Join(s.dir, "id_ed25519")
+		if err := ioutil.WriteFile(s.PrivateKeyFile, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, err
+		}
+
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == s.config.User && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("public key rejected for %s", c.User())
+		}
+
+		if s.config.Certificate {
+			checker, err := s.certificate(authorized)
+			if err != nil {
+				return nil, err
+			}
+
+			config.PublicKeyCallback = checker.Authenticate
+		}
+	}
+
+	if s.config.KeyboardInteractive != nil {
+		config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			ask := func(questions []string, echos []bool) ([]string, error) {
+				return client(c.User(), "", questions, echos)
+			}
+
+			return nil, s.config.KeyboardInteractive(c.User(), ask)
+		}
+	}
+
+	if config.PasswordCallback == nil && config.PublicKeyCallback == nil && config.KeyboardInteractiveCallback == nil {
+		config.NoClientAuth = true
+	}
+
+	return config, nil
+}
+
+// certificate generates a CA, signs key with it for the user and
+// writes the certificate to CertificateFile. It returns a checker
+// which only accepts certificates signed by the CA.
+func (s *Server) certificate(key ssh.PublicKey) (*ssh.CertChecker, error) {
+	ca, err := NewSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "bagel",
+		ValidPrincipals: []string{s.config.User},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+
+	s.CertificateFile = s.PrivateKeyFile + "-cert.pub"
+	if err := ioutil.WriteFile(s.CertificateFile, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		return nil, err
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+
+	return checker, nil
+}
+
+// NewSigner generates an ed25519 key, for use as a host key.
+func NewSigner() (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(priv)
+}
+
+// serve accepts connections until the listener is closed.
+func (s *Server) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.connections++
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+				c.Close()
+			}()
+
+			s.handleConn(c, config)
+		}()
+	}
+}
+
+// handleConn runs the SSH protocol over a connection.
+func (s *Server) handleConn(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go s.handleGlobalRequests(conn, reqs)
+
+	var wg sync.WaitGroup
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, requests, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleSession(ch, requests)
+			}()
+		case "direct-tcpip":
+			if s.config.NoForwarding {
+				nc.Reject(ssh.Prohibited, "forwarding is disabled")
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleForward(nc)
+			}()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+
+	wg.Wait()
+}
+
+// handleGlobalRequests answers keepalives, so the client knows the
+// connection is alive, and serves tcpip-forward requests. Listeners
+// are closed when the connection is.
+func (s *Server) handleGlobalRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	listeners := make(map[string]net.Listener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for req := range reqs {
+		var payload struct {
+			Host string
+			Port uint32
+		}
+
+		switch req.Type {
+		case "tcpip-forward":
+			if s.config.NoForwarding || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			l, err := net.Listen("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			listeners[net.JoinHostPort(payload.Host, strconv.Itoa(int(port)))] = l
+			go s.serveForward(conn, l, payload.Host, port)
+
+			var reply []byte
+			if payload.Port == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{port})
+			}
+			req.Reply(true, reply)
+		case "cancel-tcpip-forward":
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			key := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+			l, ok := listeners[key]
+			if ok {
+				l.Close()
+				delete(listeners, key)
+			}
+			req.Reply(ok, nil)
+		default:
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}
+}
+
+// serveForward opens a forwarded-tcpip channel to the client for each
+// connection accepted by a tcpip-forward listener.
+func (s *Server) serveForward(conn *ssh.ServerConn, l net.Listener, host string, port uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			payload := ssh.Marshal(struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}{host, port, origin.IP.String(), uint32(origin.Port)})
+
+			ch, requests, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(requests)
+
+			pipe(ch, c.(*net.TCPConn))
+		}()
+	}
+}
+
+// handleSession serves the requests of a session channel.
+func (s *Server) handleSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var env []string
+	var cmd *exec.Cmd
+	done := make(chan struct{})
+
+	for {
+		var req *ssh.Request
+		var ok bool
+
+		select {
+		case req, ok = <-requests:
+			if !ok {
+				if cmd != nil {
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+					<-done
+				}
+				return
+			}
+		case <-done:
+			return
+		}
+
+		switch req.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			if s.config.RejectEnv || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			env = append(env, payload.Name+"="+payload.Value)
+			req.Reply(true, nil)
+
+		case "pty-req":
+			// No terminal is allocated, but the request is
+			// accepted so clients which need one can proceed.
+			req.Reply(true, nil)
+
+		case "exec":
+			var payload struct{ Command string }
+			if s.config.NoExec || cmd != nil || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			s.mu.Lock()
+			s.execs = append(s.execs, payload.Command)
+			s.mu.Unlock()
+
+			cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			cmd.Dir = s.Root
+			cmd.Env = append(os.Environ(), env...)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+			// Stdin is copied separately so waiting for the
+			// command doesn't wait for the client to close it.
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				req.Reply(false, nil)
+				return
+			}
+
+			if err := cmd.Start(); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+
+			go func() {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					if exit, ok := err.(*exec.ExitError); ok {
+						if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Exited() {
+							status = ws.ExitStatus()
+						}
+					}
+				}
+
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, uint32(status))
+				ch.SendRequest("exit-status", false, b)
+				ch.CloseWrite()
+				close(done)
+			}()
+
+		case "signal":
+			req.Reply(false, nil)
+			if cmd != nil {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			}
+
+		case "subsystem":
+			var payload struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			go ssh.DiscardRequests(requests)
+
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// handleForward connects a direct-tcpip channel to its destination.
+func (s *Server) handleForward(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid forwarding request")
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+
+	ch, requests, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(requests)
+
+	pipe(ch, target.(*net.TCPConn))
+}
+
+// pipe copies data between a channel and a TCP connection until both
+// directions are done.
+func pipe(ch ssh.Channel, c *net.TCPConn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(c, ch)
+		c.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
@@ -0,0 +1,199 @@
+package connections
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// TunnelDefaultLocal is the local address a tunnel listens on if
+// none is set. The port is chosen by the system.
+const TunnelDefaultLocal = "127.0.0.1:0"
+
+// Tunneler is implemented by connections which can forward ports
+// between the local host and the target.
+type Tunneler interface {
+	Tunnel(context.Context, TunnelOpts) (*Tunnel, error)
+}
+
+// TunnelOpts represents options for opening a tunnel.
+type TunnelOpts struct {
+	// Remote is the address on the target. Connections to the local
+	// end of the tunnel are forwarded to it. For a reverse tunnel, it
+	// is the address the target listens on.
+	Remote string
+
+	// Local is the address the tunnel listens on. Defaults to
+	// TunnelDefaultLocal. For a reverse tunnel, it is the address
+	// connections are forwarded to and is required.
+	Local string
+
+	// Reverse forwards connections from the target to the local host.
+	Reverse bool
+}
+
+// Tunnel is an open tunnel. It is closed when Close is called or the
+// context it was opened with is done.
+type Tunnel struct {
+	// Local and Remote are the addresses of each end of the tunnel.
+	Local  string
+	Remote string
+
+	// Port is the port the tunnel listens on: the local port, or the
+	// remote port of a reverse tunnel.
+	Port int
+
+	listener net.Listener
+	dial     func() (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newTunnel returns a tunnel which accepts connections from listener
+// and forwards each to a connection made by dial. It is closed when
+// ctx is done.
+func newTunnel(ctx context.Context, listener net.Listener, dial func() (net.Conn, error), local, remote string) *Tunnel {
+	t := &Tunnel{
+		Local:    local,
+		Remote:   remote,
+		listener: listener,
+		dial:     dial,
+		conns:    make(map[net.Conn]bool),
+		stop:     make(chan struct{}),
+	}
+
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		t.Port = addr.Port
+	} else if _, port, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+		t.Port, _ = strconv.Atoi(port)
+	}
+
+	t.wg.Add(1)
+	go t.serve()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Close()
+		case <-t.stop:
+		}
+	}()
+
+	return t
+}
+
+// Close closes the tunnel and every connection through it.
+func (r *Tunnel) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.closed = true
+	close(r.stop)
+	err := r.listener.Close()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	return err
+}
+
+// serve accepts connections until the tunnel is closed.
+func (r *Tunnel) serve() {
+	defer r.wg.Done()
+
+	for {
+		c, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.forward(c)
+		}()
+	}
+}
+
+// forward copies data between c and a new connection to the other
+// end of the tunnel until either side is closed.
+func (r *Tunnel) forward(c net.Conn) {
+	defer c.Close()
+
+	if !r.track(c) {
+		return
+	}
+	defer r.untrack(c)
+
+	target, err := r.dial()
+	if err != nil {
+		return
+	}
+	defer target.Close()
+
+	if !r.track(target) {
+		return
+	}
+	defer r.untrack(target)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, c)
+		closeWrite(target)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, target)
+		closeWrite(c)
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
+
+// track adds a connection so it is closed with the tunnel. It reports
+// false if the tunnel is already closed.
+func (r *Tunnel) track(c net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.conns[c] = true
+
+	return true
+}
+
+// untrack removes a connection which has been closed.
+func (r *Tunnel) untrack(c net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, c)
+}
+
+// closeWrite closes the writing side of a connection, if it can be,
+// so the other side sees the end of the data.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+
+	c.Close()
+}
@@ -1,40 +1,83 @@
 package connections
 
 import (
+	"context"
 	"io"
 	"os"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 )
 
 // Connection is an interface which specifies what drivers
 // must implement.
+//
+// Each method which does work on the target takes a context. When
+// the context is cancelled, in-flight work is stopped and the method
+// returns an "interrupted" error.
 type Connection interface {
-	Connect() error
+	Connect(context.Context) error
 	Close()
 
-	RunCommand(RunOpts) (*RunResult, error)
-
-	FileInfo(FileOpts) (*FileResult, error)
-	FileDelete(FileOpts) (*FileResult, error)
-	FileUpload(CopyFileOpts) (*FileResult, error)
-	FileDownload(CopyFileOpts) (*FileResult, error)
+	RunCommand(context.Context, RunOpts) (*RunResult, error)
+
+	FileInfo(context.Context, FileOpts) (*FileResult, error)
+	FileDelete(context.Context, FileOpts) (*FileResult, error)
+	FileUpload(context.Context, CopyFileOpts) (*FileResult, error)
+	FileDownload(context.Context, CopyFileOpts) (*FileResult, error)
+
+	// MkdirAll creates Path and any missing parents. Chmod and Chown
+	// set the Mode and the UID and GID of Path. A UID or GID below 0
+	// is left as it is, here and in FileUpload. Rename moves Path to
+	// Target and Symlink creates a link at Path which points to Target.
+	// ReadFile and WriteFile read and write all of a file's Content,
+	// and RemoveAll deletes Path and everything below it.
+	MkdirAll(context.Context, FileOpts) (*FileResult, error)
+	Chmod(context.Context, FileOpts) (*FileResult, error)
+	Chown(context.Context, FileOpts) (*FileResult, error)
+	Rename(context.Context, FileOpts) (*FileResult, error)
+	Symlink(context.Context, FileOpts) (*FileResult, error)
+	ReadFile(context.Context, FileOpts) (*FileResult, error)
+	WriteFile(context.Context, FileOpts) (*FileResult, error)
+	RemoveAll(context.Context, FileOpts) (*FileResult, error)
+
+	// ReadDir describes the entries of the directory at Path.
+	ReadDir(context.Context, FileOpts) (*FileResult, error)
 }
 
 // RunOpts represents options for running commands.
 type RunOpts struct {
-	Command string
-	Timeout int
-	Log     *io.Writer
+	Command string `json:"command"`
+	Timeout int    `json:"timeout,omitempty"`
+
+	// Log, if set, receives each line of output as it is read,
+	// prefixed with "stdout: " or "stderr: ".
+	Log *io.Writer `json:"-"`
+
+	// Become, if set, runs the command as another user.
+	Become *Become `json:"become,omitempty"`
+
+	// Stdin, if set, is sent to the command as its standard input.
+	Stdin io.Reader `json:"-"`
+
+	// Stdout, if set, receives the command's standard output as it is
+	// read. RunResult.Stdout is then left empty.
+	Stdout io.Writer `json:"-"`
+
+	// Env sets environment variables for the command.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Dir is the directory to run the command in.
+	Dir string `json:"dir,omitempty"`
 }
 
 // RunResult respresents the result of an command execution.
 type RunResult struct {
-	ExitCode int
-	Stderr   string
-	Stdout   string
-	Timeout  bool
-	Applied  bool
+	ExitCode int    `json:"exit_code"`
+	Stderr   string `json:"stderr"`
+	Stdout   string `json:"stdout"`
+	Timeout  bool   `json:"timeout"`
+	Applied  bool   `json:"applied"`
 }
 
 // ToLTable converts a RunResult to a GopherLua table.
@@ -55,30 +98,59 @@ func (r RunResult) ToLTable(L *lua.LState) *lua.LTable {
 
 // CopyFileOpts represents options for copying files.
 type CopyFileOpts struct {
-	Source      string
-	Destination string
-	UID         int
-	GID         int
-	Mode        os.FileMode
-	Timeout     int
+	Source      string      `json:"source"`
+	Destination string      `json:"destination"`
+	UID         int         `json:"uid"`
+	GID         int         `json:"gid"`
+	Mode        os.FileMode `json:"mode"`
+	Timeout     int         `json:"timeout,omitempty"`
+	Become      *Become     `json:"become,omitempty"`
 }
 
 // FileOpts represents options for managing a generic file.
 type FileOpts struct {
-	Path    string
-	UID     int
-	GID     int
-	Mode    os.FileMode
-	Timeout int
+	Path    string      `json:"path"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	Mode    os.FileMode `json:"mode"`
+	Timeout int         `json:"timeout,omitempty"`
+	Become  *Become     `json:"become,omitempty"`
+
+	// Checksum, if set, has FileInfo calculate the SHA-256
+	// checksum of a regular file's contents.
+	Checksum bool `json:"checksum,omitempty"`
+
+	// Target is the new path for Rename and the path a link
+	// points to for Symlink.
+	Target string `json:"target,omitempty"`
+
+	// Content is the data written by WriteFile.
+	Content []byte `json:"content,omitempty"`
 }
 
 // FileResult represents the result of an file action.
 type FileResult struct {
-	Exists   bool
-	Success  bool
-	Timeout  bool
-	Applied  bool
-	FileInfo FileInfo
+	Exists   bool     `json:"exists"`
+	Success  bool     `json:"success"`
+	Timeout  bool     `json:"timeout"`
+	Applied  bool     `json:"applied"`
+	FileInfo FileInfo `json:"info"`
+
+	// Checksum is the SHA-256 checksum of a copied file and
+	// Verified reports whether the destination was checked
+	// against it.
+	Checksum string `json:"checksum,omitempty"`
+	Verified bool   `json:"verified,omitempty"`
+
+	// Content is the data read by ReadFile.
+	Content []byte `json:"content,omitempty"`
+
+	// Entries describes the contents of a directory read by
+	// ReadDir, sorted by name.
+	Entries []FileInfo `json:"entries,omitempty"`
+
+	// Changed lists the paths modified by a recursive copy.
+	Changed []string `json:"changed,omitempty"`
 }
 
 // ToLTable converts a FileResult to a GopherLua table.
@@ -90,17 +162,46 @@ func (r FileResult) ToLTable(L *lua.LState) *lua.LTable {
 	ret.RawSetString("applied", lua.LBool(r.Applied))
 	ret.RawSetString("info", r.FileInfo.ToLTable(L))
 
+	if r.Checksum != "" {
+		ret.RawSetString("checksum", lua.LString(r.Checksum))
+		ret.RawSetString("verified", lua.LBool(r.Verified))
+	}
+
+	if r.Changed != nil {
+		changed := L.NewTable()
+		for _, p := range r.Changed {
+			changed.Append(lua.LString(p))
+		}
+		ret.RawSetString("changed", changed)
+	}
+
 	return ret
 }
 
-// FileInfo represents information about a file.
+// FileInfo represents information about a file. Symlinks are not
+// followed, so the information is about the link itself.
 type FileInfo struct {
-	Name string
-	UID  int
-	GID  int
-	Type string
-	Size int64
-	Mode int
+	Name string `json:"name"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Mode int    `json:"mode"`
+
+	// Owner and Group are the names of the UID and GID. They are
+	// empty if the names could not be found.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// ModTime is the time the file was last modified.
+	ModTime time.Time `json:"mtime"`
+
+	// LinkTarget is the target of a symlink.
+	LinkTarget string `json:"link_target,omitempty"`
+
+	// Checksum is the SHA-256 checksum of a regular file. It is only
+	// set if it was requested.
+	Checksum string `json:"checksum,omitempty"`
 }
 
 func (r FileInfo) ToLTable(L *lua.LState) *lua.LTable {
@@ -112,6 +213,20 @@ func (r FileInfo) ToLTable(L *lua.LState) *lua.LTable {
 	ret.RawSetString("type", lua.LString(r.Type))
 	ret.RawSetString("size", lua.LNumber(r.Size))
 	ret.RawSetString("mode", lua.LNumber(r.Mode))
+	ret.RawSetString("owner", lua.LString(r.Owner))
+	ret.RawSetString("group", lua.LString(r.Group))
+
+	if !r.ModTime.IsZero() {
+		ret.RawSetString("mtime", lua.LNumber(r.ModTime.Unix()))
+	}
+
+	if r.LinkTarget != "" {
+		ret.RawSetString("link_target", lua.LString(r.LinkTarget))
+	}
+
+	if r.Checksum != "" {
+		ret.RawSetString("checksum", lua.LString(r.Checksum))
+	}
 
 	return ret
 }
@@ -2,8 +2,17 @@ package connections
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -15,22 +24,43 @@ const (
 	maxBackoffDelay     = 10 * time.Second
 )
 
+// permanentError is implemented by errors which retryFunc should
+// give up on immediately.
+type permanentError interface {
+	Permanent() bool
+}
+
+// isPermanent reports whether an error, or an error it wraps,
+// is a permanentError.
+func isPermanent(err error) bool {
+	var pErr permanentError
+	if errors.As(err, &pErr) {
+		return pErr.Permanent()
+	}
+
+	return false
+}
+
 // Based off of Terraform's remote and local provisioners.
-func printOutput(output io.Writer, r io.Reader, doneCh chan<- struct{}) {
+// Each line is written to output as it arrives, prefixed with
+// the name of the stream it was read from.
+func printOutput(output io.Writer, stream string, r io.Reader, doneCh chan<- struct{}) {
 	defer close(doneCh)
 
 	lr := linereader.New(r)
 	for line := range lr.Ch {
-		fmt.Fprintln(output, line)
+		fmt.Fprintf(output, "%s: %s\n", stream, line)
 	}
 }
 
 // Based off of Terraform's remote-exec provisioner.
 // This will run a function one time. If the length of time
-// specified as `timeout` is reached, the function is cancelled.
-func timeoutFunc(timeout int, f func() error) error {
+// specified as `timeout` is reached or ctx is cancelled, the
+// context passed to the function is cancelled and an error of
+// "timeout" or "interrupted" is returned without waiting for it.
+func timeoutFunc(ctx context.Context, timeout int, f func(context.Context) error) error {
 	t := time.Duration(timeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), t)
+	ctx, cancel := context.WithTimeout(ctx, t)
 	defer cancel()
 
 	type errWrap struct {
@@ -41,7 +71,7 @@ func timeoutFunc(timeout int, f func() error) error {
 	doneCh := make(chan struct{})
 	go func() {
 		defer close(doneCh)
-		err := f()
+		err := f(ctx)
 		errVal.Store(&errWrap{err})
 		return
 	}()
@@ -68,10 +98,11 @@ func timeoutFunc(timeout int, f func() error) error {
 // Again, based off of Terraform's remote-exec provisioner.
 // This will retry a function several times until a timeout
 // is reached. Each attempt of the function will be delayed
-// incrementally.
-func retryFunc(timeout int, f func() error) error {
+// incrementally. The context passed to the function is
+// cancelled if the timeout is reached or ctx is cancelled.
+func retryFunc(ctx context.Context, timeout int, f func(context.Context) error) error {
 	t := time.Duration(timeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), t)
+	ctx, cancel := context.WithTimeout(ctx, t)
 	defer cancel()
 
 	type errWrap struct {
@@ -92,10 +123,10 @@ func retryFunc(timeout int, f func() error) error {
 			case <-time.After(delay):
 			}
 
-			err := f()
+			err := f(ctx)
 			errVal.Store(&errWrap{err})
 
-			if err == nil {
+			if err == nil || isPermanent(err) {
 				return
 			}
 
@@ -128,3 +159,123 @@ func retryFunc(timeout int, f func() error) error {
 
 	return nil
 }
+
+// shellQuote quotes a string so a POSIX shell treats it as
+// a single literal word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// checksum returns the hex encoded SHA-256 checksum of the contents of r.
+func checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tempName returns a hidden, randomly named file name based on name
+// for staging a file before it is renamed into place.
+func tempName(name string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf(".%s.bagel-%s", name, hex.EncodeToString(b))
+}
+
+// contextReader is a reader which fails with the context's error
+// once the context is done, stopping a copy part way through.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// envNameRe matches valid environment variable names.
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envList returns env as a sorted list of KEY=value pairs. It returns
+// an error if a name is not a valid environment variable name.
+func envList(env map[string]string) ([]string, error) {
+	var list []string
+	for k, v := range env {
+		if !envNameRe.MatchString(k) {
+			return nil, fmt.Errorf("invalid environment variable name: %q", k)
+		}
+
+		list = append(list, k+"="+v)
+	}
+
+	sort.Strings(list)
+
+	return list, nil
+}
+
+// wrapCommand prefixes a command with shell commands which change to
+// dir and export env. It is used when the connection can't set them
+// natively, such as when the command is run as another user.
+func wrapCommand(command, dir string, env map[string]string) (string, error) {
+	list, err := envList(env)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	if dir != "" {
+		lines = append(lines, fmt.Sprintf("cd -- %s || exit", shellQuote(dir)))
+	}
+
+	for _, kv := range list {
+		i := strings.Index(kv, "=")
+		lines = append(lines, fmt.Sprintf("export %s=%s", kv[:i], shellQuote(kv[i+1:])))
+	}
+
+	lines = append(lines, command)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// fileType returns the type of a file from its mode.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "char_device"
+	case mode&os.ModeDevice != 0:
+		return "block_device"
+	}
+
+	return "file"
+}
+
+// fileMode returns the permissions of a mode as the decimal number
+// with the same digits as its octal value, so 0644 becomes 644.
+func fileMode(mode os.FileMode) int {
+	m, _ := strconv.Atoi(fmt.Sprintf("%o", int(mode.Perm())))
+	return m
+}
+
+// ownerNamesCommand returns a shell command which prints the names of
+// a UID and GID separated by a "|". getent is used so directory users
+// are found, with /etc/passwd and /etc/group as a fallback.
+func ownerNamesCommand(uid, gid int) string {
+	return fmt.Sprintf(`u=$(getent passwd %[1]d 2>/dev/null || awk -F: '$3 == %[1]d' /etc/passwd); `+
+		`g=$(getent group %[2]d 2>/dev/null || awk -F: '$3 == %[2]d' /etc/group); `+
+		`echo "${u%%%%:*}|${g%%%%:*}"`, uid, gid)
+}
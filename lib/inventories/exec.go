@@ -0,0 +1,337 @@
+package inventories
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const ExecDefaultTimeout = 60
+
+// Exec represents an exec inventory driver. It runs a command which
+// prints the inventory as JSON, either in the format of an Ansible
+// dynamic inventory script or as a list of hosts.
+type Exec struct {
+	Command string   `mapstructure:"command" required:"true"`
+	Args    []string `mapstructure:"args"`
+	Timeout int      `mapstructure:"timeout"`
+}
+
+// execHost is a host in a list printed by a command. It has the same
+// fields as a host in a structured inventory.
+type execHost struct {
+	Name string `json:"name"`
+	structuredHost
+}
+
+// ansibleGroup is a group of an Ansible dynamic inventory.
+type ansibleGroup struct {
+	Hosts    []string               `json:"hosts"`
+	Vars     map[string]interface{} `json:"vars"`
+	Children []string               `json:"children"`
+}
+
+// ansibleMeta is the _meta entry of an Ansible dynamic inventory.
+type ansibleMeta struct {
+	HostVars map[string]map[string]interface{} `json:"hostvars"`
+}
+
+// NewExec will return an Exec.
+func NewExec(options map[string]interface{}) (*Exec, error) {
+	var e Exec
+
+	err := utils.DecodeAndValidate(options, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Args == nil {
+		e.Args = []string{"--list"}
+	}
+
+	if e.Timeout == 0 {
+		e.Timeout = ExecDefaultTimeout
+	}
+
+	return &e, nil
+}
+
+// Discover implements the Inventory interface for an exec driver.
+// It returns the hosts printed by the command sorted by name.
+func (r Exec) Discover() ([]Target, error) {
+	out, err := r.run(r.Args...)
+	if err != nil {
+		return nil, err
+	}
+
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && out[0] == '[' {
+		return r.parseList(out)
+	}
+
+	return r.parseAnsible(out)
+}
+
+// run runs the command with args and returns its output.
+func (r Exec) run(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.Command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out running %s", r.Command)
+		}
+
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("unable to run %s: %s: %s", r.Command, err, msg)
+		}
+
+		return nil, fmt.Errorf("unable to run %s: %s", r.Command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// parseList parses a list of hosts. Each host is either a name or an
+// object like a host of a structured inventory with a name.
+func (r Exec) parseList(out []byte) ([]Target, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of %s: %s", r.Command, err)
+	}
+
+	var targets []Target
+	for i, entry := range entries {
+		var host execHost
+
+		if err := json.Unmarshal(entry, &host.Name); err != nil {
+			if err := json.Unmarshal(entry, &host); err != nil {
+				return nil, fmt.Errorf("unable to parse host %d in the output of %s: %s", i, r.Command, err)
+			}
+		}
+
+		if host.Name == "" {
+			return nil, fmt.Errorf("host %d in the output of %s is missing a name", i, r.Command)
+		}
+
+		target := Target{
+			Name:              host.Name,
+			Address:           host.Address,
+			Groups:            host.Groups,
+			Vars:              make(map[string]interface{}),
+			ConnectionOptions: connectionOverrides(host.User, host.Port, host.Key),
+		}
+
+		if target.Address == "" {
+			target.Address = host.Name
+		}
+
+		for k, v := range host.Vars {
+			target.Vars[k] = v
+		}
+
+		targets = append(targets, target)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Name < targets[j].Name
+	})
+
+	return targets, nil
+}
+
+// parseAnsible parses an Ansible dynamic inventory. A host is in each
+// group which lists it and in the parents of those groups. Its vars
+// are those of the all group, then of its groups from parent to child
+// and then its host vars. If there is no _meta entry, the command is
+// run with --host for the vars of each host.
+func (r Exec) parseAnsible(out []byte) ([]Target, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of %s: %s", r.Command, err)
+	}
+
+	var meta *ansibleMeta
+	groups := make(map[string]ansibleGroup)
+	for name, data := range raw {
+		if name == "_meta" {
+			meta = &ansibleMeta{}
+			if err := json.Unmarshal(data, meta); err != nil {
+				return nil, fmt.Errorf("unable to parse _meta in the output of %s: %s", r.Command, err)
+			}
+			continue
+		}
+
+		// A group can also be just a list of hosts.
+		var group ansibleGroup
+		if err := json.Unmarshal(data, &group.Hosts); err != nil {
+			if err := json.Unmarshal(data, &group); err != nil {
+				return nil, fmt.Errorf("unable to parse group %s in the output of %s: %s", name, r.Command, err)
+			}
+		}
+
+		groups[name] = group
+	}
+
+	parents := make(map[string][]string)
+	for name, group := range groups {
+		for _, child := range group.Children {
+			parents[child] = append(parents[child], name)
+		}
+	}
+
+	// Each host is in the groups which list it and their ancestors.
+	hostGroups := make(map[string]map[string]bool)
+	for name, group := range groups {
+		for _, host := range group.Hosts {
+			if hostGroups[host] == nil {
+				hostGroups[host] = make(map[string]bool)
+			}
+
+			addAncestors(hostGroups[host], name, parents)
+		}
+	}
+
+	depths := make(map[string]int)
+	for name := range groups {
+		groupDepth(name, parents, depths, make(map[string]bool))
+	}
+
+	names := make([]string, 0, len(hostGroups))
+	for name := range hostGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var targets []Target
+	for _, name := range names {
+		var memberOf []string
+		for group := range hostGroups[name] {
+			if group != "all" && group != "ungrouped" {
+				memberOf = append(memberOf, group)
+			}
+		}
+
+		sort.Slice(memberOf, func(i, j int) bool {
+			a, b := memberOf[i], memberOf[j]
+			if depths[a] != depths[b] {
+				return depths[a] < depths[b]
+			}
+			return a < b
+		})
+
+		vars := make(map[string]interface{})
+		for k, v := range groups["all"].Vars {
+			vars[k] = v
+		}
+
+		for _, group := range memberOf {
+			for k, v := range groups[group].Vars {
+				vars[k] = v
+			}
+		}
+
+		var hostVars map[string]interface{}
+		if meta != nil {
+			hostVars = meta.HostVars[name]
+		} else {
+			out, err := r.run("--host", name)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := json.Unmarshal(out, &hostVars); err != nil {
+				return nil, fmt.Errorf("unable to parse the vars of %s in the output of %s: %s", name, r.Command, err)
+			}
+		}
+
+		for k, v := range hostVars {
+			vars[k] = v
+		}
+
+		sort.Strings(memberOf)
+
+		target := Target{
+			Name:    name,
+			Address: name,
+			Groups:  memberOf,
+			Vars:    vars,
+		}
+
+		if v, ok := vars["ansible_host"].(string); ok && v != "" {
+			target.Address = v
+		}
+
+		var user, key string
+		var port int
+		if v, ok := vars["ansible_user"].(string); ok {
+			user = v
+		}
+
+		switch v := vars["ansible_port"].(type) {
+		case float64:
+			port = int(v)
+		case string:
+			port, _ = strconv.Atoi(v)
+		}
+
+		if v, ok := vars["ansible_ssh_private_key_file"].(string); ok {
+			key = v
+		}
+
+		target.ConnectionOptions = connectionOverrides(user, port, key)
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// addAncestors adds a group and each of its ancestors to set.
+func addAncestors(set map[string]bool, group string, parents map[string][]string) {
+	if set[group] {
+		return
+	}
+
+	set[group] = true
+	for _, parent := range parents[group] {
+		addAncestors(set, parent, parents)
+	}
+}
+
+// groupDepth returns how many levels of parents a group has. A loop
+// of groups is cut where it is found.
+func groupDepth(group string, parents map[string][]string, depths map[string]int, visiting map[string]bool) int {
+	if d, ok := depths[group]; ok {
+		return d
+	}
+
+	if visiting[group] {
+		return 0
+	}
+	visiting[group] = true
+
+	depth := 0
+	for _, parent := range parents[group] {
+		if d := groupDepth(parent, parents, depths, visiting) + 1; d > depth {
+			depth = d
+		}
+	}
+
+	depths[group] = depth
+
+	return depth
+}
@@ -2,6 +2,10 @@ package inventories
 
 import (
 	"fmt"
+
+	"github.com/yuin/gopher-lua"
+
+	"github.com/jtopjian/bagel/lib/utils"
 )
 
 // Inventory is an interface which specifies what inventory drivers
@@ -17,6 +21,38 @@ type Target struct {
 	ConnectionName    string
 	ConnectionType    string
 	ConnectionOptions map[string]interface{}
+	InventoryName     string
+
+	// Groups are the groups the target is a member of.
+	Groups []string
+
+	// Vars are arbitrary variables of the target, including those
+	// inherited from its groups.
+	Vars map[string]interface{}
+}
+
+// ToLTable converts a Target to a read-only GopherLua table. The
+// connection options are left out since they may hold secrets.
+func (r Target) ToLTable(L *lua.LState) *lua.LTable {
+	groups := r.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+
+	vars := r.Vars
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+
+	return utils.NewReadOnlyTable(L, "target", map[string]interface{}{
+		"name":            r.Name,
+		"address":         r.Address,
+		"groups":          groups,
+		"vars":            vars,
+		"connection_name": r.ConnectionName,
+		"connection_type": r.ConnectionType,
+		"inventory":       r.InventoryName,
+	})
 }
 
 // New will return a target based on a given target driver.
@@ -28,6 +64,12 @@ func New(inventoryType string, options map[string]interface{}) (Inventory, error
 	switch inventoryType {
 	case "textfile":
 		return NewTextFile(options)
+	case "exec":
+		return NewExec(options)
+	case "terraform":
+		return NewTerraform(options)
+	case "yaml", "json":
+		return NewStructured(inventoryType, options)
 	default:
 		return nil, fmt.Errorf("unsupported inventory type: %s", inventoryType)
 	}
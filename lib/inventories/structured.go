@@ -0,0 +1,175 @@
+package inventories
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+// Structured represents a yaml or json inventory driver.
+type Structured struct {
+	File string `mapstructure:"file" required:"true"`
+
+	// Format is either yaml or json.
+	Format string
+}
+
+// structuredFile is the layout of a yaml or json inventory file.
+type structuredFile struct {
+	Groups map[string]structuredGroup `yaml:"groups" json:"groups"`
+	Hosts  map[string]structuredHost  `yaml:"hosts" json:"hosts"`
+}
+
+// structuredGroup is a group of hosts in a structured inventory.
+type structuredGroup struct {
+	Vars map[string]interface{} `yaml:"vars" json:"vars"`
+}
+
+// structuredHost is a host in a structured inventory.
+type structuredHost struct {
+	Address string                 `yaml:"address" json:"address"`
+	Groups  []string               `yaml:"groups" json:"groups"`
+	Vars    map[string]interface{} `yaml:"vars" json:"vars"`
+
+	// User, Port and Key override the connection options of the
+	// inventory for this host.
+	User string `yaml:"user" json:"user"`
+	Port int    `yaml:"port" json:"port"`
+	Key  string `yaml:"key" json:"key"`
+}
+
+// NewStructured will return a Structured of the given format.
+func NewStructured(format string, options map[string]interface{}) (*Structured, error) {
+	var structured Structured
+
+	err := utils.DecodeAndValidate(options, &structured)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != "yaml" && format != "json" {
+		return nil, fmt.Errorf("unsupported structured inventory format: %s", format)
+	}
+	structured.Format = format
+
+	if _, err := os.Stat(structured.File); os.IsNotExist(err) {
+		return nil, fmt.Errorf("file %s does not exist", structured.File)
+	}
+
+	return &structured, nil
+}
+
+// Discover implements the Inventory interface for a structured
+// driver. It returns the hosts of the file sorted by name. A host's
+// vars are the vars of each of its groups, in order, and then its own.
+func (r Structured) Discover() ([]Target, error) {
+	data, err := ioutil.ReadFile(r.File)
+	if err != nil {
+		return nil, err
+	}
+
+	var file structuredFile
+	if r.Format == "json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", r.File, err)
+	}
+
+	names := make([]string, 0, len(file.Hosts))
+	for name := range file.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var targets []Target
+	for _, name := range names {
+		host := file.Hosts[name]
+
+		target := Target{
+			Name:    name,
+			Address: host.Address,
+			Groups:  host.Groups,
+			Vars:    make(map[string]interface{}),
+		}
+
+		if target.Address == "" {
+			target.Address = name
+		}
+
+		for _, group := range host.Groups {
+			for k, v := range file.Groups[group].Vars {
+				target.Vars[k] = stringMapValue(v)
+			}
+		}
+
+		for k, v := range host.Vars {
+			target.Vars[k] = stringMapValue(v)
+		}
+
+		target.ConnectionOptions = connectionOverrides(host.User, host.Port, host.Key)
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// connectionOverrides returns the connection options a host sets, or
+// nil if it sets none.
+func connectionOverrides(user string, port int, key string) map[string]interface{} {
+	options := make(map[string]interface{})
+	if user != "" {
+		options["user"] = user
+	}
+
+	if port != 0 {
+		options["port"] = port
+	}
+
+	if key != "" {
+		options["private_key"] = key
+	}
+
+	if len(options) == 0 {
+		return nil
+	}
+
+	return options
+}
+
+// stringMapValue converts the maps YAML decodes to maps with string
+// keys so vars can be used from Lua.
+func stringMapValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = stringMapValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = stringMapValue(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = stringMapValue(val)
+		}
+		return s
+	}
+
+	return v
+}
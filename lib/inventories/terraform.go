@@ -0,0 +1,233 @@
+package inventories
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+// TerraformStateVersion is the version of the state format which
+// can be read.
+const TerraformStateVersion = 4
+
+// terraformDefaultVars are the attributes whose maps become the vars
+// of a host if a resource doesn't set vars.
+var terraformDefaultVars = []string{"metadata", "tags"}
+
+// Terraform represents a terraform inventory driver.
+type Terraform struct {
+	File      string              `mapstructure:"file" required:"true"`
+	Hosts     []string            `mapstructure:"hosts"`
+	Resources []TerraformResource `mapstructure:"resources"`
+}
+
+// TerraformResource describes how to read hosts from the instances
+// of a resource type. Each field besides Type is the path to an
+// attribute, such as network.0.fixed_ip_v4.
+type TerraformResource struct {
+	Type    string `mapstructure:"type" required:"true"`
+	Address string `mapstructure:"address" required:"true"`
+	Name    string `mapstructure:"name"`
+	Groups  string `mapstructure:"groups"`
+	Vars    string `mapstructure:"vars"`
+}
+
+// terraformState is the part of a state file which is read.
+type terraformState struct {
+	Version   int `json:"version"`
+	Resources []struct {
+		Module    string `json:"module"`
+		Mode      string `json:"mode"`
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Instances []struct {
+			IndexKey   interface{}            `json:"index_key"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"instances"`
+	} `json:"resources"`
+}
+
+// NewTerraform will return a Terraform.
+func NewTerraform(options map[string]interface{}) (*Terraform, error) {
+	var terraform Terraform
+
+	err := utils.DecodeAndValidate(options, &terraform)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each host is short for a resource with only a type and an
+	// address.
+	for _, host := range terraform.Hosts {
+		parts := strings.SplitN(host, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("hosts entry %s must be in the form of type.attribute", host)
+		}
+
+		terraform.Resources = append(terraform.Resources, TerraformResource{
+			Type:    parts[0],
+			Address: parts[1],
+		})
+	}
+
+	if len(terraform.Resources) == 0 {
+		return nil, fmt.Errorf("at least one of hosts or resources is required")
+	}
+
+	for i, resource := range terraform.Resources {
+		if resource.Type == "" || resource.Address == "" {
+			return nil, fmt.Errorf("resources entry %d requires a type and an address", i)
+		}
+	}
+
+	if _, err := os.Stat(terraform.File); os.IsNotExist(err) {
+		return nil, fmt.Errorf("file %s does not exist", terraform.File)
+	}
+
+	return &terraform, nil
+}
+
+// Discover implements the Inventory interface for a terraform driver.
+// It returns a host for each instance of a managed resource which
+// matches a configured type and has an address, in the order of the
+// state file. Instances without an address, such as ones which are
+// still being created, are skipped.
+func (r Terraform) Discover() ([]Target, error) {
+	data, err := ioutil.ReadFile(r.File)
+	if err != nil {
+		return nil, err
+	}
+
+	var state terraformState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", r.File, err)
+	}
+
+	if state.Version != TerraformStateVersion {
+		return nil, fmt.Errorf("unsupported state version in %s: %d", r.File, state.Version)
+	}
+
+	var targets []Target
+	for _, resource := range state.Resources {
+		if resource.Mode != "managed" {
+			continue
+		}
+
+		for _, tr := range r.Resources {
+			if tr.Type != resource.Type {
+				continue
+			}
+
+			for _, instance := range resource.Instances {
+				address, _ := terraformAttribute(instance.Attributes, tr.Address).(string)
+				if address == "" {
+					continue
+				}
+
+				target := Target{
+					Name:    terraformInstanceAddress(resource.Module, resource.Type, resource.Name, instance.IndexKey),
+					Address: address,
+					Vars:    make(map[string]interface{}),
+				}
+
+				if tr.Name != "" {
+					name, ok := terraformAttribute(instance.Attributes, tr.Name).(string)
+					if !ok || name == "" {
+						return nil, fmt.Errorf("%s has no %s attribute to use as its name", target.Name, tr.Name)
+					}
+					target.Name = name
+				}
+
+				if tr.Groups != "" {
+					target.Groups = terraformGroups(terraformAttribute(instance.Attributes, tr.Groups))
+				}
+
+				varPaths := terraformDefaultVars
+				if tr.Vars != "" {
+					varPaths = []string{tr.Vars}
+				}
+
+				for _, path := range varPaths {
+					if vars, ok := terraformAttribute(instance.Attributes, path).(map[string]interface{}); ok {
+						for k, v := range vars {
+							target.Vars[k] = v
+						}
+					}
+				}
+
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// terraformAttribute returns the value at a path of attributes, or
+// nil if there is none. Each part of the path is a key of a map or
+// an index of a list.
+func terraformAttribute(attributes map[string]interface{}, path string) interface{} {
+	var v interface{} = attributes
+	for _, part := range strings.Split(path, ".") {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			v = value[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil
+			}
+			v = value[i]
+		default:
+			return nil
+		}
+	}
+
+	return v
+}
+
+// terraformGroups converts an attribute to a list of groups. It can be
+// a list or a comma separated string.
+func terraformGroups(v interface{}) []string {
+	var groups []string
+
+	switch value := v.(type) {
+	case []interface{}:
+		for _, g := range value {
+			if s, ok := g.(string); ok && s != "" {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		for _, g := range strings.Split(value, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	return groups
+}
+
+// terraformInstanceAddress returns the address Terraform uses for an
+// instance, such as module.web.aws_instance.web[0].
+func terraformInstanceAddress(module, resourceType, name string, indexKey interface{}) string {
+	address := fmt.Sprintf("%s.%s", resourceType, name)
+	if module != "" {
+		address = fmt.Sprintf("%s.%s", module, address)
+	}
+
+	switch key := indexKey.(type) {
+	case float64:
+		address = fmt.Sprintf("%s[%d]", address, int(key))
+	case string:
+		address = fmt.Sprintf("%s[%q]", address, key)
+	}
+
+	return address
+}
@@ -0,0 +1,183 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/inventories"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExec_Ansible(t *testing.T) {
+	options := map[string]interface{}{
+		"command": "fixtures/ansible.sh",
+	}
+
+	e, err := inventories.New("exec", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "db01",
+			Address: "db01",
+			Groups:  []string{"db"},
+			Vars: map[string]interface{}{
+				"ntp_server": "ntp.example.com",
+				"http_port":  float64(5432),
+			},
+		},
+		inventories.Target{
+			Name:    "web01",
+			Address: "192.168.100.1",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"ntp_server":                   "ntp.example.com",
+				"http_port":                    float64(8080),
+				"tier":                         "frontend",
+				"ansible_host":                 "192.168.100.1",
+				"ansible_user":                 "ubuntu",
+				"ansible_port":                 float64(2222),
+				"ansible_ssh_private_key_file": "/home/ubuntu/.ssh/id_ed25519",
+			},
+			ConnectionOptions: map[string]interface{}{
+				"user":        "ubuntu",
+				"port":        2222,
+				"private_key": "/home/ubuntu/.ssh/id_ed25519",
+			},
+		},
+		inventories.Target{
+			Name:    "web02",
+			Address: "web02",
+			Groups:  []string{"canary", "web"},
+			Vars: map[string]interface{}{
+				"ntp_server": "ntp.example.com",
+				"http_port":  float64(8080),
+				"tier":       "canary",
+			},
+		},
+	}
+
+	actual, err := e.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestExec_AnsibleNoMeta(t *testing.T) {
+	options := map[string]interface{}{
+		"command": "fixtures/nometa.sh",
+	}
+
+	e, err := inventories.New("exec", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "web01",
+			Address: "192.168.100.1",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"tier":         "frontend",
+				"ansible_host": "192.168.100.1",
+				"ansible_port": "2222",
+			},
+			ConnectionOptions: map[string]interface{}{
+				"port": 2222,
+			},
+		},
+		inventories.Target{
+			Name:    "web02",
+			Address: "web02",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"tier": "frontend",
+			},
+		},
+	}
+
+	actual, err := e.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestExec_List(t *testing.T) {
+	options := map[string]interface{}{
+		"command": "fixtures/list.sh",
+		"args":    []string{},
+	}
+
+	e, err := inventories.New("exec", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "host1.example.com",
+			Address: "host1.example.com",
+			Vars:    map[string]interface{}{},
+		},
+		inventories.Target{
+			Name:    "web01",
+			Address: "192.168.100.1",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"tier": "frontend",
+			},
+			ConnectionOptions: map[string]interface{}{
+				"user": "ubuntu",
+			},
+		},
+	}
+
+	actual, err := e.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestExec_Errors(t *testing.T) {
+	e, err := inventories.New("exec", map[string]interface{}{
+		"command": "fixtures/nometa.sh",
+		"args":    []string{"--bad"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.Discover()
+	assert.EqualError(t, err, "unable to run fixtures/nometa.sh: exit status 1: usage: fixtures/nometa.sh --list | --host <host>")
+
+	e, err = inventories.New("exec", map[string]interface{}{
+		"command": "fixtures/hosts.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.Discover()
+	assert.Error(t, err)
+
+	e, err = inventories.New("exec", map[string]interface{}{
+		"command": "sleep",
+		"args":    []string{"5"},
+		"timeout": 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.Discover()
+	assert.EqualError(t, err, "timed out running sleep")
+}
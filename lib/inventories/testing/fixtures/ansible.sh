@@ -0,0 +1,31 @@
+#!/bin/sh
+# An Ansible dynamic inventory script with a _meta entry.
+cat <<'JSON'
+{
+  "all": {
+    "vars": {"ntp_server": "ntp.example.com", "http_port": 80},
+    "children": ["web", "db"]
+  },
+  "web": {
+    "hosts": ["web01", "web02"],
+    "vars": {"http_port": 8080, "tier": "frontend"},
+    "children": ["canary"]
+  },
+  "canary": {
+    "hosts": ["web02"],
+    "vars": {"tier": "canary"}
+  },
+  "db": ["db01"],
+  "_meta": {
+    "hostvars": {
+      "web01": {
+        "ansible_host": "192.168.100.1",
+        "ansible_user": "ubuntu",
+        "ansible_port": 2222,
+        "ansible_ssh_private_key_file": "/home/ubuntu/.ssh/id_ed25519"
+      },
+      "db01": {"http_port": 5432}
+    }
+  }
+}
+JSON
@@ -0,0 +1,14 @@
+#!/bin/sh
+# A list of hosts.
+cat <<'JSON'
+[
+  "host1.example.com",
+  {
+    "name": "web01",
+    "address": "192.168.100.1",
+    "groups": ["web"],
+    "user": "ubuntu",
+    "vars": {"tier": "frontend"}
+  }
+]
+JSON
@@ -0,0 +1,18 @@
+#!/bin/sh
+# An Ansible dynamic inventory script without a _meta entry.
+case "$1" in
+--list)
+  echo '{"web": {"hosts": ["web01", "web02"], "vars": {"tier": "frontend"}}}'
+  ;;
+--host)
+  if [ "$2" = "web01" ]; then
+    echo '{"ansible_host": "192.168.100.1", "ansible_port": "2222"}'
+  else
+    echo '{}'
+  fi
+  ;;
+*)
+  echo "usage: $0 --list | --host <host>" >&2
+  exit 1
+  ;;
+esac
@@ -0,0 +1,122 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/inventories"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructured_YAML(t *testing.T) {
+	options := map[string]interface{}{
+		"file": "fixtures/hosts.yaml",
+	}
+
+	yaml, err := inventories.New("yaml", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "db01.example.com",
+			Address: "db01.example.com",
+			Vars: map[string]interface{}{
+				"primary": true,
+			},
+		},
+		inventories.Target{
+			Name:    "web01",
+			Address: "192.168.100.1",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"http_port": 80,
+				"tier":      "frontend",
+				"backends":  []interface{}{"app01", "app02"},
+			},
+		},
+		inventories.Target{
+			Name:    "web02",
+			Address: "192.168.100.2",
+			Groups:  []string{"web", "canary"},
+			Vars: map[string]interface{}{
+				"http_port": 8080,
+				"tier":      "edge",
+				"limits": map[string]interface{}{
+					"connections": 100,
+				},
+			},
+			ConnectionOptions: map[string]interface{}{
+				"user":        "ubuntu",
+				"port":        2222,
+				"private_key": "/home/ubuntu/.ssh/id_ed25519",
+			},
+		},
+	}
+
+	actual, err := yaml.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestStructured_JSON(t *testing.T) {
+	options := map[string]interface{}{
+		"file": "fixtures/hosts.json",
+	}
+
+	json, err := inventories.New("json", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "db01.example.com",
+			Address: "db01.example.com",
+			Vars: map[string]interface{}{
+				"primary": true,
+			},
+		},
+		inventories.Target{
+			Name:    "web01",
+			Address: "192.168.100.1",
+			Groups:  []string{"web"},
+			Vars: map[string]interface{}{
+				"http_port": float64(80),
+				"tier":      "frontend",
+			},
+			ConnectionOptions: map[string]interface{}{
+				"user": "ubuntu",
+			},
+		},
+	}
+
+	actual, err := json.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestStructured_Errors(t *testing.T) {
+	_, err := inventories.New("yaml", map[string]interface{}{
+		"file": "fixtures/missing.yaml",
+	})
+	assert.EqualError(t, err, "file fixtures/missing.yaml does not exist")
+
+	json, err := inventories.New("json", map[string]interface{}{
+		"file": "fixtures/hosts.yaml",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = json.Discover()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to parse fixtures/hosts.yaml")
+}
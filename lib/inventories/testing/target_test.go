@@ -0,0 +1,102 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+
+	"github.com/jtopjian/bagel/lib/inventories"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarget_ToLTable(t *testing.T) {
+	target := inventories.Target{
+		Name:           "web01",
+		Address:        "192.168.100.1",
+		ConnectionName: "ssh",
+		ConnectionType: "ssh",
+		ConnectionOptions: map[string]interface{}{
+			"password": "secret",
+		},
+		InventoryName: "my_nodes",
+		Groups:        []string{"web", "canary"},
+		Vars: map[string]interface{}{
+			"http_port": 80,
+			"backends":  []interface{}{"app01", "app02"},
+			"limits": map[string]interface{}{
+				"connections": 100,
+			},
+		},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("target", target.ToLTable(L))
+
+	script := `
+		name = target.name
+		address = target.address
+		inventory = target.inventory
+		connection = target.connection_name .. "/" .. target.connection_type
+		password = target.connection_options
+
+		groups = table.concat(target.groups, ",")
+		group_count = #target.groups
+		http_port = target.vars.http_port
+		backend = target.vars.backends[2]
+		connections = target.vars.limits.connections
+
+		vars = 0
+		for k, v in pairs(target.vars) do
+			vars = vars + 1
+		end
+
+		-- Changes to a copy aren't kept.
+		local v = target.vars
+		v.http_port = 8080
+		kept_port = target.vars.http_port
+	`
+
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "web01", L.GetGlobal("name").String())
+	assert.Equal(t, "192.168.100.1", L.GetGlobal("address").String())
+	assert.Equal(t, "my_nodes", L.GetGlobal("inventory").String())
+	assert.Equal(t, "ssh/ssh", L.GetGlobal("connection").String())
+	assert.Equal(t, lua.LNil, L.GetGlobal("password"))
+	assert.Equal(t, "web,canary", L.GetGlobal("groups").String())
+	assert.Equal(t, lua.LNumber(2), L.GetGlobal("group_count"))
+	assert.Equal(t, lua.LNumber(80), L.GetGlobal("http_port"))
+	assert.Equal(t, "app02", L.GetGlobal("backend").String())
+	assert.Equal(t, lua.LNumber(100), L.GetGlobal("connections"))
+	assert.Equal(t, lua.LNumber(3), L.GetGlobal("vars"))
+	assert.Equal(t, lua.LNumber(80), L.GetGlobal("kept_port"))
+
+	err := L.DoString(`target.name = "web02"`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "target is read-only")
+
+	err = L.DoString(`setmetatable(target, nil)`)
+	assert.Error(t, err)
+}
+
+func TestTarget_ToLTableEmpty(t *testing.T) {
+	target := inventories.Target{
+		Name:    "host1.example.com",
+		Address: "host1.example.com",
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("target", target.ToLTable(L))
+
+	if err := L.DoString(`groups = #target.groups; vars = next(target.vars)`); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, lua.LNumber(0), L.GetGlobal("groups"))
+	assert.Equal(t, lua.LNil, L.GetGlobal("vars"))
+}
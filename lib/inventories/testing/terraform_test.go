@@ -0,0 +1,143 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/inventories"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerraform_Hosts(t *testing.T) {
+	options := map[string]interface{}{
+		"file": "fixtures/terraform.tfstate",
+		"hosts": []string{
+			"openstack_compute_instance_v2.access_ip_v4",
+			"aws_instance.private_ip",
+		},
+	}
+
+	terraform, err := inventories.New("terraform", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "openstack_compute_instance_v2.web[0]",
+			Address: "192.168.100.1",
+			Vars:    map[string]interface{}{"groups": "web,canary", "tier": "frontend"},
+		},
+		inventories.Target{
+			Name:    "openstack_compute_instance_v2.web[1]",
+			Address: "192.168.100.2",
+			Vars:    map[string]interface{}{"groups": "web", "tier": "frontend"},
+		},
+		inventories.Target{
+			Name:    `module.db.aws_instance.db["primary"]`,
+			Address: "10.0.1.10",
+			Vars:    map[string]interface{}{"Name": "db-primary", "Role": "primary"},
+		},
+	}
+
+	actual, err := terraform.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestTerraform_Resources(t *testing.T) {
+	options := map[string]interface{}{
+		"file": "fixtures/terraform.tfstate",
+		"resources": []interface{}{
+			map[interface{}]interface{}{
+				"type":    "openstack_compute_instance_v2",
+				"address": "network.0.fixed_ip_v4",
+				"name":    "name",
+				"groups":  "metadata.groups",
+			},
+			map[interface{}]interface{}{
+				"type":    "aws_instance",
+				"address": "public_ip",
+			},
+		},
+	}
+
+	terraform, err := inventories.New("terraform", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Name:    "web-0",
+			Address: "10.0.0.1",
+			Groups:  []string{"web", "canary"},
+			Vars:    map[string]interface{}{"groups": "web,canary", "tier": "frontend"},
+		},
+		inventories.Target{
+			Name:    "web-1",
+			Address: "10.0.0.2",
+			Groups:  []string{"web"},
+			Vars:    map[string]interface{}{"groups": "web", "tier": "frontend"},
+		},
+	}
+
+	actual, err := terraform.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestTerraform_Errors(t *testing.T) {
+	_, err := inventories.New("terraform", map[string]interface{}{
+		"file": "fixtures/terraform.tfstate",
+	})
+	assert.EqualError(t, err, "at least one of hosts or resources is required")
+
+	_, err = inventories.New("terraform", map[string]interface{}{
+		"file":  "fixtures/terraform.tfstate",
+		"hosts": []string{"aws_instance"},
+	})
+	assert.EqualError(t, err, "hosts entry aws_instance must be in the form of type.attribute")
+
+	_, err = inventories.New("terraform", map[string]interface{}{
+		"file": "fixtures/terraform.tfstate",
+		"resources": []interface{}{
+			map[interface{}]interface{}{"type": "aws_instance"},
+		},
+	})
+	assert.EqualError(t, err, "resources entry 0 requires a type and an address")
+
+	terraform, err := inventories.New("terraform", map[string]interface{}{
+		"file":  "fixtures/hosts.json",
+		"hosts": []string{"aws_instance.private_ip"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = terraform.Discover()
+	assert.EqualError(t, err, "unsupported state version in fixtures/hosts.json: 0")
+
+	terraform, err = inventories.New("terraform", map[string]interface{}{
+		"file": "fixtures/terraform.tfstate",
+		"resources": []interface{}{
+			map[interface{}]interface{}{
+				"type":    "aws_instance",
+				"address": "private_ip",
+				"name":    "tags.Hostname",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = terraform.Discover()
+	assert.EqualError(t, err, `module.db.aws_instance.db["primary"] has no tags.Hostname attribute to use as its name`)
+}
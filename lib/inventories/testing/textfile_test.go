@@ -1,6 +1,9 @@
 package testing
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jtopjian/bagel/lib/inventories"
@@ -33,3 +36,112 @@ func TestTextFile(t *testing.T) {
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestTextFile_Groups(t *testing.T) {
+	options := map[string]interface{}{
+		"file": "fixtures/groups.txt",
+	}
+
+	textfile, err := inventories.New("textfile", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := map[string]interface{}{"tier": "frontend"}
+	db := []string{"db"}
+
+	expected := []inventories.Target{
+		inventories.Target{
+			Address: "bastion.example.com",
+			Name:    "bastion.example.com",
+			Vars:    map[string]interface{}{"user": "admin"},
+		},
+		inventories.Target{Address: "web01.example.com", Name: "web01.example.com", Groups: []string{"web"}, Vars: frontend},
+		inventories.Target{
+			Address: "web02.example.com",
+			Name:    "web02.example.com",
+			Groups:  []string{"web", "canary"},
+			Vars: map[string]interface{}{
+				"tier":    "canary",
+				"weight":  10,
+				"enabled": true,
+			},
+		},
+		inventories.Target{Address: "web03.example.com", Name: "web03.example.com", Groups: []string{"web"}, Vars: frontend},
+		inventories.Target{Address: "web-a.example.com", Name: "web-a.example.com", Groups: []string{"web"}},
+		inventories.Target{Address: "web-b.example.com", Name: "web-b.example.com", Groups: []string{"web"}},
+		inventories.Target{
+			Address: "10.0.4.1",
+			Name:    "10.0.4.1",
+			Groups:  db,
+			Vars:    map[string]interface{}{"role": "primary db"},
+		},
+		inventories.Target{
+			Address: "10.0.4.2",
+			Name:    "10.0.4.2",
+			Groups:  db,
+			Vars:    map[string]interface{}{"role": "primary db"},
+		},
+		inventories.Target{Address: "db00-1.example.com", Name: "db00-1.example.com", Groups: db},
+		inventories.Target{Address: "db00-2.example.com", Name: "db00-2.example.com", Groups: db},
+		inventories.Target{Address: "db10-1.example.com", Name: "db10-1.example.com", Groups: db},
+		inventories.Target{Address: "db10-2.example.com", Name: "db10-2.example.com", Groups: db},
+		inventories.Target{Address: "db20-1.example.com", Name: "db20-1.example.com", Groups: db},
+		inventories.Target{Address: "db20-2.example.com", Name: "db20-2.example.com", Groups: db},
+	}
+
+	actual, err := textfile.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestTextFile_Errors(t *testing.T) {
+	textfile, err := inventories.New("textfile", map[string]interface{}{
+		"file": "fixtures/bad.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = textfile.Discover()
+	assert.EqualError(t, err, "fixtures/bad.txt line 3: invalid host: host$.example.com")
+
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"web[03:01].example.com":   "invalid range in web[03:01].example.com",
+		"web[1:c].example.com":     "invalid range in web[1:c].example.com",
+		"web[1:3.example.com":      "invalid host: web[1:3.example.com",
+		"web[0:99999].example.com": "web[0:99999].example.com expands to more than 65536 hosts",
+		"10.0.4.1/28":              "10.0.4.1/28 is not the start of a CIDR block, did you mean 10.0.4.0/28?",
+		"10.0.0.0/8":               "10.0.0.0/8 expands to more than 65536 hosts",
+		"10.0.4.0/33":              "invalid CIDR block: 10.0.4.0/33",
+		"host1 tier":               "invalid var: tier",
+		"host1 1tier=web":          "invalid var: 1tier=web",
+		`host1 role="primary`:      "unterminated quote",
+	}
+
+	file := filepath.Join(dir, "hosts.txt")
+	for line, expected := range tests {
+		if err := ioutil.WriteFile(file, []byte("# hosts\n"+line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		textfile, err := inventories.New("textfile", map[string]interface{}{
+			"file": file,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = textfile.Discover()
+		assert.EqualError(t, err, file+" line 2: "+expected, line)
+	}
+}
@@ -3,15 +3,32 @@ package inventories
 import (
 	"bufio"
 	"fmt"
+	"math/big"
+	"net"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/jtopjian/bagel/lib/utils"
 )
 
-// textFileValidEntry is a regular expression to match an valid
-// textfile line.
-var textFileValidEntry = regexp.MustCompile(`^[0-9A-Za-z\-:\._\[\]]+$`)
+// TextFileMaxHosts is the most hosts a single line may expand to.
+const TextFileMaxHosts = 65536
+
+// textFileValidEntry is a regular expression to match a valid host
+// once its ranges have been expanded.
+var textFileValidEntry = regexp.MustCompile(`^([0-9A-Za-z\-:\._]+|\[[0-9A-Fa-f:\.]+\])$`)
+
+// textFileGroup is a regular expression to match a group header.
+var textFileGroup = regexp.MustCompile(`^\[([0-9A-Za-z\-\._]+)\]$`)
+
+// textFileRange is a regular expression to match a range such as
+// [01:20], [a:f] or [0:100:10] in a host.
+var textFileRange = regexp.MustCompile(`\[([0-9]+|[a-z]):([0-9]+|[a-z])(?::([0-9]+))?\]`)
+
+// textFileVar is a regular expression to match the name of a var.
+var textFileVar = regexp.MustCompile(`^[A-Za-z_][0-9A-Za-z_]*$`)
 
 // TextFile represents a textfile inventory driver.
 type TextFile struct {
@@ -35,7 +52,9 @@ func NewTextFile(options map[string]interface{}) (*TextFile, error) {
 }
 
 // Discover implements the Inventory interface for a textfile driver.
-// It returns a set of hosts specified in a text file.
+// It returns a set of hosts specified in a text file, in the order
+// they first appear. A host listed more than once is in each of the
+// groups it is listed under and has the vars of each line.
 func (r TextFile) Discover() ([]Target, error) {
 	f, err := os.Open(r.File)
 	if err != nil {
@@ -44,17 +63,49 @@ func (r TextFile) Discover() ([]Target, error) {
 	defer f.Close()
 
 	var targets []Target
+	index := make(map[string]int)
+	var group string
+
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		if m := textFileGroup.FindStringSubmatch(line); m != nil {
+			group = m[1]
+			continue
+		}
+
+		hosts, vars, err := parseTextFileLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", r.File, n, err)
+		}
+
+		for _, host := range hosts {
+			i, ok := index[host]
+			if !ok {
+				i = len(targets)
+				index[host] = i
+				targets = append(targets, Target{
+					Name:    host,
+					Address: host,
+				})
+			}
 
-		if textFileValidEntry.MatchString(line) {
-			target := Target{
-				Name:    line,
-				Address: line,
+			target := &targets[i]
+			if group != "" && !containsString(target.Groups, group) {
+				target.Groups = append(target.Groups, group)
 			}
 
-			targets = append(targets, target)
+			for k, v := range vars {
+				if target.Vars == nil {
+					target.Vars = make(map[string]interface{})
+				}
+				target.Vars[k] = v
+			}
 		}
 	}
 
@@ -64,3 +115,221 @@ func (r TextFile) Discover() ([]Target, error) {
 
 	return targets, nil
 }
+
+// parseTextFileLine parses a line of hosts. The line is a host, range
+// or CIDR block followed by any number of key=value vars.
+func parseTextFileLine(line string) ([]string, map[string]interface{}, error) {
+	fields, err := splitTextFileFields(line)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var vars map[string]interface{}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || !textFileVar.MatchString(parts[0]) {
+			return nil, nil, fmt.Errorf("invalid var: %s", field)
+		}
+
+		if vars == nil {
+			vars = make(map[string]interface{})
+		}
+		vars[parts[0]] = textFileValue(parts[1])
+	}
+
+	host := fields[0]
+	if strings.Contains(host, "/") {
+		hosts, err := expandCIDR(host)
+		return hosts, vars, err
+	}
+
+	hosts, err := expandRanges(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, h := range hosts {
+		if !textFileValidEntry.MatchString(h) {
+			return nil, nil, fmt.Errorf("invalid host: %s", host)
+		}
+	}
+
+	return hosts, vars, nil
+}
+
+// splitTextFileFields splits a line on spaces. A value may be double
+// quoted to include spaces.
+func splitTextFileFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quoted, inField bool
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+// textFileValue converts the value of a var to an int or bool if it
+// looks like one.
+func textFileValue(v string) interface{} {
+	if i, err := strconv.Atoi(v); err == nil {
+		return i
+	}
+
+	switch v {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	return v
+}
+
+// expandRanges expands each range in a host. Numeric ranges keep the
+// width of their start, so web[01:03] is web01, web02 and web03.
+func expandRanges(host string) ([]string, error) {
+	m := textFileRange.FindStringSubmatchIndex(host)
+	if m == nil {
+		return []string{host}, nil
+	}
+
+	prefix, suffix := host[:m[0]], host[m[1]:]
+	start, end := host[m[2]:m[3]], host[m[4]:m[5]]
+
+	step := 1
+	if m[6] != -1 {
+		step, _ = strconv.Atoi(host[m[6]:m[7]])
+		if step < 1 {
+			return nil, fmt.Errorf("invalid range step in %s", host)
+		}
+	}
+
+	var values []string
+	startNum, err1 := strconv.Atoi(start)
+	endNum, err2 := strconv.Atoi(end)
+
+	switch {
+	case err1 == nil && err2 == nil:
+		if startNum > endNum {
+			return nil, fmt.Errorf("invalid range in %s", host)
+		}
+
+		if (endNum-startNum)/step >= TextFileMaxHosts {
+			return nil, fmt.Errorf("%s expands to more than %d hosts", host, TextFileMaxHosts)
+		}
+
+		for i := startNum; i <= endNum; i += step {
+			values = append(values, fmt.Sprintf("%0*d", len(start), i))
+		}
+	case err1 != nil && err2 != nil:
+		if start[0] > end[0] {
+			return nil, fmt.Errorf("invalid range in %s", host)
+		}
+
+		for c := int(start[0]); c <= int(end[0]); c += step {
+			values = append(values, string(rune(c)))
+		}
+	default:
+		return nil, fmt.Errorf("invalid range in %s", host)
+	}
+
+	// Expand any ranges in the rest of the host.
+	rest, err := expandRanges(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values)*len(rest) > TextFileMaxHosts {
+		return nil, fmt.Errorf("%s expands to more than %d hosts", host, TextFileMaxHosts)
+	}
+
+	var hosts []string
+	for _, v := range values {
+		for _, r := range rest {
+			hosts = append(hosts, prefix+v+r)
+		}
+	}
+
+	return hosts, nil
+}
+
+// expandCIDR returns the addresses of a CIDR block. The network and
+// broadcast addresses of an IPv4 block are left out unless the block
+// has two addresses or fewer.
+func expandCIDR(cidr string) ([]string, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR block: %s", cidr)
+	}
+
+	if !ip.Equal(ipNet.IP) {
+		return nil, fmt.Errorf("%s is not the start of a CIDR block, did you mean %s?", cidr, ipNet.String())
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("%s expands to more than %d hosts", cidr, TextFileMaxHosts)
+	}
+
+	count := 1 << uint(bits-ones)
+	v4 := ipNet.IP.To4() != nil
+
+	start := new(big.Int).SetBytes(ipNet.IP)
+	first, last := 0, count-1
+	if v4 && count > 2 {
+		first, last = 1, count-2
+	}
+
+	length := len(ipNet.IP)
+	var hosts []string
+	for i := first; i <= last; i++ {
+		n := new(big.Int).Add(start, big.NewInt(int64(i))).Bytes()
+
+		addr := make(net.IP, length)
+		copy(addr[length-len(n):], n)
+
+		hosts = append(hosts, addr.String())
+	}
+
+	return hosts, nil
+}
+
+// containsString reports whether s contains v.
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -26,11 +26,11 @@ type KeyOpts struct {
 
 	// KeyServer is an optional remote server to obtain the key from.
 	// If KeyServer is not used, RemoteKeyFile must be used.
-	KeyServer string
+	KeyServer string `mapstructure:"key_server"`
 
 	// RemoteKeyFile is the URL to a public key.
 	// If RemoteKeyFile is not used, KeyServer must be used.
-	RemoteKeyFile string
+	RemoteKeyFile string `mapstructure:"remote_key_file"`
 }
 
 // Key will perform a full state cycle for an apt key.
@@ -84,7 +84,9 @@ func KeyExists(opts KeyOpts) (bool, error) {
 		Command:    fmt.Sprintf("apt-key export %s", opts.Name),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -115,7 +117,9 @@ func KeyCreate(opts KeyOpts) error {
 	ro := exec.RunOpts{
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -142,6 +146,7 @@ func KeyCreate(opts KeyOpts) error {
 		ppo := file.PushPullOpts{
 			Source:      tmpfile.Name(),
 			Destination: tmpfile.Name(),
+			Context:     opts.Context,
 			Connection:  opts.Connection,
 			Logger:      opts.Logger,
 		}
@@ -163,6 +168,7 @@ func KeyCreate(opts KeyOpts) error {
 
 		fdo := file.DeleteOpts{
 			Path:       tmpfile.Name(),
+			Context:    opts.Context,
 			Connection: opts.Connection,
 			Logger:     opts.Logger,
 		}
@@ -200,7 +206,9 @@ func KeyDelete(opts KeyOpts) error {
 		Command:    fmt.Sprintf("apt-key del %s", opts.Name),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -63,7 +63,9 @@ func PackageExists(opts PackageOpts) (bool, error) {
 		Command:    fmt.Sprintf("apt-cache policy %s", opts.Name),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -104,7 +106,9 @@ func PackageCreate(opts PackageOpts) error {
 	e := exec.RunOpts{
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -142,7 +146,9 @@ func PackageDelete(opts PackageOpts) error {
 	e := exec.RunOpts{
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -78,7 +78,9 @@ func PPAExists(opts PPAOpts) (bool, error) {
 		Command:    fmt.Sprintf(`stat "%s"`, opts.fileName),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -102,7 +104,9 @@ func PPACreate(opts PPAOpts) error {
 		Command:    fmt.Sprintf("apt-add-repository -y ppa:%s", opts.Name),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -143,7 +147,9 @@ func PPADelete(opts PPAOpts) error {
 		Command:    fmt.Sprintf("apt-add-repository -y -r ppa:%s", opts.Name),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -76,7 +76,9 @@ func SourceExists(opts SourceOpts) (bool, error) {
 		Command:    fmt.Sprintf(`cat "%s"`, path),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -145,6 +147,7 @@ func SourceCreate(opts SourceOpts) error {
 	ppo := file.PushPullOpts{
 		Source:      tmpfile.Name(),
 		Destination: tmpfile.Name(),
+		Context:     opts.Context,
 		Connection:  opts.Connection,
 		Logger:      opts.Logger,
 	}
@@ -152,7 +155,9 @@ func SourceCreate(opts SourceOpts) error {
 	ro := exec.RunOpts{
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -179,7 +184,9 @@ func SourceDelete(opts SourceOpts) error {
 		Command:    fmt.Sprintf(`rm "%s"`, path),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -0,0 +1,199 @@
+package testing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/mock"
+	"github.com/jtopjian/bagel/lib/resources/apt"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// policy returns the result of apt-cache policy from a fixture.
+func policy(t *testing.T, fixture string) connections.RunResult {
+	stdout, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return connections.RunResult{Stdout: string(stdout)}
+}
+
+func TestPackage_Installed(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy nginx$`, policy(t, "fixtures/policy_installed.txt"))
+
+	input := map[string]interface{}{
+		"name": "nginx",
+	}
+
+	changed, err := apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, changed)
+	assert.Equal(t, []string{"apt-cache policy nginx"}, conn.Commands())
+}
+
+func TestPackage_Install(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy nginx$`, policy(t, "fixtures/policy_none.txt"))
+	conn.OnCommand(`^apt-get install `)
+
+	input := map[string]interface{}{
+		"name": "nginx",
+		"sudo": true,
+	}
+
+	changed, err := apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/package_install.golden", conn.Calls())
+}
+
+func TestPackage_Version(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy nginx$`, policy(t, "fixtures/policy_installed.txt"))
+	conn.OnCommand(`^apt-get install `)
+
+	input := map[string]interface{}{
+		"name":  "nginx",
+		"state": "1.18.0-0ubuntu1.2",
+	}
+
+	changed, err := apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	assert.Contains(t, conn.Commands()[1], " nginx=1.18.0-0ubuntu1.2")
+
+	// The installed version is already the requested one.
+	input["state"] = "1.18.0-0ubuntu1"
+
+	changed, err = apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, changed)
+}
+
+func TestPackage_Absent(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy nginx$`,
+		policy(t, "fixtures/policy_installed.txt"),
+		policy(t, "fixtures/policy_none.txt"),
+	)
+	conn.OnCommand(`^apt-get purge `)
+
+	input := map[string]interface{}{
+		"name":  "nginx",
+		"state": "absent",
+	}
+
+	changed, err := apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+
+	changed, err = apt.Package(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, changed)
+	assert.Equal(t, []string{
+		"apt-cache policy nginx",
+		"apt-get purge -q -y nginx",
+		"apt-cache policy nginx",
+	}, conn.Commands())
+}
+
+func TestPackage_NoSuchPackage(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-cache policy `)
+
+	input := map[string]interface{}{
+		"name": "asdf",
+	}
+
+	_, err := apt.Package(input, conn)
+	assert.EqualError(t, err, "no such package")
+}
+
+func TestKey_KeyServer(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-key export `)
+	conn.OnCommand(`^apt-key adv `)
+
+	input := map[string]interface{}{
+		"name":       "C0BA5CE6DC6315A3",
+		"key_server": "keyserver.ubuntu.com",
+		"sudo":       true,
+	}
+
+	changed, err := apt.Key(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/key_keyserver.golden", conn.Calls())
+}
+
+func TestKey_RemoteKeyFile(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("fixtures")))
+	defer server.Close()
+
+	conn := mock.New()
+	conn.AddDir("/tmp", 01777)
+	conn.OnCommand(`^apt-key export `)
+	conn.OnCommand(`^apt-key add /tmp/apt\.key\d+$`)
+
+	input := map[string]interface{}{
+		"name":            "rabbitmq",
+		"remote_key_file": server.URL + "/key.asc",
+	}
+
+	changed, err := apt.Key(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/key_remote_key_file.golden", conn.Calls(), mock.Mask{
+		Pattern:     `/tmp/apt\.key\d+`,
+		Replacement: "/tmp/apt.keyXXX",
+	})
+}
+
+func TestKey_Absent(t *testing.T) {
+	conn := mock.New()
+	conn.OnCommand(`^apt-key export `, connections.RunResult{Stdout: "-----BEGIN PGP PUBLIC KEY BLOCK-----"})
+	conn.OnCommand(`^apt-key del `, connections.RunResult{ExitCode: 1, Stderr: "gpg: key not found"})
+
+	input := map[string]interface{}{
+		"name":       "C0BA5CE6DC6315A3",
+		"key_server": "keyserver.ubuntu.com",
+		"state":      "absent",
+	}
+
+	_, err := apt.Key(input, conn)
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"apt-key export C0BA5CE6DC6315A3",
+		"apt-key del C0BA5CE6DC6315A3",
+	}, conn.Commands())
+}
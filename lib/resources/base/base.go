@@ -1,6 +1,8 @@
 package base
 
 import (
+	"context"
+
 	"github.com/sirupsen/logrus"
 
 	"github.com/jtopjian/bagel/lib/connections"
@@ -24,6 +26,14 @@ type BaseFields struct {
 	// Timeout is a timeout for the command.
 	Timeout int `mapstructure:"timeout"`
 
+	// Host is the name of the target the resource is applied to.
+	// It is set internally and used to prefix streamed output.
+	Host string `mapstructure:"_host"`
+
+	// Context is cancelled when the resource should stop. It is set
+	// internally and passed to the connection.
+	Context context.Context `mapstructure:"_context"`
+
 	// Connection represents an internal connection to use
 	// to execute commands on the host.
 	Connection connections.Connection
@@ -31,3 +41,17 @@ type BaseFields struct {
 	// Logger represents an internal logger.
 	Logger *logrus.Entry
 }
+
+// NewBecome returns options to run an action as another user. It
+// returns nil if sudo is false and no become options are set.
+func NewBecome(sudo bool, method, user, password string) *connections.Become {
+	if !sudo && method == "" && user == "" {
+		return nil
+	}
+
+	return &connections.Become{
+		Method:   method,
+		User:     user,
+		Password: password,
+	}
+}
@@ -1,10 +1,10 @@
 package base
 
 import (
-	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/utils"
 )
 
 type Register struct {
@@ -19,7 +19,7 @@ func NewLuaBasicWrapper(r BasicResource) lua.LGFunction {
 		var input map[string]interface{}
 
 		tbl := L.CheckTable(1)
-		err := gluamapper.Map(tbl, &input)
+		err := utils.MapLuaTable(tbl, &input)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -28,6 +28,10 @@ func NewLuaBasicWrapper(r BasicResource) lua.LGFunction {
 
 		ctx := L.Context()
 		conn := ctx.Value("connection").(connections.Connection)
+		if host, ok := ctx.Value("host").(string); ok {
+			input["_host"] = host
+		}
+		input["_context"] = ctx
 
 		changed, err := r(input, conn)
 		if err != nil {
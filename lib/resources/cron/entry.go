@@ -22,25 +22,25 @@ type EntryOpts struct {
 	base.BaseFields `mapstructure:",squash"`
 
 	// User is the user who owns the cron entry.
-	User string `default:"root"`
+	User string `mapstructure:"user" default:"root"`
 
 	// Command is the command which cron will run.
-	Command string `required:"true"`
+	Command string `mapstructure:"command" required:"true"`
 
 	// Minute is the minute field of the cron entry.
-	Minute string `default:"*"`
+	Minute string `mapstructure:"minute" default:"*"`
 
 	// Hour is the hour field of the cron entry.
-	Hour string `default:"*"`
+	Hour string `mapstructure:"hour" default:"*"`
 
 	// DayOfMonth is the day of the month field of the cron entry.
-	DayOfMonth string `default:"*"`
+	DayOfMonth string `mapstructure:"day_of_month" default:"*"`
 
 	// Month is the month field of the cron entry.
-	Month string `default:"*"`
+	Month string `mapstructure:"month" default:"*"`
 
 	// DayOfWeek is the day of the week field of the cron entry.
-	DayOfWeek string `default:"*"`
+	DayOfWeek string `mapstructure:"day_of_week" default:"*"`
 }
 
 // entry returns the formatted cron entry.
@@ -198,14 +198,15 @@ func getCronEntries(opts EntryOpts) ([]string, error, error) {
 		Command:    fmt.Sprintf("crontab -u %s -l", opts.User),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
 	result, err := exec.InternalRun(ro)
 	if err != nil {
-		opts.Logger.Debug(result.Stderr)
-		return nil, nil, err
+		return nil, err, nil
 	}
 
 	if result.ExitCode != 0 {
@@ -234,6 +235,7 @@ func pushCronEntries(opts EntryOpts, entries []string) error {
 	ppo := file.PushPullOpts{
 		Source:      tmpfile.Name(),
 		Destination: tmpfile.Name(),
+		Context:     opts.Context,
 		Connection:  opts.Connection,
 		Logger:      opts.Logger,
 	}
@@ -246,7 +248,9 @@ func pushCronEntries(opts EntryOpts, entries []string) error {
 		Command:    fmt.Sprintf(`crontab -u %s %s`, opts.User, tmpfile.Name()),
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
@@ -262,6 +266,7 @@ func pushCronEntries(opts EntryOpts, entries []string) error {
 
 	dfo := file.DeleteOpts{
 		Path:       tmpfile.Name(),
+		Context:    opts.Context,
 		Connection: opts.Connection,
 		Logger:     opts.Logger,
 	}
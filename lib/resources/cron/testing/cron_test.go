@@ -0,0 +1,115 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/mock"
+	"github.com/jtopjian/bagel/lib/resources/cron"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crontabMask hides the name of the temporary crontab file.
+var crontabMask = mock.Mask{
+	Pattern:     `/tmp/cron\.entry\d+`,
+	Replacement: "/tmp/cron.entryXXX",
+}
+
+func newCronConnection(crontab connections.RunResult) *mock.Connection {
+	conn := mock.New()
+	conn.AddDir("/tmp", 01777)
+	conn.OnCommand(`^crontab -u \w+ -l$`, crontab)
+	conn.OnCommand(`^crontab -u \w+ /tmp/cron\.entry\d+$`)
+
+	return conn
+}
+
+func TestEntry_NoCrontab(t *testing.T) {
+	conn := newCronConnection(connections.RunResult{
+		ExitCode: 1,
+		Stderr:   "no crontab for root",
+	})
+
+	input := map[string]interface{}{
+		"name":    "backup",
+		"command": "/usr/local/bin/backup",
+		"minute":  30,
+		"hour":    2,
+	}
+
+	changed, err := cron.Entry(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/entry_no_crontab.golden", conn.Calls(), crontabMask)
+}
+
+func TestEntry_Exists(t *testing.T) {
+	conn := newCronConnection(connections.RunResult{
+		Stdout: "0 * * * * /usr/bin/true # other\n30 2 * * * /usr/local/bin/backup # backup",
+	})
+
+	input := map[string]interface{}{
+		"name":    "backup",
+		"command": "/usr/local/bin/backup",
+		"minute":  30,
+		"hour":    2,
+	}
+
+	changed, err := cron.Entry(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, changed)
+	assert.Equal(t, []string{"crontab -u root -l"}, conn.Commands())
+}
+
+func TestEntry_Update(t *testing.T) {
+	conn := newCronConnection(connections.RunResult{
+		Stdout: "0 * * * * /usr/bin/true # other\n0 3 * * * /usr/local/bin/backup # backup",
+	})
+
+	input := map[string]interface{}{
+		"name":         "backup",
+		"user":         "app",
+		"command":      "/usr/local/bin/backup",
+		"minute":       30,
+		"hour":         2,
+		"day_of_week":  "1-5",
+		"day_of_month": "*",
+	}
+
+	changed, err := cron.Entry(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/entry_update.golden", conn.Calls(), crontabMask)
+}
+
+func TestEntry_Absent(t *testing.T) {
+	conn := newCronConnection(connections.RunResult{
+		Stdout: "0 * * * * /usr/bin/true # other\n30 2 * * * /usr/local/bin/backup # backup",
+	})
+
+	input := map[string]interface{}{
+		"name":    "backup",
+		"command": "/usr/local/bin/backup",
+		"minute":  30,
+		"hour":    2,
+		"state":   "absent",
+	}
+
+	changed, err := cron.Entry(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, changed)
+	mock.AssertGolden(t, "fixtures/entry_absent.golden", conn.Calls(), crontabMask)
+}
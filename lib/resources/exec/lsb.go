@@ -26,7 +26,9 @@ func GetLSBInfo(opts base.BaseFields) (*LSBInfo, error) {
 		Command:    "/usr/bin/lsb_release -a",
 		Sudo:       opts.Sudo,
 		Timeout:    opts.Timeout,
+		Context:    opts.Context,
 		Connection: opts.Connection,
+		Host:       opts.Host,
 		Logger:     opts.Logger,
 	}
 
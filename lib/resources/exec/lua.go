@@ -1,10 +1,10 @@
 package exec
 
 import (
-	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/utils"
 )
 
 type ExecResource func(map[string]interface{}, connections.Connection) (*connections.RunResult, error)
@@ -14,7 +14,7 @@ func NewLuaExecWrapper(r ExecResource) func(L *lua.LState) int {
 		var input map[string]interface{}
 
 		tbl := L.CheckTable(1)
-		err := gluamapper.Map(tbl, &input)
+		err := utils.MapLuaTable(tbl, &input)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -23,6 +23,10 @@ func NewLuaExecWrapper(r ExecResource) func(L *lua.LState) int {
 
 		ctx := L.Context()
 		conn := ctx.Value("connection").(connections.Connection)
+		if host, ok := ctx.Value("host").(string); ok {
+			input["_host"] = host
+		}
+		input["_context"] = ctx
 
 		result, err := r(input, conn)
 		if err != nil {
@@ -1,11 +1,16 @@
 package exec
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/resources/base"
 	"github.com/jtopjian/bagel/lib/utils"
 )
 
@@ -15,11 +20,19 @@ type RunOpts struct {
 	Command  string   `mapstructure:"cmd" required:"true"`
 	Dir      string   `mapstructure:"dir"`
 	Env      []string `mapstructure:"env"`
+	Stdin    string   `mapstructure:"stdin"`
 	Sudo     bool     `mapstructure:"sudo"`
 	Timeout  int      `mapstructure:"timeout"`
 	Unless   string   `mapstructure:"unless"`
+	Stream   bool     `mapstructure:"stream"`
+	Host     string   `mapstructure:"_host"`
 	Internal bool
 
+	BecomeMethod   string `mapstructure:"become_method"`
+	BecomeUser     string `mapstructure:"become_user"`
+	BecomePassword string `mapstructure:"become_password"`
+
+	Context    context.Context `mapstructure:"_context"`
 	Connection connections.Connection
 	Logger     *logrus.Entry
 }
@@ -55,42 +68,56 @@ func Run(input map[string]interface{}, conn connections.Connection) (*connection
 		})
 	}
 
-	cmd := r.Command
-	unless := r.Unless
-
-	if r.Sudo {
-		cmd = fmt.Sprintf("sudo %s", cmd)
-		unless = fmt.Sprintf("sudo %s", unless)
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	if r.Dir != "" {
-		cmd = fmt.Sprintf(`cd %s && %s`, r.Dir, cmd)
-		unless = fmt.Sprintf(`cd %s && %s`, r.Dir, unless)
-	}
+	env := make(map[string]string)
+	for _, kv := range r.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return result, fmt.Errorf("env must be in the form of KEY=value: %s", kv)
+		}
 
-	for _, env := range r.Env {
-		cmd = fmt.Sprintf(`%s && %s`, env, cmd)
-		unless = fmt.Sprintf(`%s && %s`, env, unless)
+		env[parts[0]] = parts[1]
 	}
 
+	// The dir and env also apply to the become user.
+	become := base.NewBecome(r.Sudo, r.BecomeMethod, r.BecomeUser, r.BecomePassword)
+
 	ro := connections.RunOpts{
-		Command: cmd,
+		Command: r.Command,
 		Timeout: r.Timeout,
+		Become:  become,
+		Env:     env,
+		Dir:     r.Dir,
+	}
+
+	if r.Stdin != "" {
+		ro.Stdin = strings.NewReader(r.Stdin)
 	}
 
 	if r.Unless != "" {
 		uo := connections.RunOpts{
-			Command: unless,
+			Command: r.Unless,
 			Timeout: r.Timeout,
+			Become:  become,
+			Env:     env,
+			Dir:     r.Dir,
 		}
 
 		if internal {
-			logger.Debugf("running unless command: %s", ro.Command)
+			logger.Debugf("running unless command: %s", uo.Command)
 		} else {
-			logger.Infof("running unless command: %s", ro.Command)
+			logger.Infof("running unless command: %s", uo.Command)
+		}
+
+		result, err = conn.RunCommand(ctx, uo)
+		if err != nil {
+			return result, err
 		}
 
-		result, err = conn.RunCommand(uo)
 		if result.ExitCode == 0 {
 			result.Applied = false
 			return result, err
@@ -103,7 +130,18 @@ func Run(input map[string]interface{}, conn connections.Connection) (*connection
 		logger.Infof("running command: %s", ro.Command)
 	}
 
-	result, err = conn.RunCommand(ro)
+	// Stream the output through the logger as it arrives.
+	if r.Stream || viper.GetBool("stream_output") {
+		var prefix string
+		if r.Host != "" {
+			prefix = fmt.Sprintf("[%s] ", r.Host)
+		}
+
+		var log io.Writer = utils.NewLogWriter(logger, prefix)
+		ro.Log = &log
+	}
+
+	result, err = conn.RunCommand(ctx, ro)
 	return result, err
 }
 
@@ -114,11 +152,19 @@ func InternalRun(opts RunOpts) (*connections.RunResult, error) {
 		"cmd":       opts.Command,
 		"dir":       opts.Dir,
 		"env":       opts.Env,
+		"stdin":     opts.Stdin,
 		"sudo":      opts.Sudo,
 		"timeout":   opts.Timeout,
 		"unless":    opts.Unless,
+		"stream":    opts.Stream,
+		"_host":     opts.Host,
+		"_context":  opts.Context,
 		"_logger":   opts.Logger,
 		"_internal": true,
+
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
 	}
 
 	return Run(input, opts.Connection)
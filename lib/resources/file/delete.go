@@ -1,11 +1,13 @@
 package file
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/resources/base"
 	"github.com/jtopjian/bagel/lib/utils"
 )
 
@@ -16,6 +18,12 @@ type DeleteOpts struct {
 	Path    string `mapstructure:"path" required:"true"`
 	Timeout int    `mapstructure:"timeout"`
 
+	Sudo           bool   `mapstructure:"sudo"`
+	BecomeMethod   string `mapstructure:"become_method"`
+	BecomeUser     string `mapstructure:"become_user"`
+	BecomePassword string `mapstructure:"become_password"`
+
+	Context    context.Context `mapstructure:"_context"`
 	Connection connections.Connection
 	Logger     *logrus.Entry
 }
@@ -60,9 +68,15 @@ func Delete(input map[string]interface{}, conn connections.Connection) (*connect
 	fo := connections.FileOpts{
 		Path:    opts.Path,
 		Timeout: opts.Timeout,
+		Become:  base.NewBecome(opts.Sudo, opts.BecomeMethod, opts.BecomeUser, opts.BecomePassword),
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	return conn.FileDelete(fo)
+	return conn.FileDelete(ctx, fo)
 }
 
 // InternalDelete is like Delete but takes a DeleteOpts argument.
@@ -71,8 +85,14 @@ func InternalDelete(opts DeleteOpts) (*connections.FileResult, error) {
 	input := map[string]interface{}{
 		"path":      opts.Path,
 		"timeout":   opts.Timeout,
+		"_context":  opts.Context,
 		"_logger":   opts.Logger,
 		"_internal": true,
+
+		"sudo":            opts.Sudo,
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
 	}
 
 	return Delete(input, opts.Connection)
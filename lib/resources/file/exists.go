@@ -1,11 +1,13 @@
 package file
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/resources/base"
 	"github.com/jtopjian/bagel/lib/utils"
 )
 
@@ -13,9 +15,16 @@ const fileExistsName = "file.Exists"
 
 // ExistsOpts represents options for checking if a file exists.
 type ExistsOpts struct {
-	Path    string `mapstructure:"path" required:"true"`
-	Timeout int    `mapstructure:"timeout"`
+	Path     string `mapstructure:"path" required:"true"`
+	Timeout  int    `mapstructure:"timeout"`
+	Checksum bool   `mapstructure:"checksum"`
 
+	Sudo           bool   `mapstructure:"sudo"`
+	BecomeMethod   string `mapstructure:"become_method"`
+	BecomeUser     string `mapstructure:"become_user"`
+	BecomePassword string `mapstructure:"become_password"`
+
+	Context    context.Context `mapstructure:"_context"`
 	Connection connections.Connection
 	Logger     *logrus.Entry
 }
@@ -58,11 +67,18 @@ func Exists(input map[string]interface{}, conn connections.Connection) (*connect
 	}
 
 	fo := connections.FileOpts{
-		Path:    opts.Path,
-		Timeout: opts.Timeout,
+		Path:     opts.Path,
+		Timeout:  opts.Timeout,
+		Checksum: opts.Checksum,
+		Become:   base.NewBecome(opts.Sudo, opts.BecomeMethod, opts.BecomeUser, opts.BecomePassword),
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	return conn.FileInfo(fo)
+	return conn.FileInfo(ctx, fo)
 }
 
 // InternalExists is like Exists, but takes an ExistsOpts argument.
@@ -71,8 +87,15 @@ func InternalExists(opts ExistsOpts, conn connections.Connection) (*connections.
 	input := map[string]interface{}{
 		"path":      opts.Path,
 		"timeout":   opts.Timeout,
+		"checksum":  opts.Checksum,
+		"_context":  opts.Context,
 		"_logger":   opts.Logger,
 		"_internal": true,
+
+		"sudo":            opts.Sudo,
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
 	}
 
 	return Exists(input, opts.Connection)
@@ -13,5 +13,6 @@ var Register = base.Register{
 		"Exists": NewLuaFileWrapper(Exists),
 		"Pull":   NewLuaFileWrapper(Pull),
 		"Push":   NewLuaFileWrapper(Push),
+		"Sync":   NewLuaFileWrapper(Sync),
 	},
 }
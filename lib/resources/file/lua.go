@@ -1,10 +1,10 @@
 package file
 
 import (
-	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/utils"
 )
 
 type FileResource func(map[string]interface{}, connections.Connection) (*connections.FileResult, error)
@@ -14,7 +14,7 @@ func NewLuaFileWrapper(r FileResource) func(L *lua.LState) int {
 		var input map[string]interface{}
 
 		tbl := L.CheckTable(1)
-		err := gluamapper.Map(tbl, &input)
+		err := utils.MapLuaTable(tbl, &input)
 		if err != nil {
 			L.Push(lua.LNil)
 			L.Push(lua.LString(err.Error()))
@@ -23,6 +23,7 @@ func NewLuaFileWrapper(r FileResource) func(L *lua.LState) int {
 
 		ctx := L.Context()
 		conn := ctx.Value("connection").(connections.Connection)
+		input["_context"] = ctx
 
 		result, err := r(input, conn)
 		if err != nil {
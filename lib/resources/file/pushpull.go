@@ -1,6 +1,7 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/resources/base"
 	"github.com/jtopjian/bagel/lib/resources/exec"
 	"github.com/jtopjian/bagel/lib/utils"
 )
@@ -16,11 +18,18 @@ import (
 type PushPullOpts struct {
 	Source      string `mapstructure:"source" required:"true"`
 	Destination string `mapstructure:"destination" required:"true"`
-	UID         int    `mapstructure:"uid"`
-	GID         int    `mapstructure:"gid"`
+	UID         *int   `mapstructure:"uid"`
+	GID         *int   `mapstructure:"gid"`
 	Mode        int    `mapstructure:"mode"`
 	Timeout     int    `mapstructure:"timeout"`
+	Recursive   bool   `mapstructure:"recursive"`
 
+	Sudo           bool   `mapstructure:"sudo"`
+	BecomeMethod   string `mapstructure:"become_method"`
+	BecomeUser     string `mapstructure:"become_user"`
+	BecomePassword string `mapstructure:"become_password"`
+
+	Context    context.Context `mapstructure:"_context"`
 	Connection connections.Connection
 	Logger     *logrus.Entry
 }
@@ -35,6 +44,12 @@ func pushPull(input map[string]interface{}, conn connections.Connection, action
 		return result, err
 	}
 
+	// A recursive copy is a sync in the same direction.
+	if opts.Recursive {
+		input["direction"] = action
+		return Sync(input, conn)
+	}
+
 	var internal bool
 	if _, ok := input["_internal"]; ok {
 		internal = true
@@ -59,20 +74,36 @@ func pushPull(input map[string]interface{}, conn connections.Connection, action
 		logger.Infof("%s %s => %s", action, opts.Source, opts.Destination)
 	}
 
+	// An owner which wasn't requested is -1 and left as it is.
+	uid, gid := -1, -1
+	if opts.UID != nil {
+		uid = *opts.UID
+	}
+
+	if opts.GID != nil {
+		gid = *opts.GID
+	}
+
 	cfo := connections.CopyFileOpts{
 		Source:      opts.Source,
 		Destination: opts.Destination,
-		UID:         opts.UID,
-		GID:         opts.GID,
+		UID:         uid,
+		GID:         gid,
 		Mode:        os.FileMode(opts.Mode),
 		Timeout:     opts.Timeout,
+		Become:      base.NewBecome(opts.Sudo, opts.BecomeMethod, opts.BecomeUser, opts.BecomePassword),
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
 	switch action {
 	case "push":
-		return conn.FileUpload(cfo)
+		return conn.FileUpload(ctx, cfo)
 	case "pull":
-		return conn.FileDownload(cfo)
+		return conn.FileDownload(ctx, cfo)
 	}
 
 	return nil, nil
@@ -89,12 +120,24 @@ func InternalPush(opts PushPullOpts) (*connections.FileResult, error) {
 	input := map[string]interface{}{
 		"source":      opts.Source,
 		"destination": opts.Destination,
-		"uid":         opts.UID,
-		"gid":         opts.GID,
 		"mode":        opts.Mode,
 		"timeout":     opts.Timeout,
+		"_context":    opts.Context,
 		"_logger":     opts.Logger,
 		"_internal":   true,
+
+		"sudo":            opts.Sudo,
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
+	}
+
+	if opts.UID != nil {
+		input["uid"] = *opts.UID
+	}
+
+	if opts.GID != nil {
+		input["gid"] = *opts.GID
 	}
 
 	return Push(input, opts.Connection)
@@ -107,14 +150,21 @@ func PushAndMove(pushPullOpts PushPullOpts, runOpts exec.RunOpts, finalDestinati
 	input := map[string]interface{}{
 		"source":      pushPullOpts.Source,
 		"destination": pushPullOpts.Destination,
-		"uid":         pushPullOpts.UID,
-		"gid":         pushPullOpts.GID,
 		"mode":        pushPullOpts.Mode,
 		"timeout":     pushPullOpts.Timeout,
+		"_context":    pushPullOpts.Context,
 		"_logger":     pushPullOpts.Logger,
 		"_internal":   true,
 	}
 
+	if pushPullOpts.UID != nil {
+		input["uid"] = *pushPullOpts.UID
+	}
+
+	if pushPullOpts.GID != nil {
+		input["gid"] = *pushPullOpts.GID
+	}
+
 	result, err := Push(input, pushPullOpts.Connection)
 	if err != nil {
 		return nil, err
@@ -148,12 +198,24 @@ func InternalPull(opts PushPullOpts) (*connections.FileResult, error) {
 	input := map[string]interface{}{
 		"source":      opts.Source,
 		"destination": opts.Destination,
-		"uid":         opts.UID,
-		"gid":         opts.GID,
 		"mode":        opts.Mode,
 		"timeout":     opts.Timeout,
+		"_context":    opts.Context,
 		"_logger":     opts.Logger,
 		"_internal":   true,
+
+		"sudo":            opts.Sudo,
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
+	}
+
+	if opts.UID != nil {
+		input["uid"] = *opts.UID
+	}
+
+	if opts.GID != nil {
+		input["gid"] = *opts.GID
 	}
 
 	return Pull(input, opts.Connection)
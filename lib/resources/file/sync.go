@@ -0,0 +1,556 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/resources/base"
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const fileSyncName = "file.Sync"
+
+// SyncOpts represents options for synchronizing a directory tree.
+type SyncOpts struct {
+	Source        string   `mapstructure:"source" required:"true"`
+	Destination   string   `mapstructure:"destination" required:"true"`
+	Direction     string   `mapstructure:"direction"`
+	UID           *int     `mapstructure:"uid"`
+	GID           *int     `mapstructure:"gid"`
+	PreserveOwner bool     `mapstructure:"preserve_owner"`
+	Mode          int      `mapstructure:"mode"`
+	DirMode       int      `mapstructure:"dir_mode"`
+	Exclude       []string `mapstructure:"exclude"`
+	Delete        bool     `mapstructure:"delete"`
+	Timeout       int      `mapstructure:"timeout"`
+
+	Sudo           bool   `mapstructure:"sudo"`
+	BecomeMethod   string `mapstructure:"become_method"`
+	BecomeUser     string `mapstructure:"become_user"`
+	BecomePassword string `mapstructure:"become_password"`
+
+	Context    context.Context `mapstructure:"_context"`
+	Connection connections.Connection
+	Logger     *logrus.Entry
+}
+
+// Sync will copy a directory tree to or from a target host. Only
+// entries which differ are copied and the paths which were changed
+// are returned.
+func Sync(input map[string]interface{}, conn connections.Connection) (*connections.FileResult, error) {
+	var opts SyncOpts
+	var result *connections.FileResult
+
+	// validate the input
+	err := utils.DecodeAndValidate(input, &opts)
+	if err != nil {
+		return result, err
+	}
+
+	if opts.Direction == "" {
+		opts.Direction = "push"
+	}
+
+	if opts.Direction != "push" && opts.Direction != "pull" {
+		return result, fmt.Errorf("unsupported sync direction: %s", opts.Direction)
+	}
+
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return result, fmt.Errorf("invalid exclude pattern %s: %s", pattern, err)
+		}
+	}
+
+	var internal bool
+	if _, ok := input["_internal"]; ok {
+		internal = true
+	}
+
+	var logger *logrus.Entry
+	if v, ok := input["_logger"]; ok {
+		if l, ok := v.(*logrus.Entry); ok {
+			logger = l
+		} else {
+			return result, fmt.Errorf("Internal file error: logger not set")
+		}
+	} else {
+		logger = utils.SetLogFields(utils.GetLogger(), map[string]interface{}{
+			"resource": fmt.Sprintf("%s:%s", fileSyncName, opts.Source),
+		})
+	}
+
+	if internal {
+		logger.Debugf("%s %s => %s", opts.Direction, opts.Source, opts.Destination)
+	} else {
+		logger.Infof("%s %s => %s", opts.Direction, opts.Source, opts.Destination)
+	}
+
+	local, err := connections.NewLocalConnection()
+	if err != nil {
+		return result, err
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	become := base.NewBecome(opts.Sudo, opts.BecomeMethod, opts.BecomeUser, opts.BecomePassword)
+
+	// The become options only apply to the target host.
+	s := syncer{
+		ctx:     ctx,
+		opts:    opts,
+		logger:  logger,
+		become:  become,
+		changed: []string{},
+	}
+
+	switch opts.Direction {
+	case "push":
+		s.src, s.dst = local, conn
+		s.dstBecome = become
+		s.copy = conn.FileUpload
+	case "pull":
+		s.src, s.dst = conn, local
+		s.srcBecome = become
+		s.copy = conn.FileDownload
+	}
+
+	if err := s.sync(); err != nil {
+		return result, err
+	}
+
+	result = &connections.FileResult{
+		Exists:  true,
+		Success: true,
+		Applied: len(s.changed) > 0,
+		Changed: s.changed,
+	}
+
+	return result, nil
+}
+
+// InternalSync is like Sync, but takes a SyncOpts argument.
+// This is meant to be used internally to build more complex resources.
+func InternalSync(opts SyncOpts) (*connections.FileResult, error) {
+	input := map[string]interface{}{
+		"source":         opts.Source,
+		"destination":    opts.Destination,
+		"direction":      opts.Direction,
+		"preserve_owner": opts.PreserveOwner,
+		"mode":           opts.Mode,
+		"dir_mode":       opts.DirMode,
+		"exclude":        opts.Exclude,
+		"delete":         opts.Delete,
+		"timeout":        opts.Timeout,
+		"_context":       opts.Context,
+		"_logger":        opts.Logger,
+		"_internal":      true,
+
+		"sudo":            opts.Sudo,
+		"become_method":   opts.BecomeMethod,
+		"become_user":     opts.BecomeUser,
+		"become_password": opts.BecomePassword,
+	}
+
+	if opts.UID != nil {
+		input["uid"] = *opts.UID
+	}
+
+	if opts.GID != nil {
+		input["gid"] = *opts.GID
+	}
+
+	return Sync(input, opts.Connection)
+}
+
+// syncer copies the tree below one connection's source directory to
+// another connection's destination directory.
+type syncer struct {
+	ctx    context.Context
+	opts   SyncOpts
+	logger *logrus.Entry
+
+	src, dst             connections.Connection
+	srcBecome, dstBecome *connections.Become
+
+	// copy copies a file from src to dst as become.
+	copy   func(context.Context, connections.CopyFileOpts) (*connections.FileResult, error)
+	become *connections.Become
+
+	changed []string
+}
+
+// sync runs the synchronization.
+func (r *syncer) sync() error {
+	fr, err := r.src.FileInfo(r.ctx, connections.FileOpts{
+		Path:    r.opts.Source,
+		Timeout: r.opts.Timeout,
+		Become:  r.srcBecome,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !fr.Exists || fr.FileInfo.Type != "directory" {
+		return fmt.Errorf("source %s is not a directory", r.opts.Source)
+	}
+	root := fr.FileInfo
+
+	srcEntries, srcOrder, err := r.list(r.src, r.srcBecome, r.opts.Source)
+	if err != nil {
+		return err
+	}
+
+	fr, err = r.dst.FileInfo(r.ctx, r.dstOpts(r.opts.Destination))
+	if err != nil {
+		return err
+	}
+
+	dstEntries := map[string]connections.FileInfo{}
+	var dstOrder []string
+
+	switch {
+	case !fr.Exists:
+		if err := r.mkdir(r.opts.Destination, root); err != nil {
+			return err
+		}
+	case fr.FileInfo.Type != "directory":
+		return fmt.Errorf("destination %s is not a directory", r.opts.Destination)
+	default:
+		if err := r.attributes(r.opts.Destination, root, fr.FileInfo); err != nil {
+			return err
+		}
+
+		dstEntries, dstOrder, err = r.list(r.dst, r.dstBecome, r.opts.Destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range srcOrder {
+		if err := r.entry(rel, srcEntries[rel], dstEntries); err != nil {
+			return err
+		}
+	}
+
+	if !r.opts.Delete {
+		return nil
+	}
+
+	// Entries below a removed directory are removed with it.
+	removed := ""
+	for _, rel := range dstOrder {
+		if _, ok := srcEntries[rel]; ok {
+			continue
+		}
+
+		if removed != "" && isBelow(rel, removed) {
+			continue
+		}
+
+		p := path.Join(r.opts.Destination, rel)
+		if err := r.apply(r.dst.RemoveAll, r.dstOpts(p)); err != nil {
+			return err
+		}
+
+		r.change(p, "removed")
+		removed = rel
+	}
+
+	return nil
+}
+
+// entry synchronizes one source entry to the destination.
+func (r *syncer) entry(rel string, src connections.FileInfo, dstEntries map[string]connections.FileInfo) error {
+	p := path.Join(r.opts.Destination, rel)
+	dst, exists := dstEntries[rel]
+
+	switch src.Type {
+	case "directory":
+		if exists && dst.Type == "directory" {
+			return r.attributes(p, src, dst)
+		}
+
+		if exists {
+			if err := r.apply(r.dst.RemoveAll, r.dstOpts(p)); err != nil {
+				return err
+			}
+		}
+
+		return r.mkdir(p, src)
+
+	case "file":
+		if exists && dst.Type == "file" && dst.Checksum == src.Checksum {
+			return r.attributes(p, src, dst)
+		}
+
+		if exists && dst.Type == "directory" {
+			if err := r.apply(r.dst.RemoveAll, r.dstOpts(p)); err != nil {
+				return err
+			}
+		}
+
+		// An owner which wasn't requested is -1 and left as it is.
+		uid, gid, _ := r.owner(src)
+		cfo := connections.CopyFileOpts{
+			Source:      path.Join(r.opts.Source, rel),
+			Destination: p,
+			UID:         uid,
+			GID:         gid,
+			Mode:        r.mode(src),
+			Timeout:     r.opts.Timeout,
+			Become:      r.become,
+		}
+
+		if err := r.apply(func(ctx context.Context, _ connections.FileOpts) (*connections.FileResult, error) {
+			return r.copy(ctx, cfo)
+		}, connections.FileOpts{Path: p}); err != nil {
+			return err
+		}
+
+		// Downloads are not given an owner and not every driver applies
+		// one on upload, so a requested owner is set afterwards.
+		if _, _, ok := r.owner(src); ok {
+			if err := r.chown(p, src); err != nil {
+				return err
+			}
+		}
+
+		r.change(p, "copied")
+
+	case "symlink":
+		if exists && dst.Type == "symlink" && dst.LinkTarget == src.LinkTarget {
+			return nil
+		}
+
+		if exists {
+			if err := r.apply(r.dst.RemoveAll, r.dstOpts(p)); err != nil {
+				return err
+			}
+		}
+
+		fo := r.dstOpts(p)
+		fo.Target = src.LinkTarget
+		if err := r.apply(r.dst.Symlink, fo); err != nil {
+			return err
+		}
+
+		r.change(p, "linked")
+
+	default:
+		r.logger.Debugf("skipping %s: unsupported file type %s", rel, src.Type)
+	}
+
+	return nil
+}
+
+// mkdir creates a destination directory for src.
+func (r *syncer) mkdir(p string, src connections.FileInfo) error {
+	fo := r.dstOpts(p)
+	fo.Mode = r.mode(src)
+	if err := r.apply(r.dst.MkdirAll, fo); err != nil {
+		return err
+	}
+
+	if _, _, ok := r.owner(src); ok {
+		if err := r.chown(p, src); err != nil {
+			return err
+		}
+	}
+
+	r.change(p, "created")
+
+	return nil
+}
+
+// attributes updates the mode and owner of an existing destination
+// entry if they differ from what src requires.
+func (r *syncer) attributes(p string, src, dst connections.FileInfo) error {
+	changed := false
+
+	if mode := r.mode(src); mode != infoMode(dst) {
+		fo := r.dstOpts(p)
+		fo.Mode = mode
+		if err := r.apply(r.dst.Chmod, fo); err != nil {
+			return err
+		}
+
+		changed = true
+	}
+
+	if uid, gid, ok := r.owner(src); ok && ((uid >= 0 && uid != dst.UID) || (gid >= 0 && gid != dst.GID)) {
+		if err := r.chown(p, src); err != nil {
+			return err
+		}
+
+		changed = true
+	}
+
+	if changed {
+		r.change(p, "updated")
+	}
+
+	return nil
+}
+
+// chown sets the owner of a destination entry.
+func (r *syncer) chown(p string, src connections.FileInfo) error {
+	fo := r.dstOpts(p)
+	fo.UID, fo.GID, _ = r.owner(src)
+
+	return r.apply(r.dst.Chown, fo)
+}
+
+// mode returns the mode a destination entry should have.
+func (r *syncer) mode(src connections.FileInfo) os.FileMode {
+	if src.Type == "directory" && r.opts.DirMode != 0 {
+		return os.FileMode(r.opts.DirMode)
+	}
+
+	if src.Type != "directory" && r.opts.Mode != 0 {
+		return os.FileMode(r.opts.Mode)
+	}
+
+	return infoMode(src)
+}
+
+// owner returns the owner and group a destination entry should have
+// and whether either was requested at all. One which wasn't requested
+// is -1, so existing entries keep it.
+func (r *syncer) owner(src connections.FileInfo) (int, int, bool) {
+	uid, gid := -1, -1
+	if r.opts.PreserveOwner {
+		uid, gid = src.UID, src.GID
+	}
+
+	if r.opts.UID != nil {
+		uid = *r.opts.UID
+	}
+
+	if r.opts.GID != nil {
+		gid = *r.opts.GID
+	}
+
+	return uid, gid, r.opts.PreserveOwner || r.opts.UID != nil || r.opts.GID != nil
+}
+
+// list returns every entry below root which is not excluded, keyed by
+// its path relative to root, and the paths in the order they were
+// found. A directory is always found before its contents.
+func (r *syncer) list(conn connections.Connection, become *connections.Become, root string) (map[string]connections.FileInfo, []string, error) {
+	entries := make(map[string]connections.FileInfo)
+	var order []string
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		fo := connections.FileOpts{
+			Path:     path.Join(root, rel),
+			Timeout:  r.opts.Timeout,
+			Become:   become,
+			Checksum: true,
+		}
+
+		fr, err := conn.ReadDir(r.ctx, fo)
+		if err != nil {
+			return err
+		}
+
+		if fr.Timeout {
+			return fmt.Errorf("timeout reading %s", fo.Path)
+		}
+
+		for _, fi := range fr.Entries {
+			p := path.Join(rel, fi.Name)
+			if r.excluded(p) {
+				continue
+			}
+
+			entries[p] = fi
+			order = append(order, p)
+
+			if fi.Type == "directory" {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, nil, err
+	}
+
+	return entries, order, nil
+}
+
+// excluded reports whether a relative path matches an exclude pattern.
+// A pattern is matched against both the whole path and its last element.
+func (r *syncer) excluded(rel string) bool {
+	for _, pattern := range r.opts.Exclude {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dstOpts returns the options for an action on a destination path.
+func (r *syncer) dstOpts(p string) connections.FileOpts {
+	return connections.FileOpts{
+		Path:    p,
+		Timeout: r.opts.Timeout,
+		Become:  r.dstBecome,
+	}
+}
+
+// apply runs a file action and turns an unsuccessful result into an
+// error.
+func (r *syncer) apply(f func(context.Context, connections.FileOpts) (*connections.FileResult, error), fo connections.FileOpts) error {
+	fr, err := f(r.ctx, fo)
+	if err != nil {
+		return err
+	}
+
+	if fr.Timeout {
+		return fmt.Errorf("timeout")
+	}
+
+	if !fr.Success {
+		return fmt.Errorf("unable to sync %s", fo.Path)
+	}
+
+	return nil
+}
+
+// change records a changed destination path.
+func (r *syncer) change(p, action string) {
+	r.logger.Debugf("%s %s", action, p)
+	r.changed = append(r.changed, p)
+}
+
+// infoMode converts the mode of a FileInfo, such as 644, back to an
+// os.FileMode.
+func infoMode(fi connections.FileInfo) os.FileMode {
+	mode, _ := strconv.ParseUint(strconv.Itoa(fi.Mode), 8, 32)
+	return os.FileMode(mode)
+}
+
+// isBelow reports whether rel is inside the directory dir.
+func isBelow(rel, dir string) bool {
+	return len(rel) > len(dir) && rel[:len(dir)] == dir && rel[len(dir)] == '/'
+}
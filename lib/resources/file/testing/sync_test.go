@@ -0,0 +1,336 @@
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/mock"
+	"github.com/jtopjian/bagel/lib/connections/testing/sshserver"
+	"github.com/jtopjian/bagel/lib/resources/file"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSyncSource returns a local directory with a small tree in it.
+func newSyncSource(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"a.txt":     "a\n",
+		"sub/b.txt": "b\n",
+		"debug.log": "log\n",
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// The umask may have changed the mode.
+		if err := os.Chmod(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// remoteInfo describes a file on a mock connection.
+func remoteInfo(t *testing.T, conn *mock.Connection, p string) connections.FileInfo {
+	fr, err := conn.FileInfo(context.Background(), connections.FileOpts{Path: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.Exists {
+		t.Fatalf("%s does not exist", p)
+	}
+
+	return fr.FileInfo
+}
+
+func TestSync_Push(t *testing.T) {
+	src := newSyncSource(t)
+	defer os.RemoveAll(src)
+
+	conn := mock.New()
+	conn.AddDir("/srv", 0755)
+
+	input := map[string]interface{}{
+		"source":      src,
+		"destination": "/srv/app",
+		"exclude":     []string{"*.log"},
+	}
+
+	fr, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Applied)
+	assert.Equal(t, []string{"/srv/app", "/srv/app/a.txt", "/srv/app/sub", "/srv/app/sub/b.txt"}, fr.Changed)
+
+	content, ok := conn.File("/srv/app/sub/b.txt")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "b\n", string(content))
+
+	_, ok = conn.File("/srv/app/debug.log")
+	assert.Equal(t, false, ok)
+
+	assert.Equal(t, 644, remoteInfo(t, conn, "/srv/app/a.txt").Mode)
+	assert.Equal(t, 755, remoteInfo(t, conn, "/srv/app/sub").Mode)
+
+	// Nothing changes the second time.
+	fr, err = file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Applied)
+	assert.Equal(t, []string{}, fr.Changed)
+}
+
+func TestSync_Pull(t *testing.T) {
+	dst, err := ioutil.TempDir("", "bagel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	conn := mock.New()
+	conn.AddDir("/srv", 0755)
+	conn.AddDir("/srv/app", 0755)
+	conn.AddDir("/srv/app/sub", 0700)
+	conn.AddFile("/srv/app/a.txt", []byte("a\n"), 0600)
+	conn.AddFile("/srv/app/sub/b.txt", []byte("b\n"), 0644)
+
+	input := map[string]interface{}{
+		"source":      "/srv/app",
+		"destination": filepath.Join(dst, "app"),
+		"direction":   "pull",
+	}
+
+	fr, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Applied)
+	assert.Equal(t, 4, len(fr.Changed))
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "app", "sub", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "b\n", string(content))
+
+	stat, err := os.Stat(filepath.Join(dst, "app", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	stat, err = os.Stat(filepath.Join(dst, "app", "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	fr, err = file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Applied)
+}
+
+func TestSync_Delete(t *testing.T) {
+	src := newSyncSource(t)
+	defer os.RemoveAll(src)
+
+	conn := mock.New()
+	conn.AddDir("/srv", 0755)
+	conn.AddDir("/srv/app", 0755)
+	conn.AddDir("/srv/app/old", 0755)
+	conn.AddFile("/srv/app/old/c.txt", []byte("c\n"), 0644)
+	conn.AddFile("/srv/app/stale.txt", []byte("stale\n"), 0644)
+	conn.AddFile("/srv/app/debug.log", []byte("kept\n"), 0644)
+
+	input := map[string]interface{}{
+		"source":      src,
+		"destination": "/srv/app",
+		"exclude":     []string{"*.log"},
+	}
+
+	// Without delete, extra entries are kept.
+	_, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := conn.File("/srv/app/stale.txt")
+	assert.Equal(t, true, ok)
+
+	input["delete"] = true
+	fr, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, fr.Applied)
+	assert.Equal(t, []string{"/srv/app/old", "/srv/app/stale.txt"}, fr.Changed)
+
+	_, ok = conn.File("/srv/app/old/c.txt")
+	assert.Equal(t, false, ok)
+
+	_, ok = conn.File("/srv/app/stale.txt")
+	assert.Equal(t, false, ok)
+
+	// Excluded entries are never deleted.
+	content, ok := conn.File("/srv/app/debug.log")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "kept\n", string(content))
+
+	fr, err = file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Applied)
+}
+
+func TestSync_ModeAndOwner(t *testing.T) {
+	src := newSyncSource(t)
+	defer os.RemoveAll(src)
+
+	conn := mock.New()
+	conn.AddDir("/srv", 0755)
+
+	input := map[string]interface{}{
+		"source":      src,
+		"destination": "/srv/app",
+		"mode":        0600,
+		"dir_mode":    0700,
+		"uid":         5,
+		"gid":         6,
+	}
+
+	_, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi := remoteInfo(t, conn, "/srv/app/sub/b.txt")
+	assert.Equal(t, 600, fi.Mode)
+	assert.Equal(t, 5, fi.UID)
+	assert.Equal(t, 6, fi.GID)
+
+	fi = remoteInfo(t, conn, "/srv/app/sub")
+	assert.Equal(t, 700, fi.Mode)
+	assert.Equal(t, 5, fi.UID)
+	assert.Equal(t, 6, fi.GID)
+
+	// Without an owner, the existing owner is kept.
+	delete(input, "uid")
+	delete(input, "gid")
+
+	fr, err := file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, false, fr.Applied)
+
+	// Changing a file's content keeps its owner too.
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err = file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/srv/app/a.txt"}, fr.Changed)
+
+	fi = remoteInfo(t, conn, "/srv/app/a.txt")
+	assert.Equal(t, 5, fi.UID)
+	assert.Equal(t, 6, fi.GID)
+
+	// Only the requested ID is changed, as are modes which differ.
+	input["uid"] = 7
+	input["mode"] = 0640
+
+	fr, err = file.Sync(input, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/srv/app", "/srv/app/a.txt", "/srv/app/debug.log", "/srv/app/sub", "/srv/app/sub/b.txt"}, fr.Changed)
+
+	fi = remoteInfo(t, conn, "/srv/app/sub/b.txt")
+	assert.Equal(t, 640, fi.Mode)
+	assert.Equal(t, 7, fi.UID)
+	assert.Equal(t, 6, fi.GID)
+}
+
+func TestSync_PushOwnerSSH(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of a file requires root")
+	}
+
+	src := newSyncSource(t)
+	defer os.RemoveAll(src)
+
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	conn, err := connections.New("ssh", server.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	destination := filepath.Join(server.Root, "app")
+	input := map[string]interface{}{
+		"source":      src,
+		"destination": destination,
+		"uid":         65534,
+		"gid":         65534,
+	}
+
+	if _, err := file.Sync(input, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a.txt", "sub", "sub/b.txt"} {
+		fi, err := os.Stat(filepath.Join(destination, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stat := fi.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(65534), stat.Uid, p)
+		assert.Equal(t, uint32(65534), stat.Gid, p)
+	}
+}
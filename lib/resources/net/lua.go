@@ -0,0 +1,56 @@
+package net
+
+import (
+	"github.com/yuin/gopher-lua"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+type TunnelResource func(map[string]interface{}, connections.Connection) (*connections.Tunnel, error)
+
+// NewLuaTunnelWrapper returns a Lua function which opens a tunnel. It
+// returns a table of the tunnel's port and addresses and a close
+// function.
+func NewLuaTunnelWrapper(r TunnelResource) func(L *lua.LState) int {
+	return func(L *lua.LState) int {
+		var input map[string]interface{}
+
+		tbl := L.CheckTable(1)
+		err := utils.MapLuaTable(tbl, &input)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		ctx := L.Context()
+		conn := ctx.Value("connection").(connections.Connection)
+		input["_context"] = ctx
+
+		tunnel, err := r(input, conn)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		ret := L.NewTable()
+		ret.RawSetString("port", lua.LNumber(tunnel.Port))
+		ret.RawSetString("local_address", lua.LString(tunnel.Local))
+		ret.RawSetString("remote_address", lua.LString(tunnel.Remote))
+		ret.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+			if err := tunnel.Close(); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+
+			return 0
+		}))
+
+		L.Push(ret)
+		L.Push(lua.LNil)
+
+		return 2
+	}
+}
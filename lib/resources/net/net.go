@@ -0,0 +1,14 @@
+package net
+
+import (
+	"github.com/yuin/gopher-lua"
+
+	"github.com/jtopjian/bagel/lib/resources/base"
+)
+
+var Register = base.Register{
+	LuaName: "net",
+	Resources: map[string]lua.LGFunction{
+		"Tunnel": NewLuaTunnelWrapper(Tunnel),
+	},
+}
@@ -0,0 +1,110 @@
+package testing
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/connections/mock"
+	"github.com/jtopjian/bagel/lib/connections/testing/sshserver"
+	"github.com/jtopjian/bagel/lib/resources"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newLuaState returns a Lua state with the resources registered which
+// runs actions against conn.
+func newLuaState(ctx context.Context, conn connections.Connection) *lua.LState {
+	L := lua.NewState()
+	L.SetContext(context.WithValue(ctx, "connection", conn))
+	resources.Register(L)
+
+	return L
+}
+
+func TestTunnel(t *testing.T) {
+	server := sshserver.New(t, sshserver.Config{PublicKey: true})
+	defer server.Close()
+
+	conn, err := connections.New("ssh", server.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	go func() {
+		c, err := service.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		fmt.Fprintln(c, "hello")
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	L := newLuaState(ctx, conn)
+	defer L.Close()
+
+	script := fmt.Sprintf(`
+		tunnel, err = net.Tunnel({ remote = %q })
+		port = tunnel.port
+		local_address = tunnel.local_address
+		remote_address = tunnel.remote_address
+	`, service.Addr().String())
+
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+	assert.Equal(t, service.Addr().String(), L.GetGlobal("remote_address").String())
+
+	local := L.GetGlobal("local_address").String()
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%s", L.GetGlobal("port").String()), local)
+
+	c, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "hello\n", line)
+
+	if err := L.DoString(`tunnel.close()`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = net.Dial("tcp", local)
+	assert.Error(t, err)
+}
+
+func TestTunnel_Unsupported(t *testing.T) {
+	L := newLuaState(context.Background(), mock.New())
+	defer L.Close()
+
+	if err := L.DoString(`tunnel, err = net.Tunnel({ remote = "127.0.0.1:8080" })`); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, lua.LNil, L.GetGlobal("tunnel"))
+	assert.Equal(t, "connection does not support tunnels", L.GetGlobal("err").String())
+}
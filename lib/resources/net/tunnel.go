@@ -0,0 +1,80 @@
+package net
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jtopjian/bagel/lib/connections"
+	"github.com/jtopjian/bagel/lib/utils"
+)
+
+const netTunnelName = "net.Tunnel"
+
+// TunnelOpts represents options for opening a tunnel.
+type TunnelOpts struct {
+	Remote  string `mapstructure:"remote" required:"true"`
+	Local   string `mapstructure:"local_address"`
+	Reverse bool   `mapstructure:"reverse"`
+
+	Context    context.Context `mapstructure:"_context"`
+	Connection connections.Connection
+	Logger     *logrus.Entry
+}
+
+// Tunnel will open a tunnel between the local host and a target host.
+// The tunnel stays open until it is closed or the role run finishes.
+func Tunnel(input map[string]interface{}, conn connections.Connection) (*connections.Tunnel, error) {
+	var opts TunnelOpts
+
+	// validate the input
+	err := utils.DecodeAndValidate(input, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Connection = conn
+
+	var logger *logrus.Entry
+	if v, ok := input["_logger"]; ok {
+		if l, ok := v.(*logrus.Entry); ok {
+			logger = l
+		} else {
+			return nil, fmt.Errorf("Internal net error: logger not set")
+		}
+	} else {
+		logger = utils.SetLogFields(utils.GetLogger(), map[string]interface{}{
+			"resource": fmt.Sprintf("%s:%s", netTunnelName, opts.Remote),
+		})
+	}
+
+	tunneler, ok := conn.(connections.Tunneler)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support tunnels")
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	to := connections.TunnelOpts{
+		Remote:  opts.Remote,
+		Local:   opts.Local,
+		Reverse: opts.Reverse,
+	}
+
+	tunnel, err := tunneler.Tunnel(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open tunnel to %s: %s", opts.Remote, err)
+	}
+
+	if opts.Reverse {
+		logger.Infof("opened tunnel from %s to %s", tunnel.Remote, tunnel.Local)
+	} else {
+		logger.Infof("opened tunnel from %s to %s", tunnel.Local, tunnel.Remote)
+	}
+
+	return tunnel, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/jtopjian/bagel/lib/resources/exec"
 	"github.com/jtopjian/bagel/lib/resources/file"
 	"github.com/jtopjian/bagel/lib/resources/log"
+	"github.com/jtopjian/bagel/lib/resources/net"
 	"github.com/jtopjian/bagel/lib/resources/util"
 )
 
@@ -47,6 +48,13 @@ func Register(L *lua.LState) {
 		L.SetField(mt, k, L.NewFunction(v))
 	}
 
+	// Register Net
+	mt = L.NewTypeMetatable(net.Register.LuaName)
+	L.SetGlobal(net.Register.LuaName, mt)
+	for k, v := range net.Register.Resources {
+		L.SetField(mt, k, L.NewFunction(v))
+	}
+
 	// Register Util
 	mt = L.NewTypeMetatable(util.Register.LuaName)
 	L.SetGlobal(util.Register.LuaName, mt)
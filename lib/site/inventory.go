@@ -61,12 +61,7 @@ func (r *Inventory) DiscoverTargets() error {
 		return err
 	}
 
-	for _, target := range discoveredTargets {
-		r.Targets = append(r.Targets, inventories.Target{
-			Name:    target.Name,
-			Address: target.Address,
-		})
-	}
+	r.Targets = append(r.Targets, discoveredTargets...)
 
 	return nil
 }
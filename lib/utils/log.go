@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"bytes"
+	"sync"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -19,3 +22,42 @@ func SetLogFields(logger *logrus.Logger, fields map[string]interface{}) *logrus.
 	v := logrus.Fields(fields)
 	return logger.WithFields(v)
 }
+
+// LogWriter is an io.Writer which logs each line written to it at
+// the info level. It is safe to write to from multiple goroutines.
+type LogWriter struct {
+	Logger *logrus.Entry
+	Prefix string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewLogWriter will return a LogWriter which logs to logger,
+// prefixing each line with prefix.
+func NewLogWriter(logger *logrus.Entry, prefix string) *LogWriter {
+	return &LogWriter{
+		Logger: logger,
+		Prefix: prefix,
+	}
+}
+
+// Write implements io.Writer. Incomplete lines are held until
+// the rest of the line is written.
+func (r *LogWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		r.Logger.Info(r.Prefix + string(r.buf[:i]))
+		r.buf = r.buf[i+1:]
+	}
+
+	return len(p), nil
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/spf13/viper"
+	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 )
 
@@ -49,3 +51,90 @@ func (pl *lStatePool) Shutdown() {
 var LuaPool = &lStatePool{
 	saved: make([]*lua.LState, 0, 0),
 }
+
+// MapLuaTable maps a Lua table to v. Unlike gluamapper.Map, the
+// table's keys are kept as they are so options such as become_user
+// match their snake_case mapstructure tags.
+func MapLuaTable(tbl *lua.LTable, v interface{}) error {
+	mapper := gluamapper.NewMapper(gluamapper.Option{
+		NameFunc: gluamapper.Id,
+	})
+
+	return mapper.Map(tbl, v)
+}
+
+// ToLValue converts a Go value, such as one decoded from YAML or JSON,
+// to a GopherLua value. Maps become tables and slices become arrays.
+// Values of other types are converted to strings.
+func ToLValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case []string:
+		tbl := L.NewTable()
+		for _, val := range v {
+			tbl.Append(lua.LString(val))
+		}
+		return tbl
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, val := range v {
+			tbl.Append(ToLValue(L, val))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for k, val := range v {
+			tbl.RawSetString(k, ToLValue(L, val))
+		}
+		return tbl
+	case map[interface{}]interface{}:
+		tbl := L.NewTable()
+		for k, val := range v {
+			tbl.RawSetString(fmt.Sprintf("%v", k), ToLValue(L, val))
+		}
+		return tbl
+	}
+
+	return lua.LString(fmt.Sprintf("%v", v))
+}
+
+// NewReadOnlyTable returns a table whose fields are the values of
+// fields. Each time a field is read, a new copy is returned, so
+// changes to a nested table aren't kept. Setting a field raises an
+// error which mentions name.
+func NewReadOnlyTable(L *lua.LState, name string, fields map[string]interface{}) *lua.LTable {
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		v, ok := fields[L.CheckString(2)]
+		if !ok {
+			L.Push(lua.LNil)
+			return 1
+		}
+
+		L.Push(ToLValue(L, v))
+		return 1
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("%s is read-only", name)
+		return 0
+	}))
+	mt.RawSetString("__metatable", lua.LString(name))
+
+	tbl := L.NewTable()
+	L.SetMetatable(tbl, mt)
+
+	return tbl
+}